@@ -4,9 +4,14 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
+// profileInfix separates the name of a processed M3U from the name of a
+// profile in the path of the playlist of the profile.
+const profileInfix = ".profile-"
+
 type Config struct {
 	DataPath string
 	TempPath string
@@ -36,11 +41,37 @@ func GetLatestProcessedM3UPath() (string, error) {
 		return "", fmt.Errorf("failed to read directory: %w", err)
 	}
 
-	if len(files) == 0 {
+	latest := ""
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".m3u" || strings.Contains(file.Name(), profileInfix) {
+			continue
+		}
+		latest = file.Name()
+	}
+
+	if latest == "" {
 		return "", fmt.Errorf("no files found in directory")
 	}
 
-	return files[len(files)-1].Name(), nil
+	return filepath.Join(dir, latest), nil
+}
+
+// GetProcessedProfilePath returns the path of the playlist of a profile that
+// is saved next to a processed M3U.
+func GetProcessedProfilePath(m3uPath string, profile string) string {
+	return strings.TrimSuffix(m3uPath, ".m3u") + profileInfix + profile + ".m3u"
+}
+
+// GetProcessedSnapshotPath returns the path of the channel snapshot that is
+// saved next to a processed M3U.
+func GetProcessedSnapshotPath(m3uPath string) string {
+	return strings.TrimSuffix(m3uPath, ".m3u") + ".channels.json"
+}
+
+// GetProcessedDiffPath returns the path of the sync diff that is saved next
+// to a processed M3U.
+func GetProcessedDiffPath(m3uPath string) string {
+	return strings.TrimSuffix(m3uPath, ".m3u") + ".diff.json"
 }
 
 func GetNewM3UPath() string {
@@ -57,6 +88,8 @@ func ClearOldProcessedM3U(latestFilename string) error {
 		return fmt.Errorf("failed to read directory: %w", err)
 	}
 
+	latestPrefix := strings.TrimSuffix(filepath.Base(latestFilename), ".m3u") + "."
+
 	for _, file := range files {
 		if file.IsDir() {
 			continue
@@ -64,7 +97,8 @@ func ClearOldProcessedM3U(latestFilename string) error {
 
 		filePath := filepath.Join(dir, file.Name())
 
-		if filePath == latestFilename {
+		// Keep the latest M3U together with the files saved next to it.
+		if filePath == latestFilename || strings.HasPrefix(file.Name(), latestPrefix) {
 			continue
 		}
 
@@ -77,6 +111,16 @@ func ClearOldProcessedM3U(latestFilename string) error {
 	return nil
 }
 
+// GetChannelNumbersPath returns the path of the channel numbers assigned on
+// the previous syncs to the playlist of a profile, or to the main playlist if
+// profile is empty.
+func GetChannelNumbersPath(profile string) string {
+	if profile != "" {
+		return filepath.Join(globalConfig.DataPath, "channel_numbers."+profile+".json")
+	}
+	return filepath.Join(globalConfig.DataPath, "channel_numbers.json")
+}
+
 func GetStreamsDirPath() string {
 	return filepath.Join(globalConfig.DataPath, "streams/")
 }
@@ -88,3 +132,9 @@ func GetSourcesDirPath() string {
 func GetSortDirPath() string {
 	return filepath.Join(globalConfig.TempPath, "sorter/")
 }
+
+// GetProfileSortDirPath returns the directory the channels of the playlist of
+// a profile are sorted in.
+func GetProfileSortDirPath(profile string) string {
+	return filepath.Join(globalConfig.TempPath, "sorter-"+profile)
+}
@@ -1,28 +1,84 @@
 package handlers
 
 import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
+	"m3u-stream-merger/config"
 	"m3u-stream-merger/logger"
+	"m3u-stream-merger/sourceproc"
 )
 
+// SourceSyncer starts a sync of the given sources, or of all of them if none
+// is given.
+type SourceSyncer interface {
+	SyncSources(indexes ...string) error
+}
+
+// ConfigReloader reloads the settings and regenerates the merged M3U.
+type ConfigReloader interface {
+	ReloadConfig() error
+}
+
 type M3UHTTPHandler struct {
-	logger        logger.Logger
+	logger   logger.Logger
+	syncer   SourceSyncer
+	reloader ConfigReloader
+
+	// The main playlist and the playlists of the profiles are replaced
+	// together, so that requests never mix the playlists of two syncs.
+	pathsMu       sync.RWMutex
 	processedPath string
+	profilePaths  map[string]string
+
+	channelsMu sync.Mutex
+	channels   map[string]map[string]string
 }
 
 func NewM3UHTTPHandler(logger logger.Logger, processedPath string) *M3UHTTPHandler {
 	return &M3UHTTPHandler{
 		logger:        logger,
 		processedPath: processedPath,
+		channels:      make(map[string]map[string]string),
 	}
 }
 
-func (h *M3UHTTPHandler) SetProcessedPath(path string) {
-	h.processedPath = path
+// SetPlaylistPaths sets the main playlist and the playlists of the profiles,
+// keyed by profile name.
+func (h *M3UHTTPHandler) SetPlaylistPaths(processedPath string, profilePaths map[string]string) {
+	h.pathsMu.Lock()
+	defer h.pathsMu.Unlock()
+
+	h.processedPath = processedPath
+	h.profilePaths = profilePaths
+}
+
+// playlistPaths returns the main playlist and the playlists of the profiles
+// of the same sync.
+func (h *M3UHTTPHandler) playlistPaths() (string, map[string]string) {
+	h.pathsMu.RLock()
+	defer h.pathsMu.RUnlock()
+
+	return h.processedPath, h.profilePaths
+}
+
+func (h *M3UHTTPHandler) SetSyncer(syncer SourceSyncer) {
+	h.syncer = syncer
+}
+
+func (h *M3UHTTPHandler) SetReloader(reloader ConfigReloader) {
+	h.reloader = reloader
 }
 
 func (h *M3UHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -33,22 +89,332 @@ func (h *M3UHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if h.processedPath == "" {
+	access := getUserAccess(r.URL.Query().Get("username"))
+	h.servePlaylist(w, r, h.accessPath(access), access)
+}
+
+// ServeProfileHTTP serves the playlist of a profile (e.g.
+// /playlist/kids.m3u).
+func (h *M3UHTTPHandler) ServeProfileHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	isAuthorized := h.handleAuth(r)
+	if !isAuthorized {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	profile, ok := strings.CutSuffix(path.Base(r.URL.Path), ".m3u")
+	if !ok || !slices.Contains(sourceproc.Profiles(), profile) {
+		http.Error(w, "Unknown playlist profile.", http.StatusNotFound)
+		return
+	}
+
+	// Restricted users only have access to their own playlist.
+	access := getUserAccess(r.URL.Query().Get("username"))
+	if access != nil && access.profile != profile {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	_, profilePaths := h.playlistPaths()
+	h.servePlaylist(w, r, profilePaths[profile], access)
+}
+
+// servePlaylist serves a processed M3U, without the channels of the groups
+// the user is not entitled to or that don't match the filter of the query.
+func (h *M3UHTTPHandler) servePlaylist(w http.ResponseWriter, r *http.Request, processedPath string, access *userAccess) {
+	if processedPath == "" {
 		http.Error(w, "No processed M3U found.", http.StatusNotFound)
 		return
 	}
 
-	http.ServeFile(w, r, h.processedPath)
+	streamQuery, err := h.streamQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter, err := parsePlaylistFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(streamQuery) == 0 && !access.restrictsGroups() && filter.empty() {
+		http.ServeFile(w, r, processedPath)
+		return
+	}
+
+	h.serveChannels(w, r, processedPath, streamQuery, access, filter)
 }
 
-func (h *M3UHTTPHandler) handleAuth(r *http.Request) bool {
-	credentials := os.Getenv("CREDENTIALS")
-	if credentials == "" || strings.ToLower(credentials) == "none" {
-		// No authentication required.
+// streamQuery returns the query parameters to add to the stream URLs of the
+// playlist: the quality given to the playlist URL (e.g.
+// /playlist.m3u?quality=4k), or else the default quality of the user from
+// USER_QUALITY, and the credentials of the user when stream requests are
+// checked against USER_PROFILE and USER_GROUPS.
+func (h *M3UHTTPHandler) streamQuery(r *http.Request) (url.Values, error) {
+	if os.Getenv("BYPASS_PROXY") == "true" {
+		return nil, nil
+	}
+
+	query := url.Values{}
+	if user := r.URL.Query().Get("username"); user != "" && userAccessEnabled() {
+		query.Set("username", user)
+		if pass := r.URL.Query().Get("password"); pass != "" {
+			query.Set("password", pass)
+		}
+	}
+
+	quality, mode := r.URL.Query().Get("quality"), r.URL.Query().Get("quality_mode")
+	if quality == "" {
+		quality, mode = h.userQuality(r.URL.Query().Get("username"))
+	}
+	if quality == "" {
+		return query, nil
+	}
+
+	if _, ok := sourceproc.ParseQuality(quality); !ok {
+		return nil, fmt.Errorf("unknown quality: %s", quality)
+	}
+	query.Set("quality", quality)
+	switch strings.ToLower(mode) {
+	case "", "prefer":
+	case "require":
+		query.Set("quality_mode", "require")
+	default:
+		return nil, fmt.Errorf("unknown quality mode: %s", mode)
+	}
+
+	return query, nil
+}
+
+// userQuality returns the default quality of a user from USER_QUALITY, in the
+// form user1:4k|user2:sd:require.
+func (h *M3UHTTPHandler) userQuality(user string) (quality, mode string) {
+	if user == "" {
+		return "", ""
+	}
+
+	for _, item := range strings.Split(os.Getenv("USER_QUALITY"), "|") {
+		parts := strings.Split(strings.TrimSpace(item), ":")
+		if len(parts) < 2 || !strings.EqualFold(parts[0], user) {
+			continue
+		}
+		if len(parts) == 3 {
+			return parts[1], parts[2]
+		}
+		return parts[1], ""
+	}
+	return "", ""
+}
+
+// serveChannels serves the channels of the processed M3U the user is
+// entitled to and that match the filter, with the query added to each stream
+// URL. The file is read one channel at a time, so that large playlists are
+// not loaded into memory.
+func (h *M3UHTTPHandler) serveChannels(w http.ResponseWriter, r *http.Request, processedPath string, query url.Values, access *userAccess, filter *playlistFilter) {
+	file, err := os.Open(processedPath)
+	if err != nil {
+		http.Error(w, "No processed M3U found.", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	if contentType := mime.TypeByExtension(filepath.Ext(processedPath)); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	encodedQuery := query.Encode()
+	writer := bufio.NewWriter(w)
+
+	// The lines of a channel, from its #EXTINF line to its stream URL, are
+	// kept until the stream URL tells whether the channel is served.
+	var entry []string
+	inChannels := false
+	matched := 0
+	err = readPlaylistLines(file, func(line string) bool {
+		if strings.HasPrefix(line, "#EXTINF") {
+			entry = entry[:0]
+			inChannels = true
+		}
+		if !inChannels {
+			// Lines before the first channel, such as #EXTM3U.
+			_, _ = writer.WriteString(line)
+			_ = writer.WriteByte('\n')
+			return true
+		}
+		entry = append(entry, line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			return true
+		}
+
+		title, attributes := sourceproc.ParseExtInf(entry[0])
+		if !access.allowsGroup(attributes["group-title"]) || !filter.matches(title, attributes, line) {
+			return true
+		}
+		matched++
+		if matched <= filter.offset {
+			return true
+		}
+		if filter.limit >= 0 && matched-filter.offset > filter.limit {
+			return false
+		}
+
+		if encodedQuery != "" {
+			separator := "?"
+			if strings.Contains(line, "?") {
+				separator = "&"
+			}
+			entry[len(entry)-1] = line + separator + encodedQuery
+		}
+		for _, entryLine := range entry {
+			_, _ = writer.WriteString(entryLine)
+			_ = writer.WriteByte('\n')
+		}
 		return true
+	})
+	if err != nil {
+		h.logger.Errorf("Error reading processed M3U: %v", err)
+	}
+	_ = writer.Flush()
+}
+
+// readPlaylistLines calls fn with each line of a processed M3U, without its
+// line ending, until fn returns false. Lines can be of any length, as stream
+// URLs and attributes are.
+func readPlaylistLines(r io.Reader, fn func(line string) bool) error {
+	reader := bufio.NewReaderSize(r, 64*1024)
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 && !fn(strings.TrimRight(line, "\r\n")) {
+			return nil
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ServeDiffHTTP serves the sync diff saved next to the current processed M3U.
+func (h *M3UHTTPHandler) ServeDiffHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	isAuthorized := h.handleAuth(r)
+	if !isAuthorized {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	processedPath, _ := h.playlistPaths()
+	if processedPath == "" {
+		http.Error(w, "No processed M3U found.", http.StatusNotFound)
+		return
+	}
+
+	diffPath := config.GetProcessedDiffPath(processedPath)
+	if _, err := os.Stat(diffPath); err != nil {
+		http.Error(w, "No sync diff found.", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	http.ServeFile(w, r, diffPath)
+}
+
+// ServeSyncHTTP starts a sync of the sources given by the index query
+// parameter (e.g. /sync?index=1,3). The other sources are rebuilt from their
+// cached copies. Without index, every source is synced.
+func (h *M3UHTTPHandler) ServeSyncHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	isAuthorized := h.handleAuth(r)
+	if !isAuthorized {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.syncer == nil {
+		http.Error(w, "Sync is not available.", http.StatusServiceUnavailable)
+		return
+	}
+
+	var indexes []string
+	for _, value := range r.URL.Query()["index"] {
+		for _, idx := range strings.Split(value, ",") {
+			if idx = strings.TrimSpace(idx); idx != "" {
+				indexes = append(indexes, idx)
+			}
+		}
+	}
+
+	if err := h.syncer.SyncSources(indexes...); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(indexes) > 0 {
+		h.logger.Logf("Sync of M3U_%s requested via HTTP", strings.Join(indexes, ", M3U_"))
+	} else {
+		h.logger.Log("Sync of all sources requested via HTTP")
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ServeReloadHTTP reloads the settings and regenerates the merged M3U from the
+// cached sources.
+func (h *M3UHTTPHandler) ServeReloadHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	isAuthorized := h.handleAuth(r)
+	if !isAuthorized {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.reloader == nil {
+		http.Error(w, "Reload is not available.", http.StatusServiceUnavailable)
+		return
+	}
+
+	if err := h.reloader.ReloadConfig(); err != nil {
+		h.logger.Errorf("Error reloading config: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.logger.Log("Config reload requested via HTTP")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// credentialsEnabled reports whether requests must be authenticated.
+func credentialsEnabled() bool {
+	credentials := os.Getenv("CREDENTIALS")
+	return credentials != "" && strings.ToLower(credentials) != "none"
+}
+
+func (h *M3UHTTPHandler) handleAuth(r *http.Request) bool {
+	if !credentialsEnabled() {
+		// No authentication required, unless users are restricted: their
+		// requests couldn't be told apart from anonymous ones.
+		return !userAccessEnabled()
 	}
 
-	creds := h.parseCredentials(credentials)
+	creds := h.parseCredentials(os.Getenv("CREDENTIALS"))
 	user, pass := r.URL.Query().Get("username"), r.URL.Query().Get("password")
 	if user == "" || pass == "" {
 		return false
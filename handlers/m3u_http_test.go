@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"context"
+	"fmt"
 	"m3u-stream-merger/config"
 	"m3u-stream-merger/logger"
 	"m3u-stream-merger/sourceproc"
@@ -9,6 +10,8 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -214,3 +217,651 @@ func TestM3UHTTPHandler_Headers(t *testing.T) {
 		}
 	}
 }
+
+type mockSourceSyncer struct {
+	indexes [][]string
+}
+
+func (m *mockSourceSyncer) SyncSources(indexes ...string) error {
+	for _, idx := range indexes {
+		if idx != "1" && idx != "2" {
+			return fmt.Errorf("unknown M3U index: %s", idx)
+		}
+	}
+	m.indexes = append(m.indexes, indexes)
+	return nil
+}
+
+func TestM3UHTTPHandler_Sync(t *testing.T) {
+	os.Setenv("CREDENTIALS", "")
+
+	tests := []struct {
+		name        string
+		method      string
+		query       string
+		wantStatus  int
+		wantIndexes []string
+	}{
+		{
+			name:       "All sources",
+			method:     http.MethodPost,
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:        "Single source",
+			method:      http.MethodPost,
+			query:       "index=2",
+			wantStatus:  http.StatusAccepted,
+			wantIndexes: []string{"2"},
+		},
+		{
+			name:        "Several sources",
+			method:      http.MethodPost,
+			query:       "index=1,2",
+			wantStatus:  http.StatusAccepted,
+			wantIndexes: []string{"1", "2"},
+		},
+		{
+			name:       "Unknown source",
+			method:     http.MethodPost,
+			query:      "index=3",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "GET is not allowed",
+			method:     http.MethodGet,
+			query:      "index=1",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			syncer := &mockSourceSyncer{}
+			handler := NewM3UHTTPHandler(&logger.DefaultLogger{}, "")
+			handler.SetSyncer(syncer)
+
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(tt.method, "/sync?"+tt.query, nil)
+			handler.ServeSyncHTTP(recorder, request)
+
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("Expected status code %d, got %d", tt.wantStatus, recorder.Code)
+			}
+			if tt.wantStatus != http.StatusAccepted {
+				if len(syncer.indexes) != 0 {
+					t.Errorf("Expected no sync, got %v", syncer.indexes)
+				}
+				return
+			}
+			if len(syncer.indexes) != 1 || !reflect.DeepEqual(syncer.indexes[0], tt.wantIndexes) {
+				t.Errorf("Expected sync of %v, got %v", tt.wantIndexes, syncer.indexes)
+			}
+		})
+	}
+}
+
+type mockConfigReloader struct {
+	err     error
+	reloads int
+}
+
+func (m *mockConfigReloader) ReloadConfig() error {
+	if m.err != nil {
+		return m.err
+	}
+	m.reloads++
+	return nil
+}
+
+func TestM3UHTTPHandler_Reload(t *testing.T) {
+	os.Setenv("CREDENTIALS", "")
+
+	tests := []struct {
+		name        string
+		method      string
+		err         error
+		wantStatus  int
+		wantReloads int
+	}{
+		{
+			name:        "Reload",
+			method:      http.MethodPost,
+			wantStatus:  http.StatusAccepted,
+			wantReloads: 1,
+		},
+		{
+			name:       "Invalid config",
+			method:     http.MethodPost,
+			err:        fmt.Errorf("invalid FILTER_EXPRESSION"),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "GET is not allowed",
+			method:     http.MethodGet,
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reloader := &mockConfigReloader{err: tt.err}
+			handler := NewM3UHTTPHandler(&logger.DefaultLogger{}, "")
+			handler.SetReloader(reloader)
+
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(tt.method, "/reload", nil)
+			handler.ServeReloadHTTP(recorder, request)
+
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("Expected status code %d, got %d", tt.wantStatus, recorder.Code)
+			}
+			if reloader.reloads != tt.wantReloads {
+				t.Errorf("Expected %d reloads, got %d", tt.wantReloads, reloader.reloads)
+			}
+		})
+	}
+}
+
+func TestM3UHTTPHandler_StreamQuality(t *testing.T) {
+	t.Setenv("CREDENTIALS", "")
+	t.Setenv("USER_QUALITY", "tv:4k|phone:sd:require")
+
+	playlist := "#EXTM3U\n" +
+		"#EXTINF:-1,CNN\nhttp://example.com/p/cnn/abc.m3u8\n" +
+		"#EXTINF:-1,BBC\nhttp://example.com/p/bbc/def.ts?token=1\n"
+	processedPath := filepath.Join(t.TempDir(), "processed.m3u")
+	if err := os.WriteFile(processedPath, []byte(playlist), 0644); err != nil {
+		t.Fatalf("Failed to write playlist: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "No quality",
+			query:      "",
+			wantStatus: http.StatusOK,
+			wantBody:   playlist,
+		},
+		{
+			name:       "User default",
+			query:      "?username=tv",
+			wantStatus: http.StatusOK,
+			wantBody: "#EXTM3U\n" +
+				"#EXTINF:-1,CNN\nhttp://example.com/p/cnn/abc.m3u8?quality=4k\n" +
+				"#EXTINF:-1,BBC\nhttp://example.com/p/bbc/def.ts?token=1&quality=4k\n",
+		},
+		{
+			name:       "User default required",
+			query:      "?username=phone",
+			wantStatus: http.StatusOK,
+			wantBody: "#EXTM3U\n" +
+				"#EXTINF:-1,CNN\nhttp://example.com/p/cnn/abc.m3u8?quality=sd&quality_mode=require\n" +
+				"#EXTINF:-1,BBC\nhttp://example.com/p/bbc/def.ts?token=1&quality=sd&quality_mode=require\n",
+		},
+		{
+			name:       "Query overrides user default",
+			query:      "?username=tv&quality=hd",
+			wantStatus: http.StatusOK,
+			wantBody: "#EXTM3U\n" +
+				"#EXTINF:-1,CNN\nhttp://example.com/p/cnn/abc.m3u8?quality=hd\n" +
+				"#EXTINF:-1,BBC\nhttp://example.com/p/bbc/def.ts?token=1&quality=hd\n",
+		},
+		{
+			name:       "Unknown quality",
+			query:      "?quality=ultra",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := NewM3UHTTPHandler(&logger.DefaultLogger{}, processedPath)
+
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodGet, "/playlist.m3u"+tt.query, nil)
+			handler.ServeHTTP(recorder, request)
+
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("Expected status code %d, got %d", tt.wantStatus, recorder.Code)
+			}
+			if tt.wantBody != "" && recorder.Body.String() != tt.wantBody {
+				t.Errorf("Expected body:\n%s\ngot:\n%s", tt.wantBody, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestM3UHTTPHandler_Profiles(t *testing.T) {
+	t.Setenv("CREDENTIALS", "")
+	t.Setenv("PLAYLIST_PROFILES", "kids,sports-bar")
+
+	tempDir := t.TempDir()
+	mainPath := filepath.Join(tempDir, "processed.m3u")
+	kidsPath := filepath.Join(tempDir, "processed.profile-kids.m3u")
+	for path, content := range map[string]string{
+		mainPath: "#EXTM3U\n#EXTINF:-1,CNN\nhttp://example.com/p/cnn/abc.m3u8\n",
+		kidsPath: "#EXTM3U\n#EXTINF:-1,Cartoon Network\nhttp://example.com/p/cn/def.m3u8\n",
+	} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write playlist: %v", err)
+		}
+	}
+
+	handler := NewM3UHTTPHandler(&logger.DefaultLogger{}, "")
+	handler.SetPlaylistPaths(mainPath, map[string]string{"kids": kidsPath})
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "Profile",
+			path:       "/playlist/kids.m3u",
+			wantStatus: http.StatusOK,
+			wantBody:   "#EXTM3U\n#EXTINF:-1,Cartoon Network\nhttp://example.com/p/cn/def.m3u8\n",
+		},
+		{
+			name:       "Profile with stream query",
+			path:       "/playlist/kids.m3u?quality=hd",
+			wantStatus: http.StatusOK,
+			wantBody:   "#EXTM3U\n#EXTINF:-1,Cartoon Network\nhttp://example.com/p/cn/def.m3u8?quality=hd\n",
+		},
+		{
+			name:       "Profile not processed yet",
+			path:       "/playlist/sports-bar.m3u",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "Unknown profile",
+			path:       "/playlist/living-room.m3u",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "Not a playlist",
+			path:       "/playlist/kids",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			handler.ServeProfileHTTP(recorder, request)
+
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("Expected status code %d, got %d", tt.wantStatus, recorder.Code)
+			}
+			if tt.wantBody != "" && recorder.Body.String() != tt.wantBody {
+				t.Errorf("Expected body:\n%s\ngot:\n%s", tt.wantBody, recorder.Body.String())
+			}
+		})
+	}
+
+	t.Run("Playlists replaced by a sync", func(t *testing.T) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 100; i++ {
+				handler.SetPlaylistPaths(mainPath, map[string]string{"kids": kidsPath})
+			}
+		}()
+
+		for i := 0; i < 100; i++ {
+			for _, path := range []string{"/playlist.m3u", "/playlist/kids.m3u"} {
+				recorder := httptest.NewRecorder()
+				request := httptest.NewRequest(http.MethodGet, path, nil)
+				if path == "/playlist.m3u" {
+					handler.ServeHTTP(recorder, request)
+				} else {
+					handler.ServeProfileHTTP(recorder, request)
+				}
+				if recorder.Code != http.StatusOK {
+					t.Fatalf("Expected status code %d for %s, got %d", http.StatusOK, path, recorder.Code)
+				}
+			}
+		}
+		<-done
+	})
+}
+
+func TestM3UHTTPHandler_UserAccess(t *testing.T) {
+	t.Setenv("CREDENTIALS", "admin:secret|kid:pass|guest:pass")
+	t.Setenv("PLAYLIST_PROFILES", "kids,sports-bar")
+	t.Setenv("USER_PROFILE", "kid:kids")
+	t.Setenv("USER_GROUPS", "guest:news, Kids")
+
+	cnn := sourceproc.EncodeSlug(&sourceproc.StreamInfo{Title: "CNN", Group: "News"})
+	espn := sourceproc.EncodeSlug(&sourceproc.StreamInfo{Title: "ESPN", Group: "Sports"})
+	cartoons := sourceproc.EncodeSlug(&sourceproc.StreamInfo{Title: "Cartoon Network", Group: "Kids"})
+
+	tempDir := t.TempDir()
+	mainPath := filepath.Join(tempDir, "processed.m3u")
+	kidsPath := filepath.Join(tempDir, "processed.profile-kids.m3u")
+	mainPlaylist := "#EXTM3U\n" +
+		"#EXTINF:-1 group-title=\"News\",CNN\nhttp://example.com/p/cnn/" + cnn + ".m3u8\n" +
+		"#EXTINF:-1 group-title=\"Sports\",ESPN\n#EXTVLCOPT:http-user-agent=VLC\nhttp://example.com/p/espn/" + espn + ".m3u8\n" +
+		"#EXTINF:-1 group-title=\"Kids\",Cartoon Network\nhttp://example.com/p/cn/" + cartoons + ".m3u8\n"
+	kidsPlaylist := "#EXTM3U\n" +
+		"#EXTINF:-1 group-title=\"Kids\",Cartoon Network\nhttp://example.com/p/cn/" + cartoons + ".m3u8\n"
+	for path, content := range map[string]string{mainPath: mainPlaylist, kidsPath: kidsPlaylist} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write playlist: %v", err)
+		}
+	}
+
+	if err := ValidateUserAccess(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	handler := NewM3UHTTPHandler(&logger.DefaultLogger{}, "")
+	handler.SetPlaylistPaths(mainPath, map[string]string{"kids": kidsPath})
+
+	playlistTests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "Unrestricted user",
+			path:       "/playlist.m3u?username=admin&password=secret",
+			wantStatus: http.StatusOK,
+			wantBody: "#EXTM3U\n" +
+				"#EXTINF:-1 group-title=\"News\",CNN\nhttp://example.com/p/cnn/" + cnn + ".m3u8?password=secret&username=admin\n" +
+				"#EXTINF:-1 group-title=\"Sports\",ESPN\n#EXTVLCOPT:http-user-agent=VLC\nhttp://example.com/p/espn/" + espn + ".m3u8?password=secret&username=admin\n" +
+				"#EXTINF:-1 group-title=\"Kids\",Cartoon Network\nhttp://example.com/p/cn/" + cartoons + ".m3u8?password=secret&username=admin\n",
+		},
+		{
+			name:       "Profile of the user",
+			path:       "/playlist.m3u?username=kid&password=pass",
+			wantStatus: http.StatusOK,
+			wantBody: "#EXTM3U\n" +
+				"#EXTINF:-1 group-title=\"Kids\",Cartoon Network\nhttp://example.com/p/cn/" + cartoons + ".m3u8?password=pass&username=kid\n",
+		},
+		{
+			name:       "Groups of the user",
+			path:       "/playlist.m3u?username=guest&password=pass&quality=hd",
+			wantStatus: http.StatusOK,
+			wantBody: "#EXTM3U\n" +
+				"#EXTINF:-1 group-title=\"News\",CNN\nhttp://example.com/p/cnn/" + cnn + ".m3u8?password=pass&quality=hd&username=guest\n" +
+				"#EXTINF:-1 group-title=\"Kids\",Cartoon Network\nhttp://example.com/p/cn/" + cartoons + ".m3u8?password=pass&quality=hd&username=guest\n",
+		},
+		{
+			name:       "Own profile playlist",
+			path:       "/playlist/kids.m3u?username=kid&password=pass",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Other profile playlist",
+			path:       "/playlist/sports-bar.m3u?username=kid&password=pass",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "Profile playlist of a user restricted to groups",
+			path:       "/playlist/kids.m3u?username=guest&password=pass",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "No credentials",
+			path:       "/playlist.m3u",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "User without password",
+			path:       "/playlist.m3u?username=admin",
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range playlistTests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if strings.HasPrefix(tt.path, "/playlist/") {
+				handler.ServeProfileHTTP(recorder, request)
+			} else {
+				handler.ServeHTTP(recorder, request)
+			}
+
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("Expected status code %d, got %d", tt.wantStatus, recorder.Code)
+			}
+			if tt.wantBody != "" && recorder.Body.String() != tt.wantBody {
+				t.Errorf("Expected body:\n%s\ngot:\n%s", tt.wantBody, recorder.Body.String())
+			}
+		})
+	}
+
+	// A slug claiming another group is checked against the playlist.
+	forged := sourceproc.EncodeSlug(&sourceproc.StreamInfo{Title: "ESPN", Group: "News"})
+
+	streamTests := []struct {
+		name  string
+		query string
+		slug  string
+		want  bool
+	}{
+		{"Unrestricted user", "?username=admin&password=secret", espn, true},
+		{"Channel of the profile", "?username=kid&password=pass", cartoons, true},
+		{"Channel outside of the profile", "?username=kid&password=pass", cnn, false},
+		{"Channel of an allowed group", "?username=guest&password=pass", cnn, true},
+		{"Channel of another group", "?username=guest&password=pass", espn, false},
+		{"Forged group", "?username=guest&password=pass", forged, false},
+		{"Invalid slug", "?username=guest&password=pass", "invalid", false},
+		{"Wrong password", "?username=kid&password=wrong", cartoons, false},
+		{"No credentials", "", cartoons, false},
+	}
+
+	for _, tt := range streamTests {
+		t.Run("Stream "+tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/p/stream/"+tt.slug+".m3u8"+tt.query, nil)
+			if got := handler.AuthorizeStream(request, tt.slug); got != tt.want {
+				t.Errorf("Expected AuthorizeStream to return %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	t.Run("Restricted users without CREDENTIALS", func(t *testing.T) {
+		t.Setenv("CREDENTIALS", "")
+
+		if err := ValidateUserAccess(); err == nil {
+			t.Errorf("Expected an error for USER_PROFILE and USER_GROUPS without CREDENTIALS")
+		}
+
+		// Requests are refused, with or without a user.
+		for _, query := range []string{"", "?username=admin", "?username=kid"} {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/playlist.m3u"+query, nil))
+			if recorder.Code != http.StatusForbidden {
+				t.Errorf("Expected status code %d for %q, got %d", http.StatusForbidden, query, recorder.Code)
+			}
+
+			request := httptest.NewRequest(http.MethodGet, "/p/stream/"+cartoons+".m3u8"+query, nil)
+			if handler.AuthorizeStream(request, cartoons) {
+				t.Errorf("Expected the stream to be refused for %q", query)
+			}
+		}
+	})
+
+	t.Run("Stream without restricted users", func(t *testing.T) {
+		t.Setenv("USER_PROFILE", "")
+		t.Setenv("USER_GROUPS", "")
+
+		request := httptest.NewRequest(http.MethodGet, "/p/stream/"+cnn+".m3u8", nil)
+		if !handler.AuthorizeStream(request, cnn) {
+			t.Errorf("Expected streams to be allowed without USER_PROFILE and USER_GROUPS")
+		}
+	})
+}
+
+func TestM3UHTTPHandler_Filters(t *testing.T) {
+	t.Setenv("CREDENTIALS", "")
+	t.Setenv("USER_PROFILE", "")
+	t.Setenv("USER_GROUPS", "")
+
+	entries := []string{
+		"#EXTINF:-1 group-title=\"News\" tvg-type=\"live\",CNN\nhttp://example.com/p/cnn/" +
+			sourceproc.EncodeSlug(&sourceproc.StreamInfo{Title: "CNN", SourceM3U: "1"}) + ".m3u8\n",
+		"#EXTINF:-1 group-title=\"News\" tvg-type=\"live\",BBC News\n#EXTVLCOPT:http-user-agent=VLC\nhttp://example.com/p/bbc/" +
+			sourceproc.EncodeSlug(&sourceproc.StreamInfo{Title: "BBC News", SourceM3U: "2"}) + ".m3u8\n",
+		"#EXTINF:-1 group-title=\"Sports\" tvg-type=\"live\",BBC Sport\nhttp://example.com/p/bbc/" +
+			sourceproc.EncodeSlug(&sourceproc.StreamInfo{Title: "BBC Sport", SourceM3U: "2"}) + ".m3u8\n",
+		"#EXTINF:-1 group-title=\"Movies\" tvg-type=\"movie\",Heat (1995)\nhttp://example.com/p/movie/" +
+			sourceproc.EncodeSlug(&sourceproc.StreamInfo{Title: "Heat (1995)", SourceM3U: "3"}) + ".mkv\n",
+	}
+	playlist := func(indexes ...int) string {
+		content := "#EXTM3U\n"
+		for _, i := range indexes {
+			content += entries[i]
+		}
+		return content
+	}
+
+	processedPath := filepath.Join(t.TempDir(), "processed.m3u")
+	if err := os.WriteFile(processedPath, []byte(playlist(0, 1, 2, 3)), 0644); err != nil {
+		t.Fatalf("Failed to write playlist: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "No filter",
+			query:      "",
+			wantStatus: http.StatusOK,
+			wantBody:   playlist(0, 1, 2, 3),
+		},
+		{
+			name:       "Group",
+			query:      "?group=news",
+			wantStatus: http.StatusOK,
+			wantBody:   playlist(0, 1),
+		},
+		{
+			name:       "Several groups",
+			query:      "?group=Sports,Movies",
+			wantStatus: http.StatusOK,
+			wantBody:   playlist(2, 3),
+		},
+		{
+			name:       "Search",
+			query:      "?search=bbc",
+			wantStatus: http.StatusOK,
+			wantBody:   playlist(1, 2),
+		},
+		{
+			name:       "Type",
+			query:      "?type=MOVIE",
+			wantStatus: http.StatusOK,
+			wantBody:   playlist(3),
+		},
+		{
+			name:       "Source",
+			query:      "?source=2",
+			wantStatus: http.StatusOK,
+			wantBody:   playlist(1, 2),
+		},
+		{
+			name:       "Combined filters",
+			query:      "?search=bbc&group=Sports&source=2&type=live",
+			wantStatus: http.StatusOK,
+			wantBody:   playlist(2),
+		},
+		{
+			name:       "Offset and limit",
+			query:      "?offset=1&limit=2",
+			wantStatus: http.StatusOK,
+			wantBody:   playlist(1, 2),
+		},
+		{
+			name:       "Limit of filtered channels",
+			query:      "?type=live&offset=2&limit=5",
+			wantStatus: http.StatusOK,
+			wantBody:   playlist(2),
+		},
+		{
+			name:       "Zero limit",
+			query:      "?limit=0",
+			wantStatus: http.StatusOK,
+			wantBody:   playlist(),
+		},
+		{
+			name:       "Invalid limit",
+			query:      "?limit=ten",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "Negative offset",
+			query:      "?offset=-1",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := NewM3UHTTPHandler(&logger.DefaultLogger{}, processedPath)
+
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodGet, "/playlist.m3u"+tt.query, nil)
+			handler.ServeHTTP(recorder, request)
+
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("Expected status code %d, got %d", tt.wantStatus, recorder.Code)
+			}
+			if tt.wantBody != "" && recorder.Body.String() != tt.wantBody {
+				t.Errorf("Expected body:\n%s\ngot:\n%s", tt.wantBody, recorder.Body.String())
+			}
+		})
+	}
+
+	t.Run("Filter within the groups of the user", func(t *testing.T) {
+		t.Setenv("CREDENTIALS", "guest:pass")
+		t.Setenv("USER_GROUPS", "guest:News")
+		handler := NewM3UHTTPHandler(&logger.DefaultLogger{}, processedPath)
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/playlist.m3u?username=guest&password=pass&search=bbc&quality=hd", nil))
+		want := strings.Replace(playlist(1), ".m3u8\n", ".m3u8?password=pass&quality=hd&username=guest\n", 1)
+		if recorder.Code != http.StatusOK || recorder.Body.String() != want {
+			t.Errorf("Expected status code %d and body:\n%s\ngot %d:\n%s", http.StatusOK, want, recorder.Code, recorder.Body.String())
+		}
+	})
+
+	t.Run("Lines longer than the read buffer", func(t *testing.T) {
+		long := "#EXTINF:-1 group-title=\"News\" tvg-logo=\"http://example.com/" + strings.Repeat("a", 2*1024*1024) + "\",Long\n" +
+			"http://example.com/p/long/" + sourceproc.EncodeSlug(&sourceproc.StreamInfo{Title: "Long"}) + ".m3u8\n"
+		longPath := filepath.Join(t.TempDir(), "processed.m3u")
+		if err := os.WriteFile(longPath, []byte(playlist(0)+long+entries[1]), 0644); err != nil {
+			t.Fatalf("Failed to write playlist: %v", err)
+		}
+		handler := NewM3UHTTPHandler(&logger.DefaultLogger{}, longPath)
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/playlist.m3u?group=News", nil))
+		if want := playlist(0) + long + entries[1]; recorder.Body.String() != want {
+			t.Errorf("Expected the whole playlist of %d bytes, got %d bytes", len(want), recorder.Body.Len())
+		}
+	})
+
+	t.Run("Source with bypassed proxy", func(t *testing.T) {
+		t.Setenv("BYPASS_PROXY", "true")
+		handler := NewM3UHTTPHandler(&logger.DefaultLogger{}, processedPath)
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/playlist.m3u?source=1", nil))
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, recorder.Code)
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"m3u-stream-merger/sourceproc"
+)
+
+// playlistFilter selects the channels of a processed M3U from the query of
+// the playlist URL (e.g. /playlist.m3u?group=News&search=bbc&limit=50).
+type playlistFilter struct {
+	groups  map[string]bool
+	search  string
+	types   map[string]bool
+	sources map[string]bool
+	offset  int
+	limit   int
+}
+
+func parsePlaylistFilter(query url.Values) (*playlistFilter, error) {
+	filter := &playlistFilter{
+		groups:  queryValues(query, "group"),
+		search:  strings.ToLower(strings.TrimSpace(query.Get("search"))),
+		types:   queryValues(query, "type"),
+		sources: queryValues(query, "source"),
+		limit:   -1,
+	}
+
+	if filter.sources != nil && os.Getenv("BYPASS_PROXY") == "true" {
+		return nil, fmt.Errorf("source is not available when the proxy is bypassed")
+	}
+
+	if value := query.Get("offset"); value != "" {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("invalid offset: %s", value)
+		}
+		filter.offset = offset
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid limit: %s", value)
+		}
+		filter.limit = limit
+	}
+
+	return filter, nil
+}
+
+// queryValues returns the lowercase values of a query parameter, which can
+// be repeated or separated by commas, or nil if it isn't set.
+func queryValues(query url.Values, name string) map[string]bool {
+	var values map[string]bool
+	for _, value := range query[name] {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+				if values == nil {
+					values = make(map[string]bool)
+				}
+				values[item] = true
+			}
+		}
+	}
+	return values
+}
+
+// empty reports whether the filter selects every channel.
+func (f *playlistFilter) empty() bool {
+	return f.groups == nil && f.search == "" && f.types == nil && f.sources == nil &&
+		f.offset == 0 && f.limit < 0
+}
+
+// matches reports whether a channel matches the group, search, type and
+// source of the filter. The source is the one the channel was taken from,
+// like the source sorting key.
+func (f *playlistFilter) matches(title string, attributes map[string]string, streamURL string) bool {
+	if f.groups != nil && !f.groups[strings.ToLower(attributes["group-title"])] {
+		return false
+	}
+	if f.search != "" && !strings.Contains(strings.ToLower(title), f.search) {
+		return false
+	}
+	if f.types != nil && !f.types[strings.ToLower(attributes["tvg-type"])] {
+		return false
+	}
+	if f.sources != nil {
+		parsedURL, err := url.Parse(streamURL)
+		if err != nil {
+			return false
+		}
+		stream, err := sourceproc.DecodeSlug(streamSlug(parsedURL.Path))
+		if err != nil || !f.sources[stream.SourceM3U] {
+			return false
+		}
+	}
+	return true
+}
@@ -14,13 +14,21 @@ import (
 	"m3u-stream-merger/logger"
 	"m3u-stream-merger/proxy"
 	"m3u-stream-merger/proxy/client"
+	"m3u-stream-merger/proxy/loadbalancer"
 	"m3u-stream-merger/proxy/stream/failovers"
 	"m3u-stream-merger/utils"
 )
 
+// StreamAuthorizer decides whether the client of a stream request may play
+// the stream of a slug.
+type StreamAuthorizer interface {
+	AuthorizeStream(r *http.Request, slug string) bool
+}
+
 type StreamHTTPHandler struct {
-	manager ProxyInstance
-	logger  logger.Logger
+	manager    ProxyInstance
+	logger     logger.Logger
+	authorizer StreamAuthorizer
 }
 
 func NewStreamHTTPHandler(manager ProxyInstance, logger logger.Logger) *StreamHTTPHandler {
@@ -30,6 +38,10 @@ func NewStreamHTTPHandler(manager ProxyInstance, logger logger.Logger) *StreamHT
 	}
 }
 
+func (h *StreamHTTPHandler) SetAuthorizer(authorizer StreamAuthorizer) {
+	h.authorizer = authorizer
+}
+
 func (h *StreamHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	streamClient := client.NewStreamClient(w, r)
 
@@ -43,6 +55,12 @@ func (h *StreamHTTPHandler) ServeSegmentHTTP(w http.ResponseWriter, r *http.Requ
 }
 
 func (h *StreamHTTPHandler) extractStreamURL(urlPath string) string {
+	return streamSlug(urlPath)
+}
+
+// streamSlug returns the slug of the path of a stream URL
+// (/p/{originalBasePath}/{slug}.{fileExt}).
+func streamSlug(urlPath string) string {
 	base := path.Base(urlPath)
 	parts := strings.Split(base, ".")
 	if len(parts) == 0 {
@@ -60,7 +78,19 @@ func (h *StreamHTTPHandler) handleStream(ctx context.Context, streamClient *clie
 		return
 	}
 
-	coordinator := h.manager.GetStreamRegistry().GetOrCreateCoordinator(streamURL)
+	if h.authorizer != nil && !h.authorizer.AuthorizeStream(r, streamURL) {
+		h.logger.Warnf("Refused stream %s to %s: not in the user's playlist", r.URL.Path, r.RemoteAddr)
+		_ = streamClient.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	// Clients asking for another quality must not share the buffer.
+	coordinatorID := streamURL
+	if quality, err := loadbalancer.ParseQualityPreference(r); err == nil && quality != nil {
+		coordinatorID += "|" + quality.String()
+	}
+
+	coordinator := h.manager.GetStreamRegistry().GetOrCreateCoordinator(coordinatorID)
 
 	for {
 		lbResult := coordinator.GetWriterLBResult()
@@ -156,7 +186,20 @@ func (h *StreamHTTPHandler) handleSegmentStream(streamClient *client.StreamClien
 		return
 	}
 
-	resp, err := utils.HTTPClient.Get(segment.URL)
+	req, err := http.NewRequest(http.MethodGet, segment.URL, nil)
+	if err != nil {
+		h.logger.Errorf("Failed to create request: %v", err)
+		_ = streamClient.WriteHeader(http.StatusInternalServerError)
+		_, _ = streamClient.Write([]byte(fmt.Sprintf("Failed to create request: %v", err)))
+		return
+	}
+	sourceIndex, _, _ := strings.Cut(segment.SourceM3U, "|")
+	utils.ApplySourceHeaders(req, sourceIndex)
+	for key, values := range segment.Headers {
+		req.Header[key] = values
+	}
+
+	resp, err := utils.GetSourceHTTPClient(sourceIndex).Do(req)
 	if err != nil {
 		h.logger.Errorf("Failed to fetch URL: %v", err)
 		_ = streamClient.WriteHeader(http.StatusInternalServerError)
@@ -289,6 +289,39 @@ func TestStreamHTTPHandler_ServeHTTP(t *testing.T) {
 	}
 }
 
+type mockStreamAuthorizer struct {
+	allowed map[string]bool
+}
+
+func (m *mockStreamAuthorizer) AuthorizeStream(r *http.Request, slug string) bool {
+	return m.allowed[slug]
+}
+
+func TestStreamHTTPHandler_Authorizer(t *testing.T) {
+	manager := &mockStreamManager{}
+	manager.loadBalancerFunc = func(ctx context.Context, req *http.Request) (*loadbalancer.LoadBalancerResult, error) {
+		return nil, errors.New("no stream available")
+	}
+	manager.getRegistryFunc = func() *buffer.StreamRegistry {
+		return buffer.NewStreamRegistry(config.NewDefaultStreamConfig(), store.NewConcurrencyManager(), logger.Default, time.Second)
+	}
+
+	handler := NewStreamHTTPHandler(manager, logger.Default)
+	handler.SetAuthorizer(&mockStreamAuthorizer{allowed: map[string]bool{"allowed": true}})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/p/stream/refused.m3u8", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected status %d, got %d", http.StatusForbidden, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/p/stream/allowed.m3u8", nil))
+	if w.Code == http.StatusForbidden {
+		t.Errorf("expected allowed stream not to be refused")
+	}
+}
+
 func TestStreamHTTPHandler_DisconnectionConcurrency(t *testing.T) {
 	cm := store.NewConcurrencyManager()
 	config := config.NewDefaultStreamConfig()
@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"m3u-stream-merger/sourceproc"
+)
+
+// userAccess is what a user is entitled to: the playlist of a profile from
+// USER_PROFILE, and the groups of that playlist from USER_GROUPS. A user
+// without a profile gets the main playlist, and a user without groups gets
+// every group of it.
+type userAccess struct {
+	profile string
+	groups  map[string]bool
+}
+
+// userAccessEnabled reports whether any user is restricted. Stream requests
+// are only checked then.
+func userAccessEnabled() bool {
+	return strings.TrimSpace(os.Getenv("USER_PROFILE")) != "" ||
+		strings.TrimSpace(os.Getenv("USER_GROUPS")) != ""
+}
+
+// ValidateUserAccess reports an error when users are restricted without
+// CREDENTIALS. Users are told apart by the credentials of their requests only,
+// so without them any client could claim to be an unrestricted user.
+func ValidateUserAccess() error {
+	if userAccessEnabled() && !credentialsEnabled() {
+		return fmt.Errorf("invalid USER_PROFILE/USER_GROUPS: CREDENTIALS must be set to restrict users")
+	}
+	return nil
+}
+
+// getUserAccess returns the entitlement of a user from USER_PROFILE, in the
+// form user1:kids|user2:living-room, and USER_GROUPS, in the form
+// user1:Kids,Cartoons|user2:News. It returns nil for users who are not
+// restricted.
+func getUserAccess(user string) *userAccess {
+	if user == "" {
+		return nil
+	}
+
+	var access *userAccess
+	if profile := userSetting("USER_PROFILE", user); profile != "" {
+		access = &userAccess{profile: strings.ToLower(profile)}
+	}
+	if groups := userSetting("USER_GROUPS", user); groups != "" {
+		if access == nil {
+			access = &userAccess{}
+		}
+		access.groups = make(map[string]bool)
+		for _, group := range strings.Split(groups, ",") {
+			if group = strings.ToLower(strings.TrimSpace(group)); group != "" {
+				access.groups[group] = true
+			}
+		}
+	}
+	return access
+}
+
+// userSetting returns the value of a user in a setting of the form
+// user1:value1|user2:value2.
+func userSetting(env, user string) string {
+	for _, item := range strings.Split(os.Getenv(env), "|") {
+		name, value, ok := strings.Cut(strings.TrimSpace(item), ":")
+		if ok && strings.EqualFold(name, user) {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// restrictsGroups reports whether the user may only see some groups.
+func (a *userAccess) restrictsGroups() bool {
+	return a != nil && a.groups != nil
+}
+
+// allowsGroup reports whether the user may see the channels of a group.
+func (a *userAccess) allowsGroup(group string) bool {
+	return !a.restrictsGroups() || a.groups[strings.ToLower(strings.TrimSpace(group))]
+}
+
+// accessPath returns the playlist a user is entitled to.
+func (h *M3UHTTPHandler) accessPath(access *userAccess) string {
+	processedPath, profilePaths := h.playlistPaths()
+	if access != nil && access.profile != "" {
+		return profilePaths[access.profile]
+	}
+	return processedPath
+}
+
+// AuthorizeStream reports whether the client of a stream request may play the
+// stream of a slug. When users are restricted by USER_PROFILE or USER_GROUPS,
+// stream requests must carry the credentials of a user, which the playlist
+// adds to its stream URLs, and restricted users may only play the channels
+// of their playlist.
+func (h *M3UHTTPHandler) AuthorizeStream(r *http.Request, slug string) bool {
+	if !userAccessEnabled() {
+		return true
+	}
+	if !h.handleAuth(r) {
+		return false
+	}
+
+	access := getUserAccess(r.URL.Query().Get("username"))
+	if access == nil {
+		return true
+	}
+
+	key, err := sourceproc.SlugKey(slug)
+	if err != nil {
+		return false
+	}
+
+	group, ok := h.playlistChannels(h.accessPath(access))[key]
+	return ok && access.allowsGroup(group)
+}
+
+// playlistChannels returns the groups of the channels of a processed M3U,
+// keyed by the key their streams are indexed on. Processed M3Us don't change
+// once written, so they are read once.
+func (h *M3UHTTPHandler) playlistChannels(processedPath string) map[string]string {
+	if processedPath == "" {
+		return nil
+	}
+
+	h.channelsMu.Lock()
+	defer h.channelsMu.Unlock()
+
+	if channels, ok := h.channels[processedPath]; ok {
+		return channels
+	}
+
+	file, err := os.Open(processedPath)
+	if err != nil {
+		h.logger.Errorf("Error reading processed M3U: %v", err)
+		return nil
+	}
+	defer file.Close()
+
+	channels := make(map[string]string)
+	group := ""
+	err = readPlaylistLines(file, func(line string) bool {
+		switch {
+		case strings.HasPrefix(line, "#EXTINF"):
+			_, attributes := sourceproc.ParseExtInf(line)
+			group = attributes["group-title"]
+		case line != "" && !strings.HasPrefix(line, "#"):
+			streamURL, err := url.Parse(line)
+			if err != nil {
+				return true
+			}
+			if key, err := sourceproc.SlugKey(streamSlug(streamURL.Path)); err == nil {
+				channels[key] = group
+			}
+		}
+		return true
+	})
+	if err != nil {
+		h.logger.Errorf("Error reading processed M3U: %v", err)
+		return nil
+	}
+
+	// Forget the playlists of previous syncs.
+	currentPath, profilePaths := h.playlistPaths()
+	for path := range h.channels {
+		if path != currentPath && !isProfilePath(profilePaths, path) {
+			delete(h.channels, path)
+		}
+	}
+	h.channels[processedPath] = channels
+
+	return channels
+}
+
+func isProfilePath(profilePaths map[string]string, processedPath string) bool {
+	for _, path := range profilePaths {
+		if path == processedPath {
+			return true
+		}
+	}
+	return false
+}
@@ -18,6 +18,7 @@ func main() {
 
 	m3uHandler := handlers.NewM3UHTTPHandler(logger.Default, "")
 	streamHandler := handlers.NewStreamHTTPHandler(handlers.NewDefaultProxyInstance(), logger.Default)
+	streamHandler.SetAuthorizer(m3uHandler)
 
 	logger.Default.Log("Starting updater...")
 	_, err := updater.Initialize(ctx, logger.Default, m3uHandler)
@@ -39,6 +40,18 @@ func main() {
 	http.HandleFunc("/playlist.m3u", func(w http.ResponseWriter, r *http.Request) {
 		m3uHandler.ServeHTTP(w, r)
 	})
+	http.HandleFunc("/playlist/", func(w http.ResponseWriter, r *http.Request) {
+		m3uHandler.ServeProfileHTTP(w, r)
+	})
+	http.HandleFunc("/sync", func(w http.ResponseWriter, r *http.Request) {
+		m3uHandler.ServeSyncHTTP(w, r)
+	})
+	http.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		m3uHandler.ServeReloadHTTP(w, r)
+	})
+	http.HandleFunc("/sync/diff", func(w http.ResponseWriter, r *http.Request) {
+		m3uHandler.ServeDiffHTTP(w, r)
+	})
 	http.HandleFunc("/p/", func(w http.ResponseWriter, r *http.Request) {
 		streamHandler.ServeHTTP(w, r)
 	})
@@ -49,6 +62,10 @@ func main() {
 	// Start the server
 	logger.Default.Logf("Server is running on port %s...", os.Getenv("PORT"))
 	logger.Default.Log("Playlist Endpoint is running (`/playlist.m3u`)")
+	logger.Default.Log("Profile Playlist Endpoint is running (`/playlist/{profile}.m3u`)")
+	logger.Default.Log("Sync Endpoint is running (`POST /sync?index={index}`)")
+	logger.Default.Log("Sync Diff Endpoint is running (`/sync/diff`)")
+	logger.Default.Log("Reload Endpoint is running (`POST /reload`)")
 	logger.Default.Log("Stream Endpoint is running (`/p/{originalBasePath}/{streamID}.{fileExt}`)")
 	err = http.ListenAndServe(fmt.Sprintf(":%s", os.Getenv("PORT")), nil)
 	if err != nil {
@@ -8,6 +8,7 @@ import (
 	"m3u-stream-merger/sourceproc"
 	"m3u-stream-merger/store"
 	"m3u-stream-merger/utils"
+	"math"
 	"net/http"
 	"path"
 	"slices"
@@ -27,6 +28,7 @@ type LoadBalancerInstance struct {
 	slugParser      SlugParser
 	testedIndexes   map[string][]string
 	testedIndexesMu sync.RWMutex
+	quality         *QualityPreference
 }
 
 type LoadBalancerInstanceOption func(*LoadBalancerInstance)
@@ -63,7 +65,6 @@ func NewLoadBalancerInstance(
 	instance := &LoadBalancerInstance{
 		Cm:            cm,
 		config:        cfg,
-		httpClient:    utils.HTTPClient,
 		logger:        &logger.DefaultLogger{},
 		indexProvider: &DefaultIndexProvider{},
 		slugParser:    &DefaultSlugParser{},
@@ -82,6 +83,8 @@ type LoadBalancerResult struct {
 	URL      string
 	Index    string
 	SubIndex string
+	Options  *sourceproc.StreamOptions
+	Quality  string
 }
 
 func (instance *LoadBalancerInstance) GetStreamId(req *http.Request) string {
@@ -110,11 +113,21 @@ func (instance *LoadBalancerInstance) Balance(ctx context.Context, req *http.Req
 
 	streamId := instance.GetStreamId(req)
 
-	err := instance.fetchBackendUrls(streamId)
+	quality, err := ParseQualityPreference(req)
+	if err != nil {
+		instance.logger.Warnf("Ignoring quality preference: %v", err)
+	}
+	instance.quality = quality
+
+	err = instance.fetchBackendUrls(streamId)
 	if err != nil {
 		return nil, fmt.Errorf("error fetching sources for: %s", streamId)
 	}
 
+	if !instance.hasQualityUrls() {
+		return nil, fmt.Errorf("no %s stream available for: %s", instance.quality.Tier, streamId)
+	}
+
 	backoff := proxy.NewBackoffStrategy(time.Duration(instance.config.RetryWait)*time.Second, 0)
 
 	for lap := 0; lap < instance.config.MaxRetries || instance.config.MaxRetries == 0; lap++ {
@@ -195,6 +208,13 @@ func (instance *LoadBalancerInstance) tryAllStreams(ctx context.Context, method
 
 		for len(done) < initialCount {
 			sort.Slice(m3uIndexes, func(i, j int) bool {
+				if instance.quality != nil {
+					distanceI := instance.bestQualityDistance(m3uIndexes[i])
+					distanceJ := instance.bestQualityDistance(m3uIndexes[j])
+					if distanceI != distanceJ {
+						return distanceI < distanceJ
+					}
+				}
 				return instance.Cm.ConcurrencyPriorityValue(m3uIndexes[i]) > instance.Cm.ConcurrencyPriorityValue(m3uIndexes[j])
 			})
 
@@ -236,11 +256,7 @@ func (instance *LoadBalancerInstance) tryStreamUrls(
 	index string,
 	urls map[string]string,
 ) (*LoadBalancerResult, error) {
-	if instance.httpClient == nil {
-		return nil, fmt.Errorf("HTTP client cannot be nil")
-	}
-
-	for _, subIndex := range sourceproc.SortStreamSubUrls(urls) {
+	for _, subIndex := range instance.sortStreamUrls(index, urls) {
 		fileContent, ok := urls[subIndex]
 		if !ok {
 			continue
@@ -273,9 +289,12 @@ func (instance *LoadBalancerInstance) tryStreamUrls(
 			instance.markTested(streamId, id)
 			continue
 		}
-		req.Header.Set("User-Agent", utils.GetEnv("USER_AGENT"))
+		utils.ApplySourceHeaders(req, index)
 
-		resp, err := instance.httpClient.Do(req)
+		options := instance.Info.URLOptions[index][subIndex]
+		options.ApplyHeaders(req)
+
+		resp, err := instance.getHTTPClient(index).Do(req)
 		if err != nil {
 			instance.logger.Errorf("Error fetching stream: %s", err.Error())
 			instance.markTested(streamId, id)
@@ -301,12 +320,76 @@ func (instance *LoadBalancerInstance) tryStreamUrls(
 			URL:      url,
 			Index:    index,
 			SubIndex: subIndex,
+			Options:  options,
+			Quality:  instance.Info.URLQualities[index][subIndex],
 		}, nil
 	}
 
 	return nil, fmt.Errorf("all urls failed")
 }
 
+// sortStreamUrls orders the URLs of a source by closeness to the preferred
+// quality, then by their order in the source. URLs of other tiers are left out
+// when the quality is required.
+func (instance *LoadBalancerInstance) sortStreamUrls(index string, urls map[string]string) []string {
+	subIndexes := sourceproc.SortStreamSubUrls(urls)
+	if instance.quality == nil {
+		return subIndexes
+	}
+
+	distances := make(map[string]int, len(subIndexes))
+	sorted := make([]string, 0, len(subIndexes))
+	for _, subIndex := range subIndexes {
+		distance, ok := instance.quality.distance(instance.Info.URLQualities[index][subIndex])
+		if !ok {
+			continue
+		}
+		distances[subIndex] = distance
+		sorted = append(sorted, subIndex)
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return distances[sorted[i]] < distances[sorted[j]]
+	})
+	return sorted
+}
+
+// bestQualityDistance returns the distance to the preferred quality of the
+// closest URL of a source.
+func (instance *LoadBalancerInstance) bestQualityDistance(index string) int {
+	best := math.MaxInt
+	for subIndex := range instance.Info.URLs[index] {
+		distance, ok := instance.quality.distance(instance.Info.URLQualities[index][subIndex])
+		if ok && distance < best {
+			best = distance
+		}
+	}
+	return best
+}
+
+// hasQualityUrls reports whether the stream has a URL of the required
+// quality, if any is required.
+func (instance *LoadBalancerInstance) hasQualityUrls() bool {
+	if instance.quality == nil || !instance.quality.Required {
+		return true
+	}
+	for index := range instance.Info.URLs {
+		if instance.bestQualityDistance(index) != math.MaxInt {
+			return true
+		}
+	}
+	return false
+}
+
+// getHTTPClient returns the client set through WithHTTPClient, or the
+// client configured for the given M3U index.
+func (instance *LoadBalancerInstance) getHTTPClient(index string) HTTPClient {
+	if instance.httpClient != nil {
+		return instance.httpClient
+	}
+	return utils.GetSourceHTTPClient(index)
+}
+
 func (instance *LoadBalancerInstance) markTested(streamId string, id string) {
 	instance.testedIndexesMu.Lock()
 	instance.testedIndexes[streamId] = append(instance.testedIndexes[streamId], id)
@@ -702,3 +702,134 @@ func TestLoadBalancerConcurrencyPriority(t *testing.T) {
 		})
 	}
 }
+
+type mockHTTPClientWithHeaders struct {
+	headers http.Header
+	mu      sync.Mutex
+}
+
+func (m *mockHTTPClientWithHeaders) Do(req *http.Request) (*http.Response, error) {
+	m.mu.Lock()
+	m.headers = req.Header.Clone()
+	m.mu.Unlock()
+
+	return &http.Response{StatusCode: http.StatusOK}, nil
+}
+
+func TestLoadBalancerAppliesStreamOptions(t *testing.T) {
+	os.Setenv("M3U_USER_AGENT_1", "SourceAgent/1.0")
+	os.Setenv("M3U_REFERER_1", "http://source.example.com/")
+	defer os.Unsetenv("M3U_USER_AGENT_1")
+	defer os.Unsetenv("M3U_REFERER_1")
+
+	client := &mockHTTPClientWithHeaders{}
+	slugParser := &mockSlugParser{
+		streams: map[string]*sourceproc.StreamInfo{
+			"test-stream": {
+				Title: "Test Stream",
+				URLs: map[string]map[string]string{
+					"1": {"a": "0:::http://test1.com/stream"},
+				},
+				URLOptions: map[string]map[string]*sourceproc.StreamOptions{
+					"1": {"a": {VLCOpts: []string{"http-user-agent=ChannelAgent/2.0"}}},
+				},
+			},
+		},
+	}
+
+	instance := NewLoadBalancerInstance(
+		store.NewConcurrencyManager(),
+		NewDefaultLBConfig(),
+		WithHTTPClient(client),
+		WithIndexProvider(&mockIndexProvider{indexes: []string{"1"}}),
+		WithSlugParser(slugParser),
+	)
+
+	result, err := instance.Balance(context.Background(), newTestRequest(http.MethodGet))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Options == nil {
+		t.Error("Expected stream options on the result")
+	}
+	if got := client.headers.Get("User-Agent"); got != "ChannelAgent/2.0" {
+		t.Errorf("Expected channel User-Agent, got %s", got)
+	}
+	if got := client.headers.Get("Referer"); got != "http://source.example.com/" {
+		t.Errorf("Expected source Referer, got %s", got)
+	}
+}
+
+func TestLoadBalancerQualityPreference(t *testing.T) {
+	client := &mockHTTPClient{
+		responses: map[string]*http.Response{
+			"http://test1.com/sd": {StatusCode: http.StatusOK},
+			"http://test1.com/4k": {StatusCode: http.StatusOK},
+			"http://test2.com/hd": {StatusCode: http.StatusOK},
+		},
+		errors: make(map[string]error),
+	}
+
+	slugParser := &mockSlugParser{
+		streams: map[string]*sourceproc.StreamInfo{
+			"test-stream": {
+				Title: "Test Stream",
+				URLs: map[string]map[string]string{
+					"1": {
+						"a": "0:::http://test1.com/sd",
+						"b": "1:::http://test1.com/4k",
+					},
+					"2": {
+						"a": "0:::http://test2.com/hd",
+					},
+				},
+				URLQualities: map[string]map[string]string{
+					"1": {"a": sourceproc.QualitySD, "b": sourceproc.Quality4K},
+					"2": {"a": sourceproc.QualityHD},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		query   string
+		wantURL string
+		wantErr bool
+	}{
+		{name: "preferred tier", query: "quality=hd", wantURL: "http://test2.com/hd"},
+		{name: "preferred tier alias", query: "quality=uhd", wantURL: "http://test1.com/4k"},
+		{name: "closest higher tier", query: "quality=fhd", wantURL: "http://test1.com/4k"},
+		{name: "required tier", query: "quality=sd&quality_mode=require", wantURL: "http://test1.com/sd"},
+		{name: "required tier missing", query: "quality=fhd&quality_mode=require", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := NewLoadBalancerInstance(
+				store.NewConcurrencyManager(),
+				&LBConfig{MaxRetries: 1},
+				WithHTTPClient(client),
+				WithLogger(logger.Default),
+				WithIndexProvider(&mockIndexProvider{indexes: []string{"1", "2"}}),
+				WithSlugParser(slugParser),
+			)
+
+			req, _ := http.NewRequest(http.MethodGet, "/test-stream.m3u8?"+tt.query, nil)
+			result, err := instance.Balance(context.Background(), req)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error, got result %s", result.URL)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Balance() error = %v", err)
+			}
+			if result.URL != tt.wantURL {
+				t.Errorf("Balance() URL = %s, want %s", result.URL, tt.wantURL)
+			}
+		})
+	}
+}
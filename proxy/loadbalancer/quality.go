@@ -0,0 +1,80 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"m3u-stream-merger/sourceproc"
+)
+
+// unknownQualityDistance ranks URLs of unknown quality after all the others.
+const unknownQualityDistance = 100
+
+// QualityPreference is the quality tier requested by a client through the
+// quality query parameter of the stream URL (e.g. ?quality=hd). With
+// quality_mode=require, URLs of other tiers are never used.
+type QualityPreference struct {
+	Tier     string
+	Required bool
+}
+
+// ParseQualityPreference reads the quality preference of a stream request. It
+// returns nil if the request has none.
+func ParseQualityPreference(req *http.Request) (*QualityPreference, error) {
+	query := req.URL.Query()
+	value := query.Get("quality")
+	if value == "" {
+		return nil, nil
+	}
+
+	tier, ok := sourceproc.ParseQuality(value)
+	if !ok {
+		return nil, fmt.Errorf("unknown quality: %s", value)
+	}
+
+	preference := &QualityPreference{Tier: tier}
+	switch mode := strings.ToLower(query.Get("quality_mode")); mode {
+	case "", "prefer":
+	case "require":
+		preference.Required = true
+	default:
+		return nil, fmt.Errorf("unknown quality mode: %s", mode)
+	}
+
+	return preference, nil
+}
+
+// String identifies the preference, e.g. "hd" or "hd!" if it is required.
+func (p *QualityPreference) String() string {
+	if p == nil {
+		return ""
+	}
+	if p.Required {
+		return p.Tier + "!"
+	}
+	return p.Tier
+}
+
+// distance orders URLs by how close their quality is to the preferred tier.
+// Higher tiers come before lower tiers at the same distance. It returns false
+// for URLs that must not be used.
+func (p *QualityPreference) distance(quality string) (int, bool) {
+	if p == nil {
+		return 0, true
+	}
+	if p.Required {
+		return 0, quality == p.Tier
+	}
+
+	rank := sourceproc.QualityRank(quality)
+	if rank == 0 {
+		return unknownQualityDistance, true
+	}
+
+	diff := rank - sourceproc.QualityRank(p.Tier)
+	if diff < 0 {
+		return -diff*2 + 1, true
+	}
+	return diff * 2, true
+}
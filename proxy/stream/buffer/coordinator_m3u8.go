@@ -122,7 +122,7 @@ func (c *StreamCoordinator) StartHLSWriter(ctx context.Context, lbResult *loadba
 
 			if metadata.IsEndlist {
 				// Process remaining segments before ending
-				err = c.processSegments(ctx, metadata.Segments)
+				err = c.processSegments(ctx, lbResult, metadata.Segments)
 				if err != nil {
 					c.logger.Errorf("Error processing segments: %v", err)
 				}
@@ -135,7 +135,7 @@ func (c *StreamCoordinator) StartHLSWriter(ctx context.Context, lbResult *loadba
 
 				lastMediaSeq = metadata.MediaSequence
 
-				if err := c.processSegments(ctx, metadata.Segments); err != nil {
+				if err := c.processSegments(ctx, lbResult, metadata.Segments); err != nil {
 					if ctx.Err() != nil {
 						c.writeError(err, proxy.StatusServerError)
 						return
@@ -148,13 +148,13 @@ func (c *StreamCoordinator) StartHLSWriter(ctx context.Context, lbResult *loadba
 	}
 }
 
-func (c *StreamCoordinator) processSegments(ctx context.Context, segments []string) error {
+func (c *StreamCoordinator) processSegments(ctx context.Context, lbResult *loadbalancer.LoadBalancerResult, segments []string) error {
 	for _, segment := range segments {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		default:
-			if err := c.streamSegment(ctx, segment); err != nil {
+			if err := c.streamSegment(ctx, lbResult, segment); err != nil {
 				if err != io.EOF {
 					return err
 				}
@@ -164,13 +164,15 @@ func (c *StreamCoordinator) processSegments(ctx context.Context, segments []stri
 	return nil
 }
 
-func (c *StreamCoordinator) streamSegment(ctx context.Context, segmentURL string) error {
+func (c *StreamCoordinator) streamSegment(ctx context.Context, lbResult *loadbalancer.LoadBalancerResult, segmentURL string) error {
 	req, err := http.NewRequest("GET", segmentURL, nil)
 	if err != nil {
 		return fmt.Errorf("Error creating request to segment: %v", err)
 	}
+	utils.ApplySourceHeaders(req, lbResult.Index)
+	lbResult.Options.ApplyHeaders(req)
 
-	resp, err := utils.HTTPClient.Do(req)
+	resp, err := utils.GetSourceHTTPClient(lbResult.Index).Do(req)
 	if err != nil {
 		return fmt.Errorf("Error fetching segment stream: %v", err)
 	}
@@ -77,6 +77,9 @@ func (p *M3U8Processor) processURL(
 		URL:       u.String(),
 		SourceM3U: lbResult.Index + "|" + lbResult.SubIndex,
 	}
+	if headers := lbResult.Options.HTTPHeaders(); len(headers) > 0 {
+		segment.Headers = headers
+	}
 
 	return p.writeLine(streamClient, generateSegmentURL(&segment))
 }
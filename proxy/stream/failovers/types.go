@@ -1,9 +1,13 @@
 package failovers
 
-import "sync"
+import (
+	"net/http"
+	"sync"
+)
 
 type M3U8Segment struct {
 	sync.RWMutex
-	URL       string `json:"url"`
-	SourceM3U string `json:"source_m3u"`
+	URL       string      `json:"url"`
+	SourceM3U string      `json:"source_m3u"`
+	Headers   http.Header `json:"headers,omitempty"`
 }
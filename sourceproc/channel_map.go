@@ -0,0 +1,172 @@
+package sourceproc
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"m3u-stream-merger/logger"
+
+	"gopkg.in/yaml.v3"
+)
+
+// canonicalChannel is a channel of the CHANNEL_MAP_FILE. Streams whose title
+// or tvg-id is listed in Titles or TvgIDs are merged into it, and take its
+// name, tvg-id, logo, group and number.
+type canonicalChannel struct {
+	Name   string   `yaml:"name"`
+	TvgID  string   `yaml:"tvg-id"`
+	Logo   string   `yaml:"logo"`
+	Group  string   `yaml:"group"`
+	ChNo   string   `yaml:"chno"`
+	Titles []string `yaml:"titles"`
+	TvgIDs []string `yaml:"tvg-ids"`
+
+	// key is the merge key of the channel, computed from its own fields.
+	key string
+}
+
+type channelMapFile struct {
+	Channels []*canonicalChannel `yaml:"channels"`
+}
+
+// channelMap looks up the canonical channel of a stream. Titles are compared
+// after the MERGE_NORMALIZE steps and case insensitively, tvg-ids case
+// insensitively.
+type channelMap struct {
+	titles    map[string]*canonicalChannel
+	tvgIDs    map[string]*canonicalChannel
+	normalize func(string) string
+}
+
+// loadChannelMap reads the CHANNEL_MAP_FILE. It returns nil if none is set.
+// JSON files are read as YAML, which they are a subset of.
+func loadChannelMap(mergeKey *mergeKeyBuilder) (*channelMap, error) {
+	path := strings.TrimSpace(os.Getenv("CHANNEL_MAP_FILE"))
+	if path == "" {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CHANNEL_MAP_FILE: %v", err)
+	}
+
+	var file channelMapFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("error parsing CHANNEL_MAP_FILE %s: %v", path, err)
+	}
+
+	channels := &channelMap{
+		titles: make(map[string]*canonicalChannel),
+		tvgIDs: make(map[string]*canonicalChannel),
+		normalize: func(title string) string {
+			return strings.ToLower(mergeKey.normalize(title))
+		},
+	}
+
+	for i, channel := range file.Channels {
+		if channel == nil || strings.TrimSpace(channel.Name) == "" {
+			return nil, fmt.Errorf("invalid CHANNEL_MAP_FILE %s: channel %d has no name", path, i+1)
+		}
+
+		channel.key = mergeKey.key(&StreamInfo{
+			Title:   channel.Name,
+			TvgID:   channel.TvgID,
+			TvgChNo: channel.ChNo,
+			LogoURL: channel.Logo,
+			Group:   channel.Group,
+		})
+
+		if err := channels.add(channels.titles, channels.normalize(channel.Name), channel); err != nil {
+			return nil, fmt.Errorf("invalid CHANNEL_MAP_FILE %s: %v", path, err)
+		}
+		for _, title := range channel.Titles {
+			if err := channels.add(channels.titles, channels.normalize(title), channel); err != nil {
+				return nil, fmt.Errorf("invalid CHANNEL_MAP_FILE %s: %v", path, err)
+			}
+		}
+		for _, tvgID := range append([]string{channel.TvgID}, channel.TvgIDs...) {
+			if err := channels.add(channels.tvgIDs, strings.ToLower(strings.TrimSpace(tvgID)), channel); err != nil {
+				return nil, fmt.Errorf("invalid CHANNEL_MAP_FILE %s: %v", path, err)
+			}
+		}
+	}
+
+	return channels, nil
+}
+
+func (m *channelMap) add(aliases map[string]*canonicalChannel, alias string, channel *canonicalChannel) error {
+	if alias == "" {
+		return nil
+	}
+	if existing, ok := aliases[alias]; ok && existing != channel {
+		return fmt.Errorf("%q is mapped to both %q and %q", alias, existing.Name, channel.Name)
+	}
+	aliases[alias] = channel
+	return nil
+}
+
+// compileChannelMap loads the CHANNEL_MAP_FILE for a sync. A file that was
+// edited into an invalid one since the last reload is ignored, and channels
+// are merged as if no map was set until it is fixed.
+func compileChannelMap(mergeKey *mergeKeyBuilder) *channelMap {
+	channels, err := loadChannelMap(mergeKey)
+	if err != nil {
+		logger.Default.Errorf("Ignoring channel map: %v", err)
+		return nil
+	}
+	return channels
+}
+
+// lookup returns the canonical channel of the stream, if any. The tvg-id is
+// checked before the title.
+func (m *channelMap) lookup(stream *StreamInfo) *canonicalChannel {
+	if m == nil {
+		return nil
+	}
+	if tvgID := strings.ToLower(strings.TrimSpace(stream.TvgID)); tvgID != "" {
+		if channel, ok := m.tvgIDs[tvgID]; ok {
+			return channel
+		}
+	}
+	return m.titles[m.normalize(stream.Title)]
+}
+
+// apply replaces the identity of the stream by the canonical channel. Fields
+// the channel doesn't set are kept from the stream. The values of the channel
+// win over the merge policies.
+func (c *canonicalChannel) apply(stream *StreamInfo) {
+	stream.Candidates = make(map[string][]fieldCandidate)
+	for _, field := range mergeFields {
+		var value string
+		switch field.name {
+		case "title":
+			value = c.Name
+		case "tvg-id":
+			value = c.TvgID
+		case "tvg-chno":
+			value = c.ChNo
+		case "logo":
+			value = c.Logo
+		case "group":
+			value = c.Group
+		}
+		if value == "" {
+			continue
+		}
+
+		*field.field(stream) = value
+		stream.Candidates[field.name] = []fieldCandidate{{
+			Value:     value,
+			Source:    stream.SourceM3U,
+			Index:     stream.SourceIndex,
+			Canonical: true,
+		}}
+	}
+
+	stream.MergeKey = ""
+	if c.key != c.Name {
+		stream.MergeKey = c.key
+	}
+}
@@ -0,0 +1,123 @@
+package sourceproc
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelMap(t *testing.T) {
+	tempDir := t.TempDir()
+	yamlPath := filepath.Join(tempDir, "channels.yaml")
+	require.NoError(t, os.WriteFile(yamlPath, []byte(`channels:
+  - name: BBC One
+    tvg-id: bbc1.uk
+    logo: http://example.com/bbc1.png
+    group: UK
+    chno: 101
+    titles: ["BBC One London", "BBC 1 HD"]
+    tvg-ids: [bbcone.uk]
+`), 0644))
+	jsonPath := filepath.Join(tempDir, "channels.json")
+	require.NoError(t, os.WriteFile(jsonPath, []byte(`{"channels": [
+  {"name": "BBC One", "tvg-id": "bbc1.uk", "chno": "101", "titles": ["BBC One London", "BBC 1 HD"]}
+]}`), 0644))
+
+	for _, path := range []string{yamlPath, jsonPath} {
+		t.Run(filepath.Ext(path), func(t *testing.T) {
+			t.Setenv("CHANNEL_MAP_FILE", path)
+			t.Setenv("MERGE_NORMALIZE", "casefold")
+
+			channels, err := loadChannelMap(compileMergeKey())
+			require.NoError(t, err)
+
+			for _, stream := range []*StreamInfo{
+				{Title: "BBC One London"},
+				{Title: "bbc 1 hd"},
+				{Title: "Something else", TvgID: "BBC1.uk"},
+			} {
+				channel := channels.lookup(stream)
+				require.NotNil(t, channel, stream.Title)
+				channel.apply(stream)
+				assert.Equal(t, "BBC One", stream.Title)
+				assert.Equal(t, "bbc1.uk", stream.TvgID)
+				assert.Equal(t, "101", stream.TvgChNo)
+				assert.Equal(t, "bbc one", stream.MergeKey)
+				assert.True(t, stream.Candidates["title"][0].Canonical)
+			}
+
+			assert.Nil(t, channels.lookup(&StreamInfo{Title: "BBC Two"}))
+		})
+	}
+
+	t.Run("invalid files", func(t *testing.T) {
+		t.Setenv("CHANNEL_MAP_FILE", filepath.Join(tempDir, "missing.yaml"))
+		assert.ErrorContains(t, ValidateSettings(), "error reading CHANNEL_MAP_FILE")
+
+		duplicatePath := filepath.Join(tempDir, "duplicate.yaml")
+		require.NoError(t, os.WriteFile(duplicatePath, []byte(`channels:
+  - name: BBC One
+    titles: [BBC]
+  - name: BBC Two
+    titles: [BBC]
+`), 0644))
+		t.Setenv("CHANNEL_MAP_FILE", duplicatePath)
+		assert.ErrorContains(t, ValidateSettings(), `"bbc" is mapped to both "BBC One" and "BBC Two"`)
+
+		unnamedPath := filepath.Join(tempDir, "unnamed.yaml")
+		require.NoError(t, os.WriteFile(unnamedPath, []byte("channels:\n  - titles: [BBC]\n"), 0644))
+		t.Setenv("CHANNEL_MAP_FILE", unnamedPath)
+		assert.ErrorContains(t, ValidateSettings(), "channel 1 has no name")
+	})
+}
+
+func TestMergeOnChannelMap(t *testing.T) {
+	setupSources(t,
+		"#EXTM3U\n"+
+			"#EXTINF:-1 group-title=\"Entertainment\",BBC 1 HD\nhttp://example.com/bbc1-hd\n",
+		"#EXTM3U\n"+
+			"#EXTINF:-1 group-title=\"News\" tvg-logo=\"http://example.com/other.png\",BBC One London\nhttp://example.com/bbc1-london\n")
+
+	mapPath := filepath.Join(t.TempDir(), "channels.yaml")
+	require.NoError(t, os.WriteFile(mapPath, []byte(`channels:
+  - name: BBC One
+    logo: http://example.com/bbc1.png
+    group: UK
+    titles: ["BBC One London", "BBC 1 HD"]
+`), 0644))
+	t.Setenv("CHANNEL_MAP_FILE", mapPath)
+
+	runProcessor := func() string {
+		content, err := os.ReadFile(runTestProcessor(t).GetResultPath())
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	content := runProcessor()
+	assert.Equal(t, 1, strings.Count(content, "#EXTINF"))
+	assert.Contains(t, content, `tvg-logo="http://example.com/bbc1.png"`)
+	assert.Contains(t, content, `group-title="UK"`)
+	assert.Contains(t, content, ",BBC One\n")
+
+	stream, err := ParseStreamInfoBySlug(EncodeSlug(&StreamInfo{Title: "BBC One"}))
+	require.NoError(t, err)
+	assert.Len(t, stream.URLs["1"], 1)
+	assert.Len(t, stream.URLs["2"], 1)
+
+	// The map is read again on the next sync.
+	require.NoError(t, os.WriteFile(mapPath, []byte(`channels:
+  - name: BBC One
+    titles: ["BBC 1 HD"]
+`), 0644))
+	time.Sleep(time.Second)
+
+	content = runProcessor()
+	assert.Equal(t, 2, strings.Count(content, "#EXTINF"))
+	assert.Contains(t, content, ",BBC One\n")
+	assert.Contains(t, content, ",BBC One London\n")
+}
@@ -0,0 +1,186 @@
+package sourceproc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"m3u-stream-merger/config"
+	"m3u-stream-merger/logger"
+)
+
+// assignedNumber is the channel number given to a merge key, along with the
+// block it was taken from ("" for channels outside of the group blocks).
+type assignedNumber struct {
+	Number int    `json:"number"`
+	Block  string `json:"block,omitempty"`
+}
+
+// channelNumbering numbers the channels of the merged playlist in sorted
+// order. Channels start at CHANNEL_NUMBER_START, or at the start of the block
+// of their group in CHANNEL_NUMBER_GROUPS (e.g. "Sports:100|News:200").
+//
+// Numbers are remembered per merge key, so a channel keeps its number across
+// syncs as long as it stays in the same block. The numbers of the previous
+// sync are reserved, so new channels take the next free number of their block
+// instead of shifting the others.
+type channelNumbering struct {
+	profile  string
+	start    int
+	blocks   map[string]int
+	previous map[string]assignedNumber
+	assigned map[string]assignedNumber
+	used     map[int]bool
+	next     map[string]int
+}
+
+func newChannelNumbering(s profileSettings) (*channelNumbering, error) {
+	switch value := strings.ToLower(strings.TrimSpace(s.getenv("CHANNEL_NUMBERING"))); value {
+	case "", "false":
+		return nil, nil
+	case "true":
+	default:
+		return nil, fmt.Errorf("invalid CHANNEL_NUMBERING: %q", value)
+	}
+
+	numbering := &channelNumbering{
+		profile:  s.profile,
+		start:    1,
+		blocks:   make(map[string]int),
+		previous: make(map[string]assignedNumber),
+		assigned: make(map[string]assignedNumber),
+		used:     make(map[int]bool),
+		next:     make(map[string]int),
+	}
+
+	if value := strings.TrimSpace(s.getenv("CHANNEL_NUMBER_START")); value != "" {
+		start, err := strconv.Atoi(value)
+		if err != nil || start < 1 {
+			return nil, fmt.Errorf("invalid CHANNEL_NUMBER_START: %q", value)
+		}
+		numbering.start = start
+	}
+
+	if value := strings.TrimSpace(s.getenv("CHANNEL_NUMBER_GROUPS")); value != "" {
+		for _, item := range strings.Split(value, "|") {
+			sep := strings.LastIndex(item, ":")
+			if sep < 0 {
+				return nil, fmt.Errorf("invalid CHANNEL_NUMBER_GROUPS: missing start number for %q", item)
+			}
+
+			group := strings.ToLower(strings.TrimSpace(item[:sep]))
+			if group == "" {
+				return nil, fmt.Errorf("invalid CHANNEL_NUMBER_GROUPS: missing group in %q", item)
+			}
+			if _, ok := numbering.blocks[group]; ok {
+				return nil, fmt.Errorf("invalid CHANNEL_NUMBER_GROUPS: duplicate group %q", item[:sep])
+			}
+
+			start, err := strconv.Atoi(strings.TrimSpace(item[sep+1:]))
+			if err != nil || start < 1 {
+				return nil, fmt.Errorf("invalid CHANNEL_NUMBER_GROUPS: invalid start number for %q", item[:sep])
+			}
+			numbering.blocks[group] = start
+		}
+	}
+
+	return numbering, nil
+}
+
+// compileChannelNumbering compiles the numbering settings of a playlist for a
+// sync and loads the numbers assigned on the previous sync. It returns nil,
+// which keeps the tvg-chno of the sources, when numbering is off or its
+// settings can't be compiled.
+func compileChannelNumbering(s profileSettings) *channelNumbering {
+	numbering, err := newChannelNumbering(s)
+	if err != nil {
+		logger.Default.Errorf("Keeping the channel numbers of the sources: %v", err)
+		return nil
+	}
+	if numbering == nil {
+		return nil
+	}
+
+	data, err := os.ReadFile(config.GetChannelNumbersPath(numbering.profile))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Default.Errorf("Error reading channel numbers: %v", err)
+		}
+		return numbering
+	}
+	if err := json.Unmarshal(data, &numbering.previous); err != nil {
+		logger.Default.Errorf("Error reading channel numbers, renumbering all channels: %v", err)
+		numbering.previous = make(map[string]assignedNumber)
+		return numbering
+	}
+
+	for _, previous := range numbering.previous {
+		numbering.used[previous.Number] = true
+	}
+
+	return numbering
+}
+
+// block returns the block of a group and its first number.
+func (n *channelNumbering) block(group string) (string, int) {
+	block := strings.ToLower(strings.TrimSpace(group))
+	if start, ok := n.blocks[block]; ok {
+		return block, start
+	}
+	return "", n.start
+}
+
+// assign sets the channel number of a stream. Streams must be assigned in
+// sorted order.
+func (n *channelNumbering) assign(stream *StreamInfo) {
+	key := stream.indexKey()
+	block, start := n.block(stream.Group)
+
+	if assigned, ok := n.assigned[key]; ok {
+		stream.TvgChNo = strconv.Itoa(assigned.Number)
+		return
+	}
+
+	number := 0
+	if previous, ok := n.previous[key]; ok && previous.Block == block {
+		number = previous.Number
+	} else {
+		number = n.next[block]
+		if number < start {
+			number = start
+		}
+		for n.used[number] {
+			number++
+		}
+		n.used[number] = true
+		n.next[block] = number + 1
+	}
+
+	n.assigned[key] = assignedNumber{Number: number, Block: block}
+	stream.TvgChNo = strconv.Itoa(number)
+}
+
+// save stores the numbers assigned during this sync. Channels that are no
+// longer in the playlist are forgotten, so their numbers are free again on
+// the next sync.
+func (n *channelNumbering) save() error {
+	data, err := json.Marshal(n.assigned)
+	if err != nil {
+		return err
+	}
+
+	path := config.GetChannelNumbersPath(n.profile)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,128 @@
+package sourceproc
+
+import (
+	"os"
+	"testing"
+
+	"m3u-stream-merger/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelNumbering(t *testing.T) {
+	setupTestConfig(t)
+
+	t.Setenv("CHANNEL_NUMBERING", "true")
+	t.Setenv("CHANNEL_NUMBER_START", "10")
+	t.Setenv("CHANNEL_NUMBER_GROUPS", "Sports:100|News:200")
+
+	runSync := func(streams ...*StreamInfo) map[string]string {
+		numbering := compileChannelNumbering(defaultSettings)
+		require.NotNil(t, numbering)
+
+		numbers := make(map[string]string)
+		for _, stream := range streams {
+			stream.TvgChNo = "1"
+			numbering.assign(stream)
+			numbers[stream.Title] = stream.TvgChNo
+		}
+		require.NoError(t, numbering.save())
+		return numbers
+	}
+
+	numbers := runSync(
+		&StreamInfo{Title: "ABC", Group: "Entertainment"},
+		&StreamInfo{Title: "CNN", Group: "news"},
+		&StreamInfo{Title: "ESPN", Group: "Sports"},
+		&StreamInfo{Title: "NBC", Group: "Entertainment"},
+		&StreamInfo{Title: "Sky Sports", Group: "Sports"},
+	)
+	assert.Equal(t, map[string]string{
+		"ABC":        "10",
+		"CNN":        "200",
+		"ESPN":       "100",
+		"NBC":        "11",
+		"Sky Sports": "101",
+	}, numbers)
+
+	// New channels take the next free number of their block instead of
+	// shifting the channels that were already numbered.
+	numbers = runSync(
+		&StreamInfo{Title: "ABC", Group: "Entertainment"},
+		&StreamInfo{Title: "BBC", Group: "Entertainment"},
+		&StreamInfo{Title: "beIN", Group: "Sports"},
+		&StreamInfo{Title: "CNN", Group: "News"},
+		&StreamInfo{Title: "ESPN", Group: "Sports"},
+		&StreamInfo{Title: "Sky Sports", Group: "Sports"},
+	)
+	assert.Equal(t, map[string]string{
+		"ABC":        "10",
+		"BBC":        "12",
+		"beIN":       "102",
+		"CNN":        "200",
+		"ESPN":       "100",
+		"Sky Sports": "101",
+	}, numbers)
+
+	// NBC was removed on the previous sync, so its number is free again.
+	// Channels that change blocks are renumbered.
+	numbers = runSync(
+		&StreamInfo{Title: "ABC", Group: "Entertainment"},
+		&StreamInfo{Title: "BBC", Group: "Entertainment"},
+		&StreamInfo{Title: "CNN", Group: "Entertainment"},
+		&StreamInfo{Title: "ESPN", Group: "Sports"},
+	)
+	assert.Equal(t, map[string]string{
+		"ABC":  "10",
+		"BBC":  "12",
+		"CNN":  "11",
+		"ESPN": "100",
+	}, numbers)
+
+	// Channels are remembered by merge key.
+	numbers = runSync(
+		&StreamInfo{Title: "ABC East", MergeKey: "ABC", Group: "Entertainment"},
+	)
+	assert.Equal(t, map[string]string{"ABC East": "10"}, numbers)
+}
+
+func TestChannelNumberingValidation(t *testing.T) {
+	t.Setenv("CHANNEL_NUMBERING", "yes")
+	assert.ErrorContains(t, ValidateSettings(), `invalid CHANNEL_NUMBERING: "yes"`)
+
+	t.Setenv("CHANNEL_NUMBERING", "true")
+	t.Setenv("CHANNEL_NUMBER_START", "0")
+	assert.ErrorContains(t, ValidateSettings(), `invalid CHANNEL_NUMBER_START: "0"`)
+
+	t.Setenv("CHANNEL_NUMBER_START", "1")
+	t.Setenv("CHANNEL_NUMBER_GROUPS", "Sports")
+	assert.ErrorContains(t, ValidateSettings(), `invalid CHANNEL_NUMBER_GROUPS: missing start number for "Sports"`)
+
+	t.Setenv("CHANNEL_NUMBER_GROUPS", "Sports:100|sports:200")
+	assert.ErrorContains(t, ValidateSettings(), `invalid CHANNEL_NUMBER_GROUPS: duplicate group "sports"`)
+
+	t.Setenv("CHANNEL_NUMBER_GROUPS", "US: Sports:100|News:abc")
+	assert.ErrorContains(t, ValidateSettings(), `invalid CHANNEL_NUMBER_GROUPS: invalid start number for "News"`)
+
+	t.Setenv("CHANNEL_NUMBER_GROUPS", "US: Sports:100|News:200")
+	assert.NoError(t, ValidateSettings())
+}
+
+func TestChannelNumbersInPlaylist(t *testing.T) {
+	t.Setenv("CHANNEL_NUMBERING", "true")
+	t.Setenv("CHANNEL_NUMBER_GROUPS", "Sports:100")
+	processor := runProcessorOn(t, "#EXTM3U\n"+
+		"#EXTINF:-1 tvg-chno=\"7\" group-title=\"Sports\",ESPN\nhttp://example.com/espn\n"+
+		"#EXTINF:-1 tvg-chno=\"7\",CNN\nhttp://example.com/cnn\n"+
+		"#EXTINF:-1,ABC\nhttp://example.com/abc\n")
+
+	content, err := os.ReadFile(processor.GetResultPath())
+	require.NoError(t, err)
+	assert.Contains(t, string(content), `#EXTINF:-1 tvg-chno="1" tvg-name="ABC",ABC`)
+	assert.Contains(t, string(content), `#EXTINF:-1 tvg-chno="2" tvg-name="CNN",CNN`)
+	assert.Contains(t, string(content), `#EXTINF:-1 tvg-chno="100" tvg-group="Sports" group-title="Sports" tvg-name="ESPN",ESPN`)
+
+	_, err = os.Stat(config.GetChannelNumbersPath(""))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,172 @@
+package sourceproc
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	compressionNone = ""
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+	compressionXz   = "xz"
+	compressionZip  = "zip"
+)
+
+// maxMagicLength is the length of the longest magic number below.
+const maxMagicLength = 6
+
+var compressionMagic = []struct {
+	kind  string
+	magic []byte
+}{
+	{compressionGzip, []byte{0x1f, 0x8b}},
+	{compressionZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{compressionXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{compressionZip, []byte{'P', 'K', 0x03, 0x04}},
+}
+
+var compressionExtensions = map[string]string{
+	".gz":   compressionGzip,
+	".gzip": compressionGzip,
+	".zst":  compressionZstd,
+	".zstd": compressionZstd,
+	".xz":   compressionXz,
+	".zip":  compressionZip,
+}
+
+// detectCompression identifies the compression format from the magic bytes
+// of the content. The file extension is only used as a hint when there are
+// not enough bytes to tell.
+func detectCompression(header []byte, name string) string {
+	for _, candidate := range compressionMagic {
+		if bytes.HasPrefix(header, candidate.magic) {
+			return candidate.kind
+		}
+	}
+
+	if len(header) < maxMagicLength {
+		return compressionExtensions[strings.ToLower(filepath.Ext(name))]
+	}
+
+	return compressionNone
+}
+
+type sourceReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *sourceReader) Close() error {
+	var firstErr error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if err := r.closers[i].Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// openSource opens a playlist file and transparently decompresses it while
+// it is being read, so that callers can keep scanning it line by line.
+func openSource(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	buffered := bufio.NewReaderSize(file, 64*1024)
+	header, _ := buffered.Peek(maxMagicLength)
+
+	reader := &sourceReader{Reader: buffered, closers: []io.Closer{file}}
+
+	switch detectCompression(header, path) {
+	case compressionGzip:
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("error opening gzip stream: %v", err)
+		}
+		reader.Reader = gzipReader
+		reader.closers = append(reader.closers, gzipReader)
+	case compressionZstd:
+		zstdReader, err := zstd.NewReader(buffered, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("error opening zstd stream: %v", err)
+		}
+		reader.Reader = zstdReader
+		reader.closers = append(reader.closers, closerFunc(func() error {
+			zstdReader.Close()
+			return nil
+		}))
+	case compressionXz:
+		xzReader, err := xz.NewReader(buffered)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("error opening xz stream: %v", err)
+		}
+		reader.Reader = xzReader
+	case compressionZip:
+		entry, err := openZipPlaylist(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		reader.Reader = entry
+		reader.closers = append(reader.closers, entry)
+	}
+
+	return reader, nil
+}
+
+// openZipPlaylist opens the first playlist found in a zip archive, or the
+// first regular file if none of the entries looks like a playlist.
+func openZipPlaylist(file *os.File) (io.ReadCloser, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("error reading zip archive: %v", err)
+	}
+
+	archive, err := zip.NewReader(file, info.Size())
+	if err != nil {
+		return nil, fmt.Errorf("error reading zip archive: %v", err)
+	}
+
+	var selected *zip.File
+	for _, entry := range archive.File {
+		if entry.FileInfo().IsDir() {
+			continue
+		}
+		ext := strings.ToLower(filepath.Ext(entry.Name))
+		if ext == ".m3u" || ext == ".m3u8" {
+			selected = entry
+			break
+		}
+		if selected == nil {
+			selected = entry
+		}
+	}
+
+	if selected == nil {
+		return nil, fmt.Errorf("zip archive does not contain any file")
+	}
+
+	return selected.Open()
+}
@@ -0,0 +1,120 @@
+package sourceproc
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+)
+
+const compressedTestPlaylist = "#EXTM3U\n" +
+	"#EXTINF:-1 group-title=\"News\",CNN\nhttp://example.com/cnn\n" +
+	"#EXTINF:-1 group-title=\"Sports\",ESPN\nhttp://example.com/espn\n"
+
+func compressPlaylist(t *testing.T, kind string) []byte {
+	var buf bytes.Buffer
+
+	var writer io.WriteCloser
+	switch kind {
+	case compressionGzip:
+		writer = gzip.NewWriter(&buf)
+	case compressionZstd:
+		zstdWriter, err := zstd.NewWriter(&buf)
+		require.NoError(t, err)
+		writer = zstdWriter
+	case compressionXz:
+		xzWriter, err := xz.NewWriter(&buf)
+		require.NoError(t, err)
+		writer = xzWriter
+	case compressionZip:
+		archive := zip.NewWriter(&buf)
+		_, err := archive.Create("readme.txt")
+		require.NoError(t, err)
+		entry, err := archive.Create("channels.m3u")
+		require.NoError(t, err)
+		_, err = entry.Write([]byte(compressedTestPlaylist))
+		require.NoError(t, err)
+		require.NoError(t, archive.Close())
+		return buf.Bytes()
+	default:
+		return []byte(compressedTestPlaylist)
+	}
+
+	_, err := writer.Write([]byte(compressedTestPlaylist))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	return buf.Bytes()
+}
+
+func TestDetectCompression(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   []byte
+		fileName string
+		expected string
+	}{
+		{"gzip magic", []byte{0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00}, "playlist.m3u", compressionGzip},
+		{"zstd magic", []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0x00}, "playlist", compressionZstd},
+		{"xz magic", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, "playlist", compressionXz},
+		{"zip magic", []byte{'P', 'K', 0x03, 0x04, 0x00, 0x00}, "playlist", compressionZip},
+		{"plain text ignores extension", []byte("#EXTM3U"), "playlist.m3u.gz", compressionNone},
+		{"short content uses extension", []byte{}, "playlist.m3u.xz", compressionXz},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, detectCompression(tt.header, tt.fileName))
+		})
+	}
+}
+
+func TestHandleLocalFileCompressed(t *testing.T) {
+	tempDir := t.TempDir()
+
+	for _, kind := range []string{compressionNone, compressionGzip, compressionZstd, compressionXz, compressionZip} {
+		name := kind
+		if name == "" {
+			name = "plain"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(tempDir, "playlist-"+name)
+			require.NoError(t, os.WriteFile(path, compressPlaylist(t, kind), 0644))
+
+			result := &SourceDownloaderResult{
+				Index: "1",
+				Lines: make(chan *LineDetails, 1000),
+				Error: make(chan error, 1),
+			}
+			go func() {
+				defer close(result.Lines)
+				defer close(result.Error)
+				handleLocalFile(path, result)
+			}()
+
+			var lines []string
+			for line := range result.Lines {
+				lines = append(lines, line.Content)
+			}
+			for err := range result.Error {
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, strings.TrimSuffix(compressedTestPlaylist, "\n"), strings.Join(lines, "\n"))
+
+			entries, err := countSourceEntries(path)
+			require.NoError(t, err)
+			assert.Equal(t, 2, entries)
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package sourceproc
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"time"
+)
+
+// ChannelSnapshot is the part of a merged channel that is compared between
+// consecutive syncs.
+type ChannelSnapshot struct {
+	// Key is the key the channel was merged on. Channels can share a title
+	// while being merged on different keys.
+	Key    string   `json:"key,omitempty"`
+	Title  string   `json:"title"`
+	TvgID  string   `json:"tvg_id,omitempty"`
+	Group  string   `json:"group,omitempty"`
+	Logo   string   `json:"logo,omitempty"`
+	Number string   `json:"number,omitempty"`
+	URLs   []string `json:"urls,omitempty"`
+}
+
+func newChannelSnapshot(stream *StreamInfo) *ChannelSnapshot {
+	urls := slices.Clone(stream.URLKeys)
+	sort.Strings(urls)
+
+	return &ChannelSnapshot{
+		Key:    stream.indexKey(),
+		Title:  stream.Title,
+		TvgID:  stream.TvgID,
+		Group:  stream.Group,
+		Logo:   stream.LogoURL,
+		Number: stream.TvgChNo,
+		URLs:   urls,
+	}
+}
+
+// snapshotWriter streams the channels of a processed M3U into a JSON array
+// saved next to it.
+type snapshotWriter struct {
+	file    *os.File
+	writer  *bufio.Writer
+	entries int
+}
+
+func newSnapshotWriter(path string) (*snapshotWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("error creating channel snapshot: %v", err)
+	}
+
+	writer := bufio.NewWriter(file)
+	_, _ = writer.WriteString("[")
+
+	return &snapshotWriter{file: file, writer: writer}, nil
+}
+
+// key returns the key the channel is compared on. Snapshots saved before keys
+// were stored only have the title.
+func (c *ChannelSnapshot) key() string {
+	if c.Key != "" {
+		return c.Key
+	}
+	return c.Title
+}
+
+func (w *snapshotWriter) write(stream *StreamInfo) error {
+	data, err := json.Marshal(newChannelSnapshot(stream))
+	if err != nil {
+		return err
+	}
+
+	if w.entries > 0 {
+		_, _ = w.writer.WriteString(",\n")
+	}
+	w.entries++
+
+	_, err = w.writer.Write(data)
+	return err
+}
+
+func (w *snapshotWriter) close() error {
+	_, _ = w.writer.WriteString("]\n")
+	if err := w.writer.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// readChannelSnapshot decodes a channel snapshot one channel at a time.
+func readChannelSnapshot(path string, callback func(*ChannelSnapshot)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	if _, err := decoder.Token(); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return fmt.Errorf("error decoding channel snapshot: %v", err)
+	}
+
+	for decoder.More() {
+		var channel ChannelSnapshot
+		if err := decoder.Decode(&channel); err != nil {
+			return fmt.Errorf("error decoding channel snapshot: %v", err)
+		}
+		callback(&channel)
+	}
+
+	return nil
+}
+
+// LoadChannelSnapshot loads the channel snapshot saved next to a processed
+// M3U, keyed by the key the channels were merged on.
+func LoadChannelSnapshot(path string) (map[string]*ChannelSnapshot, error) {
+	channels := make(map[string]*ChannelSnapshot)
+	err := readChannelSnapshot(path, func(channel *ChannelSnapshot) {
+		channels[channel.key()] = channel
+	})
+	if err != nil {
+		return nil, err
+	}
+	return channels, nil
+}
+
+// ChannelURLChange lists the URLs, as "index|urlHash", that were added to or
+// removed from a channel.
+type ChannelURLChange struct {
+	Key     string   `json:"key,omitempty"`
+	Title   string   `json:"title"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// ChannelFieldChange describes a changed group, logo or number.
+type ChannelFieldChange struct {
+	Key   string `json:"key,omitempty"`
+	Title string `json:"title"`
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// SyncDiff describes what changed between two consecutive merged playlists.
+type SyncDiff struct {
+	GeneratedAt time.Time               `json:"generated_at"`
+	Previous    string                  `json:"previous"`
+	Current     string                  `json:"current"`
+	Added       []*ChannelSnapshot      `json:"added"`
+	Removed     []*ChannelSnapshot      `json:"removed"`
+	URLsChanged []ChannelURLChange      `json:"urls_changed"`
+	Changed     []ChannelFieldChange    `json:"changed"`
+	Sources     map[string]SourceStatus `json:"sources"`
+}
+
+// ComputeSyncDiff compares the previous channels with the snapshot saved
+// next to the current processed M3U.
+func ComputeSyncDiff(previous map[string]*ChannelSnapshot, currentSnapshotPath string) (*SyncDiff, error) {
+	diff := &SyncDiff{
+		GeneratedAt: time.Now(),
+		Added:       []*ChannelSnapshot{},
+		Removed:     []*ChannelSnapshot{},
+		URLsChanged: []ChannelURLChange{},
+		Changed:     []ChannelFieldChange{},
+		Sources:     GetSourceStatuses(),
+	}
+
+	seen := make(map[string]bool, len(previous))
+	err := readChannelSnapshot(currentSnapshotPath, func(current *ChannelSnapshot) {
+		key := current.key()
+		seen[key] = true
+
+		old, ok := previous[key]
+		if !ok {
+			diff.Added = append(diff.Added, current)
+			return
+		}
+
+		fields := []struct {
+			name     string
+			old, new string
+		}{
+			{"group", old.Group, current.Group},
+			{"logo", old.Logo, current.Logo},
+			{"number", old.Number, current.Number},
+		}
+		for _, field := range fields {
+			if field.old != field.new {
+				diff.Changed = append(diff.Changed, ChannelFieldChange{
+					Key:   current.Key,
+					Title: current.Title,
+					Field: field.name,
+					Old:   field.old,
+					New:   field.new,
+				})
+			}
+		}
+
+		change := ChannelURLChange{Key: current.Key, Title: current.Title}
+		for _, url := range current.URLs {
+			if !slices.Contains(old.URLs, url) {
+				change.Added = append(change.Added, url)
+			}
+		}
+		for _, url := range old.URLs {
+			if !slices.Contains(current.URLs, url) {
+				change.Removed = append(change.Removed, url)
+			}
+		}
+		if len(change.Added) > 0 || len(change.Removed) > 0 {
+			diff.URLsChanged = append(diff.URLsChanged, change)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for key, channel := range previous {
+		if !seen[key] {
+			diff.Removed = append(diff.Removed, channel)
+		}
+	}
+	sort.Slice(diff.Removed, func(i, j int) bool {
+		if diff.Removed[i].Title != diff.Removed[j].Title {
+			return diff.Removed[i].Title < diff.Removed[j].Title
+		}
+		return diff.Removed[i].key() < diff.Removed[j].key()
+	})
+
+	return diff, nil
+}
+
+// SaveSyncDiff writes a sync diff as JSON.
+func SaveSyncDiff(path string, diff *SyncDiff) error {
+	data, err := json.MarshalIndent(diff, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
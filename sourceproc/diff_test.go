@@ -0,0 +1,120 @@
+package sourceproc
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"m3u-stream-merger/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComputeSyncDiff(t *testing.T) {
+	playlistPath := filepath.Join(setupTestConfig(t), "playlist.m3u")
+	t.Setenv("M3U_URL_1", "file://"+playlistPath)
+
+	runProcessor := func(playlist string) string {
+		require.NoError(t, os.WriteFile(playlistPath, []byte(playlist), 0644))
+		return runTestProcessor(t).GetResultPath()
+	}
+
+	firstPath := runProcessor("#EXTM3U\n" +
+		"#EXTINF:-1 group-title=\"News\" tvg-chno=\"1\",CNN\nhttp://example.com/cnn\n" +
+		"#EXTINF:-1 group-title=\"News\" tvg-logo=\"http://example.com/bbc.png\",BBC\nhttp://example.com/bbc\n" +
+		"#EXTINF:-1 group-title=\"Sports\",ESPN\nhttp://example.com/espn\n")
+
+	previous, err := LoadChannelSnapshot(config.GetProcessedSnapshotPath(firstPath))
+	require.NoError(t, err)
+	require.Len(t, previous, 3)
+
+	// Processed files are named after the current second.
+	time.Sleep(time.Second)
+
+	secondPath := runProcessor("#EXTM3U\n" +
+		"#EXTINF:-1 group-title=\"World\" tvg-chno=\"2\",CNN\nhttp://example.com/cnn\n" +
+		"#EXTINF:-1 group-title=\"News\" tvg-logo=\"http://example.com/bbc.png\",BBC\nhttp://example.com/bbc-hd\n" +
+		"#EXTINF:-1 group-title=\"Sports\",Eurosport\nhttp://example.com/eurosport\n")
+	require.NotEqual(t, firstPath, secondPath)
+
+	diff, err := ComputeSyncDiff(previous, config.GetProcessedSnapshotPath(secondPath))
+	require.NoError(t, err)
+
+	require.Len(t, diff.Added, 1)
+	assert.Equal(t, "Eurosport", diff.Added[0].Title)
+
+	require.Len(t, diff.Removed, 1)
+	assert.Equal(t, "ESPN", diff.Removed[0].Title)
+
+	require.Len(t, diff.URLsChanged, 1)
+	assert.Equal(t, "BBC", diff.URLsChanged[0].Title)
+	assert.Len(t, diff.URLsChanged[0].Added, 1)
+	assert.Len(t, diff.URLsChanged[0].Removed, 1)
+
+	assert.ElementsMatch(t, []ChannelFieldChange{
+		{Key: "CNN", Title: "CNN", Field: "group", Old: "News", New: "World"},
+		{Key: "CNN", Title: "CNN", Field: "number", Old: "1", New: "2"},
+	}, diff.Changed)
+
+	assert.Equal(t, SourceStatusLocal, diff.Sources["1"].Status)
+
+	// The files of the previous sync are cleared, the new sidecars are kept.
+	_, err = os.Stat(firstPath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(config.GetProcessedSnapshotPath(secondPath))
+	assert.NoError(t, err)
+
+	latest, err := config.GetLatestProcessedM3UPath()
+	require.NoError(t, err)
+	assert.Equal(t, secondPath, latest)
+}
+
+func TestComputeSyncDiffSharedTitles(t *testing.T) {
+	tempDir := t.TempDir()
+
+	writeSnapshot := func(name string, streams ...*StreamInfo) string {
+		path := filepath.Join(tempDir, name)
+		writer, err := newSnapshotWriter(path)
+		require.NoError(t, err)
+		for _, stream := range streams {
+			require.NoError(t, writer.write(stream))
+		}
+		require.NoError(t, writer.close())
+		return path
+	}
+
+	// Both channels are displayed as "CNN" once "HD" is rewritten away, but
+	// are merged on different keys.
+	cnn := &StreamInfo{Title: "CNN", MergeKey: "cnn", Group: "News", URLKeys: []string{"1|a"}}
+	cnnHD := &StreamInfo{Title: "CNN", MergeKey: "cnn hd", Group: "News", URLKeys: []string{"1|b"}}
+
+	previous, err := LoadChannelSnapshot(writeSnapshot("previous.json", cnn, cnnHD))
+	require.NoError(t, err)
+	require.Len(t, previous, 2)
+
+	diff, err := ComputeSyncDiff(previous, writeSnapshot("unchanged.json", cnnHD, cnn))
+	require.NoError(t, err)
+	assert.Empty(t, diff.Added)
+	assert.Empty(t, diff.Removed)
+	assert.Empty(t, diff.URLsChanged)
+	assert.Empty(t, diff.Changed)
+
+	diff, err = ComputeSyncDiff(previous, writeSnapshot("removed.json", cnn))
+	require.NoError(t, err)
+	assert.Empty(t, diff.Added)
+	assert.Empty(t, diff.URLsChanged)
+	require.Len(t, diff.Removed, 1)
+	assert.Equal(t, "cnn hd", diff.Removed[0].Key)
+
+	// Snapshots saved without keys are compared on titles.
+	legacyPath := filepath.Join(tempDir, "legacy.json")
+	require.NoError(t, os.WriteFile(legacyPath, []byte(`[{"title":"BBC","urls":["1|c"]}]`), 0644))
+	previous, err = LoadChannelSnapshot(legacyPath)
+	require.NoError(t, err)
+	diff, err = ComputeSyncDiff(previous, writeSnapshot("current.json", &StreamInfo{Title: "BBC", URLKeys: []string{"1|c"}}))
+	require.NoError(t, err)
+	assert.Empty(t, diff.Added)
+	assert.Empty(t, diff.Removed)
+}
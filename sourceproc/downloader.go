@@ -2,6 +2,7 @@ package sourceproc
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,6 +11,7 @@ import (
 	"strings"
 	"sync"
 
+	"m3u-stream-merger/logger"
 	"m3u-stream-merger/utils"
 )
 
@@ -24,7 +26,9 @@ type LineDetails struct {
 	LineNum int
 }
 
-func streamDownloadM3USources() chan *SourceDownloaderResult {
+// streamDownloadM3USources streams the lines of every source. Remote sources
+// for which refresh returns false are read from their cached copy.
+func streamDownloadM3USources(refresh func(idx string) bool) chan *SourceDownloaderResult {
 	resultChan := make(chan *SourceDownloaderResult)
 	indexes := utils.GetM3UIndexes()
 
@@ -54,11 +58,15 @@ func streamDownloadM3USources() chan *SourceDownloaderResult {
 					}
 
 					if strings.HasPrefix(m3uURL, "file://") {
+						recordSourceStatus(idx, SourceStatusLocal, nil)
 						handleLocalFile(strings.TrimPrefix(m3uURL, "file://"), result)
 						return
 					}
 
-					fmt.Println("M3UURL : " + m3uURL)
+					if !refresh(idx) && handleCachedSource(idx, result) {
+						return
+					}
+
 					handleRemoteURL(m3uURL, idx, result)
 				}()
 
@@ -73,7 +81,7 @@ func streamDownloadM3USources() chan *SourceDownloaderResult {
 }
 
 func handleLocalFile(localPath string, result *SourceDownloaderResult) {
-	file, err := os.Open(localPath)
+	file, err := openSource(localPath)
 	if err != nil {
 		result.Error <- fmt.Errorf("error opening local file: %v", err)
 		return
@@ -83,61 +91,200 @@ func handleLocalFile(localPath string, result *SourceDownloaderResult) {
 	scanAndStream(file, result)
 }
 
+// handleCachedSource streams the cached copy of a remote source without
+// downloading it. It reports false if there is no cached copy yet.
+func handleCachedSource(idx string, result *SourceDownloaderResult) bool {
+	finalPath := utils.GetM3UFilePathByIndex(idx)
+	if _, err := os.Stat(finalPath); err != nil {
+		logger.Default.Logf("M3U_%s has no cached copy yet. Downloading it.", idx)
+		return false
+	}
+
+	logger.Default.Debugf("Using cached copy of M3U_%s", idx)
+	recordSourceStatus(idx, SourceStatusCached, nil)
+	handleLocalFile(finalPath, result)
+	return true
+}
+
+// handleRemoteURL downloads the source into its cache file and streams the
+// cached copy. If the provider reports that nothing changed, the download
+// fails or the result looks truncated, the last good cached copy is used.
 func handleRemoteURL(m3uURL, idx string, result *SourceDownloaderResult) {
-	resp, err := utils.CustomHttpRequest("GET", m3uURL)
+	finalPath := utils.GetM3UFilePathByIndex(idx)
+
+	var err error
+	if isXtreamURL(m3uURL) {
+		err = downloadXtreamSource(m3uURL, idx, finalPath)
+	} else {
+		err = downloadRemoteSource(m3uURL, idx, finalPath)
+	}
+
+	switch {
+	case err == nil:
+		recordSourceStatus(idx, SourceStatusDownloaded, nil)
+	case errors.Is(err, errNotModified):
+		logger.Default.Logf("M3U_%s has not changed since the last sync. Using cached copy.", idx)
+		recordSourceStatus(idx, SourceStatusNotModified, nil)
+	default:
+		if _, statErr := os.Stat(finalPath); statErr != nil {
+			recordSourceStatus(idx, SourceStatusFailed, err)
+			result.Error <- err
+			return
+		}
+		logger.Default.Warnf("M3U_%s sync failed (%v). Falling back to the last good cached copy.", idx, err)
+		recordSourceStatus(idx, SourceStatusCachedFallback, err)
+	}
+
+	handleLocalFile(finalPath, result)
+}
+
+func downloadRemoteSource(m3uURL, idx, finalPath string) error {
+	meta := loadSourceMeta(finalPath)
+
+	req, err := http.NewRequest("GET", m3uURL, nil)
 	if err != nil {
-		result.Error <- fmt.Errorf("HTTP GET error: %v", err)
-		return
+		return fmt.Errorf("HTTP GET error: %v", err)
+	}
+	utils.ApplySourceHeaders(req, idx)
+
+	if _, err := os.Stat(finalPath); err == nil {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	resp, err := utils.GetSourceHTTPClient(idx).Do(req)
+	if err != nil {
+		return fmt.Errorf("HTTP GET error: %v", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified {
+		return errNotModified
+	}
+
 	if resp.StatusCode != http.StatusOK {
-		result.Error <- fmt.Errorf("unexpected status code: %d", resp.StatusCode)
-		fmt.Printf("Failed to Download , http code: %d\n", resp.StatusCode)
-		return
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
 
-	finalPath := utils.GetM3UFilePathByIndex(idx)
-	tmpPath := finalPath + ".new"
+	return saveSourceFile(finalPath, func(w io.Writer) error {
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			return fmt.Errorf("error downloading content: %v", err)
+		}
+		return nil
+	}, sourceMeta{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	})
+}
 
-	fmt.Printf("FinalPath : %s , tempPath %s \n", finalPath, tmpPath)
+// saveSourceFile writes a freshly downloaded source to a temporary file and
+// only replaces the cached copy once the new content passed validation.
+func saveSourceFile(finalPath string, write func(io.Writer) error, meta sourceMeta) error {
+	tmpPath := finalPath + ".new"
 
 	if err := os.MkdirAll(filepath.Dir(finalPath), os.ModePerm); err != nil {
-		result.Error <- fmt.Errorf("error creating directories: %v", err)
-		return
+		return fmt.Errorf("error creating directories: %v", err)
 	}
 
 	file, err := os.Create(tmpPath)
 	if err != nil {
-		result.Error <- fmt.Errorf("error creating file: %v", err)
-		return
+		return fmt.Errorf("error creating file: %v", err)
 	}
 
-	reader := io.TeeReader(resp.Body, file)
-	scanAndStream(reader, result)
-
+	err = write(file)
 	file.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	entries, err := countSourceEntries(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	previous := loadSourceMeta(finalPath)
+	if isTruncated(entries, previous.Entries) {
+		os.Remove(tmpPath)
+		return fmt.Errorf("download looks truncated: %d entries (last good copy had %d)", entries, previous.Entries)
+	}
+
 	_ = os.Remove(finalPath)
 	if err := os.Rename(tmpPath, finalPath); err != nil {
-		result.Error <- fmt.Errorf("error moving file: %v", err)
 		os.Remove(tmpPath)
+		return fmt.Errorf("error moving file: %v", err)
+	}
+
+	meta.Entries = entries
+	if err := saveSourceMeta(finalPath, meta); err != nil {
+		logger.Default.Debugf("Error saving source metadata for %s: %v", finalPath, err)
 	}
+
+	return nil
 }
 
-func scanAndStream(r io.Reader, result *SourceDownloaderResult) {
-	scanner := bufio.NewScanner(r)
-	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+func countSourceEntries(path string) (int, error) {
+	file, err := openSource(path)
+	if err != nil {
+		return 0, fmt.Errorf("error opening downloaded file: %v", err)
+	}
+	defer file.Close()
+
+	entries := 0
+	err = readLines(file, func(line string) {
+		if isExtInfLine(strings.TrimSpace(line)) {
+			entries++
+		}
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error reading downloaded file: %v", err)
+	}
 
+	return entries, nil
+}
+
+func scanAndStream(r io.Reader, result *SourceDownloaderResult) {
 	lineNum := 0
-	for scanner.Scan() {
+	err := readLines(r, func(line string) {
 		result.Lines <- &LineDetails{
-			Content: scanner.Text(),
+			Content: line,
 			LineNum: lineNum,
 		}
 		lineNum++
-	}
+	})
 
-	if err := scanner.Err(); err != nil {
+	if err != nil {
 		result.Error <- fmt.Errorf("error reading content: %v", err)
 	}
 }
+
+// readLines calls fn for every line of r. Unlike bufio.Scanner it has no
+// line length limit. CRLF line endings and a leading UTF-8 BOM are removed.
+func readLines(r io.Reader, fn func(line string)) error {
+	reader := bufio.NewReaderSize(r, 64*1024)
+
+	first := true
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			line = strings.TrimRight(line, "\r\n")
+			if first {
+				line = strings.TrimPrefix(line, "\ufeff")
+				first = false
+			}
+			fn(line)
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package sourceproc
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"m3u-stream-merger/utils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func collectSourceLines(m3uURL, idx string) ([]string, []error) {
+	result := &SourceDownloaderResult{
+		Index: idx,
+		Lines: make(chan *LineDetails, 1000),
+		Error: make(chan error, 1),
+	}
+
+	go func() {
+		defer close(result.Lines)
+		defer close(result.Error)
+		handleRemoteURL(m3uURL, idx, result)
+	}()
+
+	var lines []string
+	for line := range result.Lines {
+		lines = append(lines, line.Content)
+	}
+	var errs []error
+	for err := range result.Error {
+		errs = append(errs, err)
+	}
+	return lines, errs
+}
+
+func TestConditionalDownloadAndFallback(t *testing.T) {
+	setupTestConfig(t)
+
+	fullPlaylist := "#EXTM3U\n" +
+		"#EXTINF:-1 group-title=\"News\",CNN\nhttp://example.com/cnn\n" +
+		"#EXTINF:-1 group-title=\"News\",BBC\nhttp://example.com/bbc\n" +
+		"#EXTINF:-1 group-title=\"Sports\",ESPN\nhttp://example.com/espn\n"
+	truncatedPlaylist := "#EXTM3U\n#EXTINF:-1,CNN\nhttp://example.com/cnn\n"
+
+	var mode atomic.Value
+	mode.Store("full")
+	var lastIfNoneMatch atomic.Value
+	lastIfNoneMatch.Store("")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastIfNoneMatch.Store(r.Header.Get("If-None-Match"))
+		switch mode.Load().(string) {
+		case "full":
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			_, _ = w.Write([]byte(fullPlaylist))
+		case "error":
+			w.WriteHeader(http.StatusBadGateway)
+		case "truncated":
+			w.Header().Set("ETag", `"v2"`)
+			_, _ = w.Write([]byte(truncatedPlaylist))
+		}
+	}))
+	defer server.Close()
+
+	// Initial download populates the cache.
+	lines, errs := collectSourceLines(server.URL, "1")
+	require.Empty(t, errs)
+	assert.Contains(t, strings.Join(lines, "\n"), "ESPN")
+	assert.Equal(t, SourceStatusDownloaded, GetSourceStatuses()["1"].Status)
+	assert.Equal(t, `"v1"`, loadSourceMeta(utils.GetM3UFilePathByIndex("1")).ETag)
+
+	// Unchanged upstream answers 304 and the cached copy is streamed.
+	lines, errs = collectSourceLines(server.URL, "1")
+	require.Empty(t, errs)
+	assert.Equal(t, `"v1"`, lastIfNoneMatch.Load())
+	assert.Contains(t, strings.Join(lines, "\n"), "ESPN")
+	assert.Equal(t, SourceStatusNotModified, GetSourceStatuses()["1"].Status)
+
+	// Failed downloads fall back to the last good copy.
+	mode.Store("error")
+	lines, errs = collectSourceLines(server.URL, "1")
+	require.Empty(t, errs)
+	assert.Contains(t, strings.Join(lines, "\n"), "ESPN")
+	assert.Equal(t, SourceStatusCachedFallback, GetSourceStatuses()["1"].Status)
+	assert.Contains(t, GetSourceStatuses()["1"].Error, "502")
+
+	// Suspiciously small downloads are rejected as well.
+	mode.Store("truncated")
+	lines, errs = collectSourceLines(server.URL, "1")
+	require.Empty(t, errs)
+	assert.Contains(t, strings.Join(lines, "\n"), "ESPN")
+	assert.Equal(t, SourceStatusCachedFallback, GetSourceStatuses()["1"].Status)
+	assert.Contains(t, GetSourceStatuses()["1"].Error, "truncated")
+
+	// Without a cached copy, failures are still reported.
+	require.NoError(t, os.Remove(utils.GetM3UFilePathByIndex("1")))
+	mode.Store("error")
+	_, errs = collectSourceLines(server.URL, "1")
+	require.Len(t, errs, 1)
+	assert.Equal(t, SourceStatusFailed, GetSourceStatuses()["1"].Status)
+}
+
+func TestTruncationThreshold(t *testing.T) {
+	utils.ResetCaches()
+	defer utils.ResetCaches()
+
+	t.Setenv("TRUNCATION_THRESHOLD", "80")
+	require.NoError(t, ValidateSettings())
+	assert.True(t, isTruncated(79, 100))
+	assert.False(t, isTruncated(80, 100))
+
+	for _, value := range []string{"101", "-1", "half"} {
+		t.Setenv("TRUNCATION_THRESHOLD", value)
+		assert.ErrorContains(t, ValidateSettings(), "invalid TRUNCATION_THRESHOLD", value)
+	}
+
+	// Invalid values fall back to the default instead of rejecting every
+	// download.
+	t.Setenv("TRUNCATION_THRESHOLD", "150")
+	assert.False(t, isTruncated(100, 100))
+	assert.True(t, isTruncated(49, 100))
+}
+
+func TestDownloadUsesSourceHeaders(t *testing.T) {
+	setupTestConfig(t)
+
+	t.Setenv("M3U_USER_AGENT_7", "CustomAgent/2.0")
+	t.Setenv("M3U_HEADERS_7", "X-Token: abc | X-Device: box")
+	t.Setenv("M3U_REFERER_7", "http://portal.example.com/")
+	t.Setenv("M3U_COOKIES_7", "session=123")
+	t.Setenv("M3U_BASIC_AUTH_7", "user:pass")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "user" || password != "pass" ||
+			r.UserAgent() != "CustomAgent/2.0" ||
+			r.Referer() != "http://portal.example.com/" ||
+			r.Header.Get("X-Token") != "abc" ||
+			r.Header.Get("X-Device") != "box" ||
+			r.Header.Get("Cookie") != "session=123" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte("#EXTM3U\n#EXTINF:-1,CNN\nhttp://example.com/cnn\n"))
+	}))
+	defer server.Close()
+
+	lines, errs := collectSourceLines(server.URL, "7")
+	require.Empty(t, errs)
+	assert.Contains(t, strings.Join(lines, "\n"), "CNN")
+
+	// Other sources keep using the global settings.
+	_, errs = collectSourceLines(server.URL, "8")
+	require.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), "403")
+}
+
+// startSOCKS5Proxy starts a minimal SOCKS5 server that supports
+// unauthenticated CONNECT requests and counts the tunnels it opened.
+func startSOCKS5Proxy(t *testing.T) (string, *atomic.Int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	tunnels := &atomic.Int32{}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				header := make([]byte, 2)
+				if _, err := io.ReadFull(conn, header); err != nil || header[0] != 0x05 {
+					return
+				}
+				if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte{0x05, 0x00})
+
+				request := make([]byte, 4)
+				if _, err := io.ReadFull(conn, request); err != nil || request[1] != 0x01 {
+					return
+				}
+
+				var host string
+				switch request[3] {
+				case 0x01:
+					addr := make([]byte, 4)
+					if _, err := io.ReadFull(conn, addr); err != nil {
+						return
+					}
+					host = net.IP(addr).String()
+				case 0x03:
+					length := make([]byte, 1)
+					if _, err := io.ReadFull(conn, length); err != nil {
+						return
+					}
+					name := make([]byte, length[0])
+					if _, err := io.ReadFull(conn, name); err != nil {
+						return
+					}
+					host = string(name)
+				default:
+					return
+				}
+				port := make([]byte, 2)
+				if _, err := io.ReadFull(conn, port); err != nil {
+					return
+				}
+
+				target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))))
+				if err != nil {
+					_, _ = conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer target.Close()
+
+				tunnels.Add(1)
+				_, _ = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+
+				go func() { _, _ = io.Copy(target, conn) }()
+				_, _ = io.Copy(conn, target)
+			}(conn)
+		}
+	}()
+
+	return listener.Addr().String(), tunnels
+}
+
+func TestDownloadThroughSourceProxy(t *testing.T) {
+	setupTestConfig(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("#EXTM3U\n#EXTINF:-1,CNN\nhttp://example.com/cnn\n"))
+	}))
+	defer server.Close()
+
+	proxyAddr, tunnels := startSOCKS5Proxy(t)
+	t.Setenv("M3U_PROXY_9", "socks5://"+proxyAddr)
+
+	lines, errs := collectSourceLines(server.URL, "9")
+	require.Empty(t, errs)
+	assert.Contains(t, strings.Join(lines, "\n"), "CNN")
+	assert.Equal(t, int32(1), tunnels.Load())
+
+	// Sources without a proxy connect directly.
+	_, errs = collectSourceLines(server.URL, "10")
+	require.Empty(t, errs)
+	assert.Equal(t, int32(1), tunnels.Load())
+}
+
+func TestRefreshSingleSource(t *testing.T) {
+	setupTestConfig(t)
+
+	var version atomic.Int32
+	var requests [2]atomic.Int32
+	newServer := func(source int, title string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests[source].Add(1)
+			v := strconv.Itoa(int(version.Load()))
+			_, _ = w.Write([]byte("#EXTM3U\n#EXTINF:-1," + title + " " + v + "\nhttp://example.com/" + title + v + "\n"))
+		}))
+	}
+	hourly := newServer(0, "Hourly")
+	defer hourly.Close()
+	monthly := newServer(1, "Monthly")
+	defer monthly.Close()
+
+	t.Setenv("M3U_URL_11", hourly.URL)
+	t.Setenv("M3U_URL_12", monthly.URL)
+
+	runProcessor := func(opts ...ProcessorOption) string {
+		content, err := os.ReadFile(runTestProcessor(t, opts...).GetResultPath())
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	content := runProcessor()
+	assert.Contains(t, content, "Hourly 0")
+	assert.Contains(t, content, "Monthly 0")
+
+	// Only the refreshed source is downloaded, the other one is read from
+	// its cached copy.
+	version.Store(1)
+	content = runProcessor(WithRefreshIndexes("11"))
+	assert.Contains(t, content, "Hourly 1")
+	assert.Contains(t, content, "Monthly 0")
+	assert.Equal(t, int32(2), requests[0].Load())
+	assert.Equal(t, int32(1), requests[1].Load())
+	assert.Equal(t, SourceStatusCached, GetSourceStatuses()["12"].Status)
+
+	// Rebuilding from the cache alone does not download anything.
+	content = runProcessor(WithRefreshIndexes())
+	assert.Contains(t, content, "Hourly 1")
+	assert.Contains(t, content, "Monthly 0")
+	assert.Equal(t, int32(2), requests[0].Load())
+	assert.Equal(t, int32(1), requests[1].Load())
+}
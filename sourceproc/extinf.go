@@ -0,0 +1,141 @@
+package sourceproc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// extInfAttribute is a single key=value pair of an #EXTINF line.
+type extInfAttribute struct {
+	key   string
+	value string
+}
+
+// extInf is the tokenized form of an #EXTINF line.
+type extInf struct {
+	duration   string
+	attributes []extInfAttribute
+	title      string
+
+	// hasTitle is set once the comma separating the attributes from the
+	// title was found.
+	hasTitle bool
+	// unterminated is set when the line ended inside a quoted value.
+	unterminated bool
+
+	warnings []string
+}
+
+// incomplete reports whether the line looks like it was wrapped and
+// continues on the next line.
+func (e *extInf) incomplete() bool {
+	return e.unterminated || !e.hasTitle
+}
+
+func isExtInfLine(line string) bool {
+	return len(line) >= 7 && strings.EqualFold(line[:7], "#EXTINF")
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// tokenizeExtInf splits an #EXTINF line into its duration, attributes and
+// title. Attribute values may be double quoted, single quoted or unquoted,
+// and the title is everything after the first comma outside of a value, so
+// it may contain commas and quotes itself. Problems are collected as
+// warnings instead of failing the whole line.
+func tokenizeExtInf(line string) *extInf {
+	result := &extInf{}
+
+	rest := line
+	if isExtInfLine(rest) {
+		rest = strings.TrimPrefix(rest[7:], ":")
+	}
+
+	i := 0
+	n := len(rest)
+
+	skipSpaces := func() {
+		for i < n && isSpace(rest[i]) {
+			i++
+		}
+	}
+
+	// Duration, e.g. "-1" or "10.5"
+	skipSpaces()
+	start := i
+	for i < n && strings.IndexByte("+-0123456789.", rest[i]) >= 0 {
+		i++
+	}
+	result.duration = rest[start:i]
+
+	for {
+		skipSpaces()
+		if i >= n {
+			return result
+		}
+
+		if rest[i] == ',' {
+			result.hasTitle = true
+			result.title = strings.TrimSpace(rest[i+1:])
+			return result
+		}
+
+		start = i
+		for i < n && rest[i] != '=' && rest[i] != ',' && !isSpace(rest[i]) {
+			i++
+		}
+		key := rest[start:i]
+
+		if i >= n || rest[i] != '=' {
+			result.warnings = append(result.warnings, fmt.Sprintf("unexpected token %q", key))
+			continue
+		}
+		i++ // skip '='
+
+		var value string
+		if i < n && (rest[i] == '"' || rest[i] == '\'') {
+			quote := rest[i]
+			i++
+			end := strings.IndexByte(rest[i:], quote)
+			if end < 0 {
+				value = rest[i:]
+				i = n
+				result.unterminated = true
+				result.warnings = append(result.warnings, fmt.Sprintf("unterminated quote in attribute %q", key))
+			} else {
+				value = rest[i : i+end]
+				i += end + 1
+			}
+		} else {
+			start = i
+			for i < n && rest[i] != ',' && !isSpace(rest[i]) {
+				i++
+			}
+			value = rest[start:i]
+		}
+
+		if key == "" {
+			result.warnings = append(result.warnings, fmt.Sprintf("attribute value %q has no name", value))
+			continue
+		}
+
+		result.attributes = append(result.attributes, extInfAttribute{
+			key:   key,
+			value: strings.TrimSpace(value),
+		})
+	}
+}
+
+// ParseExtInf returns the title and the attributes of an #EXTINF line, keyed
+// by lowercase name.
+func ParseExtInf(line string) (title string, attributes map[string]string) {
+	info := tokenizeExtInf(line)
+
+	attributes = make(map[string]string, len(info.attributes))
+	for _, attr := range info.attributes {
+		attributes[strings.ToLower(attr.key)] = attr.value
+	}
+	return info.title, attributes
+}
@@ -0,0 +1,190 @@
+package sourceproc
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenizeExtInf(t *testing.T) {
+	tests := []struct {
+		name         string
+		line         string
+		attributes   []extInfAttribute
+		title        string
+		hasTitle     bool
+		unterminated bool
+		warnings     int
+	}{
+		{
+			name:       "double quoted attributes",
+			line:       `#EXTINF:-1 tvg-id="cnn.us" group-title="News",CNN`,
+			attributes: []extInfAttribute{{"tvg-id", "cnn.us"}, {"group-title", "News"}},
+			title:      "CNN",
+			hasTitle:   true,
+		},
+		{
+			name:       "single quoted and unquoted attributes",
+			line:       `#EXTINF:-1 tvg-id='cnn.us' tvg-chno=5 radio=true,CNN`,
+			attributes: []extInfAttribute{{"tvg-id", "cnn.us"}, {"tvg-chno", "5"}, {"radio", "true"}},
+			title:      "CNN",
+			hasTitle:   true,
+		},
+		{
+			name:       "commas and quotes in values and title",
+			line:       `#EXTINF:-1 tvg-name="News, Weather" group-title="It's \"Live\"",News, Weather & "More"`,
+			attributes: []extInfAttribute{{"tvg-name", "News, Weather"}, {"group-title", `It's \`}},
+			title:      `News, Weather & "More"`,
+			hasTitle:   true,
+			warnings:   1,
+		},
+		{
+			name:     "no attributes",
+			line:     `#EXTINF:0,Plain Title`,
+			title:    "Plain Title",
+			hasTitle: true,
+		},
+		{
+			name:       "attributes without separating spaces",
+			line:       `#EXTINF:-1 tvg-id="a"tvg-name="b",B`,
+			attributes: []extInfAttribute{{"tvg-id", "a"}, {"tvg-name", "b"}},
+			title:      "B",
+			hasTitle:   true,
+		},
+		{
+			name:         "wrapped inside a quoted value",
+			line:         `#EXTINF:-1 tvg-id="cnn.us" tvg-name="CNN`,
+			attributes:   []extInfAttribute{{"tvg-id", "cnn.us"}, {"tvg-name", "CNN"}},
+			unterminated: true,
+			warnings:     1,
+		},
+		{
+			name:       "missing title separator",
+			line:       `#EXTINF:-1 tvg-id="cnn.us" CNN`,
+			attributes: []extInfAttribute{{"tvg-id", "cnn.us"}},
+			warnings:   1,
+		},
+		{
+			name:     "lowercase directive and missing duration",
+			line:     `#extinf:,Title`,
+			title:    "Title",
+			hasTitle: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := tokenizeExtInf(tt.line)
+			assert.Equal(t, tt.attributes, result.attributes)
+			assert.Equal(t, tt.title, result.title)
+			assert.Equal(t, tt.hasTitle, result.hasTitle)
+			assert.Equal(t, tt.unterminated, result.unterminated)
+			assert.Len(t, result.warnings, tt.warnings)
+		})
+	}
+}
+
+func parsePlaylistEntries(content string) ([]*playlistEntry, *playlistParser) {
+	parser := newPlaylistParser("test")
+
+	var entries []*playlistEntry
+	lineNum := 0
+	_ = readLines(strings.NewReader(content), func(line string) {
+		if entry := parser.feed(&LineDetails{Content: line, LineNum: lineNum}); entry != nil {
+			entries = append(entries, entry)
+		}
+		lineNum++
+	})
+	parser.finish()
+
+	return entries, parser
+}
+
+func TestPlaylistParserMalformedInput(t *testing.T) {
+	longURL := "http://example.com/" + strings.Repeat("a", 2*1024*1024)
+
+	content := "\ufeff#EXTM3U\r\n" +
+		"#EXTINF:-1 tvg-id=\"cnn.us\" group-title=\"News\",CNN, International\r\n" +
+		"http://example.com/cnn\r\n" +
+		"#EXTINF:-1 tvg-id=\"bbc\" tvg-name=\"BBC\r\n" +
+		"One\" group-title=\"UK\",BBC One\r\n" +
+		"http://example.com/bbc\r\n" +
+		"#EXTINF:-1 tvg-id=\"espn\"\n" +
+		"group-title=\"Sports\",ESPN\n" +
+		"\n" +
+		"http://example.com/espn\n" +
+		"http://example.com/orphan\n" +
+		"#EXTINF:-1,No URL\n" +
+		"#EXTINF:-1,Long\n" +
+		longURL + "\n" +
+		"#EXTINF:-1,Dangling"
+
+	entries, parser := parsePlaylistEntries(content)
+	require.Len(t, entries, 4)
+
+	assert.Equal(t, "CNN, International", entries[0].extInf.title)
+	assert.Equal(t, "http://example.com/cnn", entries[0].url.Content)
+	assert.Equal(t, 1, entries[0].extInfLine)
+
+	assert.Equal(t, "BBC One", entries[1].extInf.title)
+	assert.Contains(t, entries[1].extInf.attributes, extInfAttribute{"tvg-name", "BBCOne"})
+	assert.Contains(t, entries[1].extInf.attributes, extInfAttribute{"group-title", "UK"})
+
+	assert.Equal(t, "ESPN", entries[2].extInf.title)
+	assert.Contains(t, entries[2].extInf.attributes, extInfAttribute{"group-title", "Sports"})
+	assert.Equal(t, "http://example.com/espn", entries[2].url.Content)
+
+	assert.Equal(t, longURL, entries[3].url.Content)
+
+	// Orphan URL, entry without URL and the dangling last entry.
+	assert.Equal(t, 3, parser.warnings)
+}
+
+func FuzzTokenizeExtInf(f *testing.F) {
+	f.Add(`#EXTINF:-1 tvg-id="cnn.us" group-title="News",CNN`)
+	f.Add(`#EXTINF:-1 tvg-id='a' tvg-chno=5,Title, with "quotes"`)
+	f.Add(`#EXTINF:-1 tvg-name="unterminated`)
+
+	f.Fuzz(func(t *testing.T, line string) {
+		result := tokenizeExtInf(line)
+
+		if result.hasTitle && strings.TrimSpace(result.title) != result.title {
+			t.Errorf("title %q is not trimmed", result.title)
+		}
+		for _, attribute := range result.attributes {
+			if attribute.key == "" {
+				t.Errorf("attribute with empty key in %q", line)
+			}
+			if strings.ContainsAny(attribute.key, "=, \t") {
+				t.Errorf("attribute key %q contains a separator", attribute.key)
+			}
+		}
+		if utf8.ValidString(line) && !utf8.ValidString(result.title) {
+			t.Errorf("title %q is not valid UTF-8", result.title)
+		}
+	})
+}
+
+func FuzzPlaylistParser(f *testing.F) {
+	f.Add("#EXTM3U\n#EXTINF:-1,CNN\nhttp://example.com/cnn\n")
+	f.Add("\ufeff#EXTM3U\r\n#EXTINF:-1 tvg-name=\"A\r\nB\",AB\r\n#EXTVLCOPT:http-user-agent=x\r\nhttp://example.com/ab\r\n")
+
+	f.Fuzz(func(t *testing.T, content string) {
+		entries, _ := parsePlaylistEntries(content)
+
+		for _, entry := range entries {
+			if entry.url == nil || entry.url.Content == "" {
+				t.Fatalf("entry without URL in %q", content)
+			}
+			if strings.HasPrefix(entry.url.Content, "#") {
+				t.Fatalf("directive %q used as URL", entry.url.Content)
+			}
+			if entry.url.LineNum < entry.extInfLine {
+				t.Fatalf("URL on line %d precedes its #EXTINF on line %d", entry.url.LineNum, entry.extInfLine)
+			}
+		}
+	})
+}
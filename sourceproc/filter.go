@@ -3,55 +3,180 @@ package sourceproc
 import (
 	"encoding/base64"
 	"fmt"
-	"m3u-stream-merger/config"
 	"m3u-stream-merger/logger"
 	"m3u-stream-merger/utils"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
 	"sync"
 )
 
-var (
-	filterOnce     sync.Once
-	includeRegexes [][]*regexp.Regexp
-	excludeRegexes [][]*regexp.Regexp
-)
-
-// checkFilter checks if a stream matches the configured filters
-func checkFilter(stream *StreamInfo) bool {
-	filterOnce.Do(initFilters)
+// streamFilter holds the compiled include and exclude filters that apply to
+// the streams of a source.
+type streamFilter struct {
+	includeGroups []*regexp.Regexp
+	includeTitles []*regexp.Regexp
+	includeURLs   []*regexp.Regexp
+	excludeGroups []*regexp.Regexp
+	excludeTitles []*regexp.Regexp
+	excludeURLs   []*regexp.Regexp
+}
 
-	if allFiltersEmpty() {
+// match checks if a stream passes the filter. Include filters take precedence
+// over exclude filters.
+func (f *streamFilter) match(stream *StreamInfo) bool {
+	if f.isEmpty() {
 		return true
 	}
 
-	if matchAny(includeRegexes[0], stream.Group) || matchAny(includeRegexes[1], stream.Title) {
+	if matchAny(f.includeGroups, stream.Group) || matchAny(f.includeTitles, stream.Title) ||
+		matchAny(f.includeURLs, stream.SourceURL) {
 		return true
 	}
 
-	if matchAny(excludeRegexes[0], stream.Group) || matchAny(excludeRegexes[1], stream.Title) {
+	if matchAny(f.excludeGroups, stream.Group) || matchAny(f.excludeTitles, stream.Title) ||
+		matchAny(f.excludeURLs, stream.SourceURL) {
 		return false
 	}
 
-	return len(includeRegexes[0]) == 0 && len(includeRegexes[1]) == 0
+	return !f.hasIncludes()
+}
+
+func (f *streamFilter) hasIncludes() bool {
+	return len(f.includeGroups) > 0 || len(f.includeTitles) > 0 || len(f.includeURLs) > 0
+}
+
+func (f *streamFilter) isEmpty() bool {
+	return !f.hasIncludes() &&
+		len(f.excludeGroups) == 0 && len(f.excludeTitles) == 0 && len(f.excludeURLs) == 0
+}
+
+// withSource returns the filter extended by the filters that only apply to
+// the given source (e.g. M3U_EXCLUDE_GROUPS_2).
+func (f *streamFilter) withSource(s profileSettings, m3uIndex string) *streamFilter {
+	sourceRegexes := func(name string) []*regexp.Regexp {
+		value := s.getenv(fmt.Sprintf("M3U_%s_%s", name, m3uIndex))
+		if value == "" {
+			return nil
+		}
+		return compileRegexes([]string{value})
+	}
+
+	return &streamFilter{
+		includeGroups: slices.Concat(f.includeGroups, sourceRegexes("INCLUDE_GROUPS")),
+		includeTitles: slices.Concat(f.includeTitles, sourceRegexes("INCLUDE_TITLE")),
+		includeURLs:   slices.Concat(f.includeURLs, sourceRegexes("INCLUDE_URL")),
+		excludeGroups: slices.Concat(f.excludeGroups, sourceRegexes("EXCLUDE_GROUPS")),
+		excludeTitles: slices.Concat(f.excludeTitles, sourceRegexes("EXCLUDE_TITLE")),
+		excludeURLs:   slices.Concat(f.excludeURLs, sourceRegexes("EXCLUDE_URL")),
+	}
 }
 
-func initFilters() {
-	excludeGroups := utils.GetFilters("EXCLUDE_GROUPS")
-	excludeTitle := utils.GetFilters("EXCLUDE_TITLE")
-	includeGroups := utils.GetFilters("INCLUDE_GROUPS")
-	includeTitle := utils.GetFilters("INCLUDE_TITLE")
+// streamFilters holds the filters of every source and the FILTER_EXPRESSION.
+// They are compiled once per sync.
+type streamFilters struct {
+	global     *streamFilter
+	sources    map[string]*streamFilter
+	expression filterExpr
+}
 
-	excludeRegexes = [][]*regexp.Regexp{
-		compileRegexes(excludeGroups),
-		compileRegexes(excludeTitle),
+// compileFilterExpression compiles the FILTER_EXPRESSION, if any.
+func compileFilterExpression(s profileSettings) (filterExpr, error) {
+	expression := strings.TrimSpace(s.getenv("FILTER_EXPRESSION"))
+	if expression == "" {
+		return nil, nil
 	}
-	includeRegexes = [][]*regexp.Regexp{
-		compileRegexes(includeGroups),
-		compileRegexes(includeTitle),
+
+	expr, err := parseFilterExpression(expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid FILTER_EXPRESSION: %w", err)
 	}
+	return expr, nil
+}
+
+// ValidateFilters reports configuration errors of the filters.
+func ValidateFilters() error {
+	_, err := compileFilterExpression(defaultSettings)
+	return err
+}
+
+// ValidateSettings reports configuration errors of the settings that are
+// compiled on every sync. Settings are validated on startup and before a
+// reload is applied, so a sync only finds invalid settings when a file they
+// point to, like the CHANNEL_MAP_FILE, changed since. Syncs log those and
+// carry on without the setting rather than fail.
+func ValidateSettings() error {
+	if _, err := truncationThreshold(); err != nil {
+		return err
+	}
+
+	mergeKey, err := newMergeKeyBuilder()
+	if err != nil {
+		return err
+	}
+	if _, err := loadChannelMap(mergeKey); err != nil {
+		return err
+	}
+	if _, err := newMergePolicies(); err != nil {
+		return err
+	}
+	if err := validateProfileSettings(defaultSettings); err != nil {
+		return err
+	}
+
+	profiles, err := parseProfiles()
+	if err != nil {
+		return err
+	}
+	for _, profile := range profiles {
+		if err := validateProfileSettings(newProfileSettings(profile)); err != nil {
+			return fmt.Errorf("profile %s: %w", profile, err)
+		}
+	}
+	return nil
+}
+
+func compileStreamFilters(s profileSettings) *streamFilters {
+	global := &streamFilter{
+		includeGroups: compileRegexes(s.filters("INCLUDE_GROUPS")),
+		includeTitles: compileRegexes(s.filters("INCLUDE_TITLE")),
+		includeURLs:   compileRegexes(s.filters("INCLUDE_URL")),
+		excludeGroups: compileRegexes(s.filters("EXCLUDE_GROUPS")),
+		excludeTitles: compileRegexes(s.filters("EXCLUDE_TITLE")),
+		excludeURLs:   compileRegexes(s.filters("EXCLUDE_URL")),
+	}
+
+	filters := &streamFilters{
+		global:  global,
+		sources: make(map[string]*streamFilter),
+	}
+	for _, m3uIndex := range utils.GetM3UIndexes() {
+		filters.sources[m3uIndex] = global.withSource(s, m3uIndex)
+	}
+
+	expr, err := compileFilterExpression(s)
+	if err != nil {
+		logger.Default.Errorf("Ignoring filter expression: %v", err)
+	}
+	filters.expression = expr
+
+	return filters
+}
+
+// check checks if a stream matches the filters of its source and the filter
+// expression.
+func (f *streamFilters) check(stream *StreamInfo) bool {
+	filter, ok := f.sources[stream.SourceM3U]
+	if !ok {
+		filter = f.global
+	}
+	if !filter.match(stream) {
+		return false
+	}
+
+	return f.expression == nil || f.expression.eval(stream)
 }
 
 func ParseStreamInfoBySlug(slug string) (*StreamInfo, error) {
@@ -61,14 +186,22 @@ func ParseStreamInfoBySlug(slug string) (*StreamInfo, error) {
 	}
 
 	initInfo.URLs = make(map[string]map[string]string)
+	initInfo.URLOptions = make(map[string]map[string]*StreamOptions)
+	initInfo.URLQualities = make(map[string]map[string]string)
 	var wg sync.WaitGroup
+	var mu sync.Mutex
 	errCh := make(chan error, len(utils.GetM3UIndexes()))
 
+	// Keep the generation from being pruned while its URLs are read.
+	streamIndexLock.RLock()
+	defer streamIndexLock.RUnlock()
+	indexDir := currentStreamIndexDir()
+
 	for _, m3uIndex := range utils.GetM3UIndexes() {
 		wg.Add(1)
 		go func(idx string) {
 			defer wg.Done()
-			if err := loadStreamURLs(initInfo, idx); err != nil {
+			if err := loadStreamURLs(initInfo, idx, indexDir, &mu); err != nil {
 				errCh <- err
 			}
 		}(m3uIndex)
@@ -93,18 +226,20 @@ func ParseStreamInfoBySlug(slug string) (*StreamInfo, error) {
 	return initInfo, nil
 }
 
-func loadStreamURLs(stream *StreamInfo, m3uIndex string) error {
-	safeTitle := base64.StdEncoding.EncodeToString([]byte(stream.Title))
+func loadStreamURLs(stream *StreamInfo, m3uIndex string, indexDir string, mu *sync.Mutex) error {
+	safeTitle := base64.StdEncoding.EncodeToString([]byte(stream.indexKey()))
 	fileName := fmt.Sprintf("%s_%s*", safeTitle, m3uIndex)
 	// Search across all shard directories
-	globPattern := filepath.Join(config.GetStreamsDirPath(), "*", fileName)
+	globPattern := filepath.Join(indexDir, "*", fileName)
 
 	fileMatches, err := filepath.Glob(globPattern)
 	if err != nil {
 		return fmt.Errorf("error finding files for pattern %s: %v", globPattern, err)
 	}
 
-	stream.URLs[m3uIndex] = make(map[string]string)
+	urls := make(map[string]string)
+	urlOptions := make(map[string]*StreamOptions)
+	urlQualities := make(map[string]string)
 
 	for _, fileMatch := range fileMatches {
 		// Extract filename from path (works with sharded structure)
@@ -122,11 +257,19 @@ func loadStreamURLs(stream *StreamInfo, m3uIndex string) error {
 
 		encodedUrl := fileContent
 		urlIndex := "0"
-		splitContent := strings.SplitN(string(fileContent), ":::", 2)
-		if len(splitContent) == 2 {
+		splitContent := strings.SplitN(string(fileContent), ":::", 4)
+		if len(splitContent) >= 2 {
 			encodedUrl = []byte(splitContent[1])
 			urlIndex = splitContent[0]
 		}
+		if len(splitContent) >= 3 {
+			if options := decodeStreamOptions(splitContent[2]); options != nil {
+				urlOptions[parts[1]] = options
+			}
+		}
+		if len(splitContent) == 4 {
+			urlQualities[parts[1]] = strings.TrimSpace(splitContent[3])
+		}
 
 		url, err := base64.StdEncoding.DecodeString(string(encodedUrl))
 		if err != nil {
@@ -134,9 +277,19 @@ func loadStreamURLs(stream *StreamInfo, m3uIndex string) error {
 			continue
 		}
 
-		stream.URLs[m3uIndex][parts[1]] = strings.TrimSpace(fmt.Sprintf("%s:::%s", urlIndex, string(url)))
+		urls[parts[1]] = strings.TrimSpace(fmt.Sprintf("%s:::%s", urlIndex, string(url)))
 	}
 
+	mu.Lock()
+	stream.URLs[m3uIndex] = urls
+	if len(urlOptions) > 0 {
+		stream.URLOptions[m3uIndex] = urlOptions
+	}
+	if len(urlQualities) > 0 {
+		stream.URLQualities[m3uIndex] = urlQualities
+	}
+	mu.Unlock()
+
 	return nil
 }
 
@@ -161,17 +314,3 @@ func matchAny(regexes []*regexp.Regexp, s string) bool {
 	}
 	return false
 }
-
-func allFiltersEmpty() bool {
-	for _, res := range includeRegexes {
-		if len(res) > 0 {
-			return false
-		}
-	}
-	for _, res := range excludeRegexes {
-		if len(res) > 0 {
-			return false
-		}
-	}
-	return true
-}
@@ -0,0 +1,431 @@
+package sourceproc
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// FilterSyntaxError reports an invalid filter expression together with the
+// position (1-based, in characters) where the problem was found.
+type FilterSyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *FilterSyntaxError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Msg, e.Pos)
+}
+
+type filterTokenKind int
+
+const (
+	tokenEOF filterTokenKind = iota
+	tokenIdent
+	tokenString
+	tokenOperator
+	tokenLParen
+	tokenRParen
+	tokenComma
+)
+
+type filterToken struct {
+	kind  filterTokenKind
+	value string
+	pos   int
+}
+
+func (t filterToken) String() string {
+	if t.kind == tokenEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.value)
+}
+
+var filterOperators = []string{"==", "!=", "=~", "!~", "<=", ">=", "&&", "||", "<", ">", "!"}
+
+func isFilterIdentRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.'
+}
+
+// lexFilterExpression splits an expression into tokens.
+func lexFilterExpression(input string) ([]filterToken, error) {
+	var tokens []filterToken
+	runes := []rune(input)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		pos := i + 1
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, filterToken{tokenLParen, "(", pos})
+			i++
+		case r == ')':
+			tokens = append(tokens, filterToken{tokenRParen, ")", pos})
+			i++
+		case r == ',':
+			tokens = append(tokens, filterToken{tokenComma, ",", pos})
+			i++
+		case r == '"' || r == '\'':
+			var value strings.Builder
+			i++
+			for {
+				if i >= len(runes) {
+					return nil, &FilterSyntaxError{Pos: pos, Msg: "unterminated string"}
+				}
+				if runes[i] == r {
+					i++
+					break
+				}
+				if runes[i] == '\\' && i+1 < len(runes) && (runes[i+1] == r || runes[i+1] == '\\') {
+					i++
+				}
+				value.WriteRune(runes[i])
+				i++
+			}
+			tokens = append(tokens, filterToken{tokenString, value.String(), pos})
+		case isFilterIdentRune(r):
+			start := i
+			for i < len(runes) && isFilterIdentRune(runes[i]) {
+				i++
+			}
+			tokens = append(tokens, filterToken{tokenIdent, string(runes[start:i]), pos})
+		default:
+			operator := ""
+			for _, op := range filterOperators {
+				if strings.HasPrefix(string(runes[i:min(i+2, len(runes))]), op) {
+					operator = op
+					break
+				}
+			}
+			if operator == "" {
+				return nil, &FilterSyntaxError{Pos: pos, Msg: fmt.Sprintf("unexpected character %q", r)}
+			}
+			tokens = append(tokens, filterToken{tokenOperator, operator, pos})
+			i += len(operator)
+		}
+	}
+
+	return append(tokens, filterToken{tokenEOF, "", len(runes) + 1}), nil
+}
+
+// filterExpr is a compiled filter expression.
+type filterExpr interface {
+	eval(stream *StreamInfo) bool
+}
+
+type andExpr struct{ left, right filterExpr }
+
+func (e *andExpr) eval(stream *StreamInfo) bool { return e.left.eval(stream) && e.right.eval(stream) }
+
+type orExpr struct{ left, right filterExpr }
+
+func (e *orExpr) eval(stream *StreamInfo) bool { return e.left.eval(stream) || e.right.eval(stream) }
+
+type notExpr struct{ expr filterExpr }
+
+func (e *notExpr) eval(stream *StreamInfo) bool { return !e.expr.eval(stream) }
+
+// filterField reads the value a comparison is made against.
+type filterField func(stream *StreamInfo) string
+
+var filterFields = map[string]filterField{
+	"title":       func(s *StreamInfo) string { return s.Title },
+	"tvg-name":    func(s *StreamInfo) string { return s.Title },
+	"id":          func(s *StreamInfo) string { return s.TvgID },
+	"tvg-id":      func(s *StreamInfo) string { return s.TvgID },
+	"chno":        func(s *StreamInfo) string { return s.TvgChNo },
+	"tvg-chno":    func(s *StreamInfo) string { return s.TvgChNo },
+	"type":        func(s *StreamInfo) string { return s.TvgType },
+	"tvg-type":    func(s *StreamInfo) string { return s.TvgType },
+	"logo":        func(s *StreamInfo) string { return s.LogoURL },
+	"tvg-logo":    func(s *StreamInfo) string { return s.LogoURL },
+	"group":       func(s *StreamInfo) string { return s.Group },
+	"group-title": func(s *StreamInfo) string { return s.Group },
+	"tvg-group":   func(s *StreamInfo) string { return s.Group },
+	"source":      func(s *StreamInfo) string { return s.SourceM3U },
+	"url":         func(s *StreamInfo) string { return s.SourceURL },
+	"line":        func(s *StreamInfo) string { return strconv.Itoa(s.SourceIndex) },
+	"options":     func(s *StreamInfo) string { return strings.Join(s.SourceOptions.directiveLines(), "\n") },
+}
+
+// lookupFilterField resolves a field name. Names of the form attr.<name>
+// refer to the extra #EXTINF attribute of that name. It reports false for
+// unknown names.
+func lookupFilterField(name string) (filterField, bool) {
+	name = strings.ToLower(name)
+	if field, ok := filterFields[strings.ReplaceAll(name, "_", "-")]; ok {
+		return field, true
+	}
+
+	attribute, ok := strings.CutPrefix(name, "attr.")
+	if !ok || attribute == "" {
+		return nil, false
+	}
+	return func(s *StreamInfo) string {
+		return s.Attributes[attribute]
+	}, true
+}
+
+type compareExpr struct {
+	field    filterField
+	operator string
+	value    string
+	number   float64
+	isNumber bool
+	regex    *regexp.Regexp
+}
+
+func (e *compareExpr) eval(stream *StreamInfo) bool {
+	actual := e.field(stream)
+
+	switch e.operator {
+	case "==":
+		return actual == e.value
+	case "!=":
+		return actual != e.value
+	case "=~":
+		return e.regex.MatchString(actual)
+	case "!~":
+		return !e.regex.MatchString(actual)
+	}
+
+	var cmp int
+	if number, err := strconv.ParseFloat(actual, 64); err == nil && e.isNumber {
+		switch {
+		case number < e.number:
+			cmp = -1
+		case number > e.number:
+			cmp = 1
+		}
+	} else if e.isNumber {
+		// Values that are not numbers never match numeric comparisons.
+		return false
+	} else {
+		cmp = strings.Compare(actual, e.value)
+	}
+
+	switch e.operator {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+type inExpr struct {
+	field  filterField
+	values []string
+}
+
+func (e *inExpr) eval(stream *StreamInfo) bool {
+	actual := e.field(stream)
+	for _, value := range e.values {
+		if actual == value {
+			return true
+		}
+	}
+	return false
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+// parseFilterExpression compiles an expression such as
+//
+//	group =~ "^US" and not title =~ "(?i)test" and source in (1,3)
+//
+// Expressions combine comparisons with and, or, not and parentheses.
+func parseFilterExpression(input string) (filterExpr, error) {
+	tokens, err := lexFilterExpression(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if token := p.peek(); token.kind != tokenEOF {
+		return nil, p.errorf(token, "unexpected %s", token)
+	}
+
+	return expr, nil
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	token := p.tokens[p.pos]
+	if token.kind != tokenEOF {
+		p.pos++
+	}
+	return token
+}
+
+func (p *filterParser) errorf(token filterToken, format string, args ...any) error {
+	return &FilterSyntaxError{Pos: token.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// isKeyword reports whether the token is the given keyword or its symbolic
+// form.
+func isKeyword(token filterToken, keyword, symbol string) bool {
+	switch token.kind {
+	case tokenIdent:
+		return strings.EqualFold(token.value, keyword)
+	case tokenOperator:
+		return symbol != "" && token.value == symbol
+	}
+	return false
+}
+
+func (p *filterParser) parseOr() (filterExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for isKeyword(p.peek(), "or", "||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orExpr{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for isKeyword(p.peek(), "and", "&&") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andExpr{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterExpr, error) {
+	token := p.peek()
+
+	if isKeyword(token, "not", "!") {
+		p.next()
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notExpr{expr}, nil
+	}
+
+	if token.kind == tokenLParen {
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenRParen {
+			return nil, p.errorf(closing, "expected \")\" but found %s", closing)
+		}
+		return expr, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (filterExpr, error) {
+	fieldToken := p.next()
+	if fieldToken.kind != tokenIdent || isKeyword(fieldToken, "and", "") ||
+		isKeyword(fieldToken, "or", "") || isKeyword(fieldToken, "in", "") {
+		return nil, p.errorf(fieldToken, "expected a field name but found %s", fieldToken)
+	}
+	field, ok := lookupFilterField(fieldToken.value)
+	if !ok {
+		return nil, p.errorf(fieldToken, "unknown field %s (use attr.<name> for #EXTINF attributes)", fieldToken)
+	}
+
+	operator := p.next()
+	if isKeyword(operator, "in", "") {
+		return p.parseIn(field)
+	}
+	if operator.kind != tokenOperator || operator.value == "!" ||
+		operator.value == "&&" || operator.value == "||" {
+		return nil, p.errorf(operator, "expected a comparison operator after %s but found %s", fieldToken, operator)
+	}
+
+	valueToken, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+
+	expr := &compareExpr{field: field, operator: operator.value, value: valueToken.value}
+	switch operator.value {
+	case "=~", "!~":
+		expr.regex, err = regexp.Compile(valueToken.value)
+		if err != nil {
+			return nil, p.errorf(valueToken, "invalid regular expression: %v", err)
+		}
+	case "<", "<=", ">", ">=":
+		if number, err := strconv.ParseFloat(valueToken.value, 64); err == nil {
+			expr.number = number
+			expr.isNumber = true
+		}
+	}
+
+	return expr, nil
+}
+
+func (p *filterParser) parseIn(field filterField) (filterExpr, error) {
+	if open := p.next(); open.kind != tokenLParen {
+		return nil, p.errorf(open, "expected \"(\" after in but found %s", open)
+	}
+
+	expr := &inExpr{field: field}
+	for {
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		expr.values = append(expr.values, value.value)
+
+		token := p.next()
+		if token.kind == tokenRParen {
+			return expr, nil
+		}
+		if token.kind != tokenComma {
+			return nil, p.errorf(token, "expected \",\" or \")\" but found %s", token)
+		}
+	}
+}
+
+func (p *filterParser) parseValue() (filterToken, error) {
+	token := p.next()
+	if token.kind != tokenString && token.kind != tokenIdent {
+		return token, p.errorf(token, "expected a value but found %s", token)
+	}
+	return token, nil
+}
@@ -0,0 +1,103 @@
+package sourceproc
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterExpression(t *testing.T) {
+	cnn := &StreamInfo{
+		Title:      "CNN HD",
+		TvgID:      "cnn.us",
+		TvgChNo:    "12",
+		TvgType:    "live",
+		Group:      "US News",
+		SourceM3U:  "1",
+		SourceURL:  "http://example.com/cnn.m3u8",
+		Attributes: map[string]string{"tvg-country": "US", "catchup_days": "7"},
+	}
+	movie := &StreamInfo{
+		Title:     "Test Movie",
+		TvgType:   "movie",
+		Group:     "US Movies",
+		SourceM3U: "2",
+		SourceURL: "http://example.com/movie.mp4",
+	}
+
+	tests := []struct {
+		expression string
+		cnn        bool
+		movie      bool
+	}{
+		{`group =~ "^US" and not title =~ "(?i)test" and source in (1,3) and type != "movie"`, true, false},
+		{`group =~ '^US'`, true, true},
+		{`source == 2 or title == "CNN HD"`, true, true},
+		{`!(source == 2) && tvg-chno >= 10`, true, false},
+		{`chno < 9`, false, false},
+		{`tvg_id == cnn.us`, true, false},
+		{`attr.tvg-country == US and attr.catchup_days > 3`, true, false},
+		{`attr.tvg-country != ""`, true, false},
+		{`attr.TVG-COUNTRY == US`, true, false},
+		{`url !~ "\.mp4$"`, true, false},
+		{`type in ("movie", "series") or (group == "US News" and logo == "")`, true, true},
+		{`title == "CNN HD" or title == 'Test Movie' and source == 1`, true, false},
+		{`title > "M"`, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			expr, err := parseFilterExpression(tt.expression)
+			require.NoError(t, err)
+			assert.Equal(t, tt.cnn, expr.eval(cnn), "cnn")
+			assert.Equal(t, tt.movie, expr.eval(movie), "movie")
+		})
+	}
+}
+
+func TestFilterExpressionSyntaxErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		pos        int
+		message    string
+	}{
+		{`group =~ "^US`, 10, "unterminated string"},
+		{`group =~ "(US"`, 10, "invalid regular expression"},
+		{`group "US"`, 7, "expected a comparison operator"},
+		{`group == "US" and`, 18, "expected a field name"},
+		{`(group == "US"`, 15, `expected ")"`},
+		{`source in (1, 3`, 16, `expected "," or ")"`},
+		{`source in 1`, 11, `expected "(" after in`},
+		{`group == "US" title == "CNN"`, 15, "unexpected"},
+		{`group == "US" # comment`, 15, "unexpected character"},
+		{`group ==`, 9, "expected a value"},
+		{`title == "CNN" or gruop == "News"`, 19, `unknown field "gruop"`},
+		{`tvg-country == "US"`, 1, `unknown field "tvg-country"`},
+		{`attr. == "US"`, 1, "unknown field"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			_, err := parseFilterExpression(tt.expression)
+			require.Error(t, err)
+
+			var syntaxErr *FilterSyntaxError
+			require.True(t, errors.As(err, &syntaxErr))
+			assert.Equal(t, tt.pos, syntaxErr.Pos)
+			assert.Contains(t, syntaxErr.Msg, tt.message)
+		})
+	}
+}
+
+func TestValidateFilters(t *testing.T) {
+	t.Setenv("FILTER_EXPRESSION", `group =~ "^US" and`)
+	err := ValidateFilters()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "FILTER_EXPRESSION")
+	assert.Contains(t, err.Error(), "position 19")
+
+	t.Setenv("FILTER_EXPRESSION", `group =~ "^US"`)
+	assert.NoError(t, ValidateFilters())
+}
@@ -0,0 +1,143 @@
+package sourceproc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"m3u-stream-merger/utils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamFilters(t *testing.T) {
+	utils.ResetCaches()
+	defer utils.ResetCaches()
+
+	t.Setenv("M3U_URL_1", "http://example.com/1.m3u")
+	t.Setenv("M3U_URL_2", "http://example.com/2.m3u")
+	t.Setenv("M3U_URL_3", "http://example.com/3.m3u")
+	t.Setenv("EXCLUDE_TITLE_1", "^Test")
+	t.Setenv("EXCLUDE_URL_1", `\.mp4$`)
+	t.Setenv("M3U_EXCLUDE_GROUPS_2", "Adult")
+	t.Setenv("M3U_INCLUDE_GROUPS_3", "News")
+	t.Setenv("M3U_INCLUDE_URL_3", "^http://cdn\\.example\\.com/")
+	t.Setenv("FILTER_EXPRESSION", `type != "movie"`)
+
+	filters := compileStreamFilters(defaultSettings)
+
+	tests := []struct {
+		name   string
+		stream *StreamInfo
+		want   bool
+	}{
+		{
+			name:   "global title filter applies to every source",
+			stream: &StreamInfo{Title: "Test Channel", Group: "News", SourceM3U: "1"},
+			want:   false,
+		},
+		{
+			name:   "global URL filter",
+			stream: &StreamInfo{Title: "Movie", SourceM3U: "2", SourceURL: "http://example.com/movie.mp4"},
+			want:   false,
+		},
+		{
+			name:   "source group filter only applies to its source",
+			stream: &StreamInfo{Title: "Late Night", Group: "Adult", SourceM3U: "1"},
+			want:   true,
+		},
+		{
+			name:   "source group filter",
+			stream: &StreamInfo{Title: "Late Night", Group: "Adult", SourceM3U: "2"},
+			want:   false,
+		},
+		{
+			name:   "source include group",
+			stream: &StreamInfo{Title: "CNN", Group: "News", SourceM3U: "3", SourceURL: "http://example.com/cnn"},
+			want:   true,
+		},
+		{
+			name:   "source include URL",
+			stream: &StreamInfo{Title: "ESPN", Group: "Sports", SourceM3U: "3", SourceURL: "http://cdn.example.com/espn"},
+			want:   true,
+		},
+		{
+			name:   "not included by its source",
+			stream: &StreamInfo{Title: "ESPN", Group: "Sports", SourceM3U: "3", SourceURL: "http://example.com/espn"},
+			want:   false,
+		},
+		{
+			name:   "filter expression applies after the filter lists",
+			stream: &StreamInfo{Title: "CNN", Group: "News", TvgType: "movie", SourceM3U: "3", SourceURL: "http://example.com/cnn"},
+			want:   false,
+		},
+		{
+			name:   "source includes do not restrict other sources",
+			stream: &StreamInfo{Title: "ESPN", Group: "Sports", SourceM3U: "2", SourceURL: "http://example.com/espn"},
+			want:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, filters.check(tt.stream))
+		})
+	}
+}
+
+func TestFiltersReloadFromConfigFile(t *testing.T) {
+	tempDir := setupTestConfig(t)
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		_, _ = w.Write([]byte("#EXTM3U\n" +
+			"#EXTINF:-1 group-title=\"News\",CNN\nhttp://example.com/cnn\n" +
+			"#EXTINF:-1 group-title=\"Adult\",Late Night\nhttp://example.com/late\n"))
+	}))
+	defer server.Close()
+
+	t.Setenv("M3U_URL_1", server.URL)
+	t.Setenv("EXCLUDE_GROUPS_1", "News")
+
+	runProcessor := func(opts ...ProcessorOption) string {
+		content, err := os.ReadFile(runTestProcessor(t, opts...).GetResultPath())
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	content := runProcessor()
+	assert.NotContains(t, content, "CNN")
+	assert.Contains(t, content, "Late Night")
+
+	// The config file overrides the environment and the playlist is
+	// regenerated from the cached source.
+	configPath := filepath.Join(tempDir, "config.env")
+	require.NoError(t, os.WriteFile(configPath, []byte("# filters\nEXCLUDE_GROUPS_1=\"Adult\"\n"), 0644))
+	values, err := utils.ReadConfigFile(configPath)
+	require.NoError(t, err)
+	undo := utils.ApplyConfigFile(values)
+
+	content = runProcessor(WithRefreshIndexes())
+	assert.Contains(t, content, "CNN")
+	assert.NotContains(t, content, "Late Night")
+	assert.Equal(t, int32(1), requests.Load())
+
+	// Undoing restores the previous settings, and settings removed from the
+	// config file fall back to the environment.
+	undo()
+	assert.Equal(t, "News", os.Getenv("EXCLUDE_GROUPS_1"))
+	utils.ApplyConfigFile(map[string]string{"EXCLUDE_TITLE_1": "CNN"})
+	utils.ApplyConfigFile(map[string]string{})
+	assert.Equal(t, "News", os.Getenv("EXCLUDE_GROUPS_1"))
+	_, ok := os.LookupEnv("EXCLUDE_TITLE_1")
+	assert.False(t, ok)
+
+	require.NoError(t, os.WriteFile(configPath, []byte("EXCLUDE GROUPS=Adult\n"), 0644))
+	_, err = utils.ReadConfigFile(configPath)
+	assert.ErrorContains(t, err, "line 1")
+}
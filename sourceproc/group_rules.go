@@ -0,0 +1,113 @@
+package sourceproc
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"m3u-stream-merger/logger"
+)
+
+// otherGroups stands for the groups that are not listed in GROUP_ORDER.
+const otherGroups = "*"
+
+type groupRule struct {
+	pattern  *regexp.Regexp
+	template string
+}
+
+// groupRules rename the groups of the sources with the GROUP_RENAME_X rules,
+// such as "(?i)^(?:USA?\s*\|\s*)?news(?:\s*\(US\))?$ => US News". The first
+// rule, in order of X, that matches a group replaces it with its template,
+// where $1 or ${name} stand for the groups captured by the pattern. Groups
+// that are renamed alike are merged.
+type groupRules struct {
+	rules []groupRule
+}
+
+func newGroupRules(s profileSettings) (*groupRules, error) {
+	groups := &groupRules{}
+	for _, value := range s.filters("GROUP_RENAME") {
+		pattern, template, err := parseRewriteRule(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GROUP_RENAME: %v", err)
+		}
+		groups.rules = append(groups.rules, groupRule{pattern: pattern, template: template})
+	}
+	return groups, nil
+}
+
+// compileGroupRules compiles the GROUP_RENAME_X rules of a playlist for a
+// sync. If one of them can't be compiled, no group is renamed, so that groups
+// are not merged by only some of the rules.
+func compileGroupRules(s profileSettings) *groupRules {
+	groups, err := newGroupRules(s)
+	if err != nil {
+		logger.Default.Errorf("Keeping the groups of the sources: %v", err)
+		return &groupRules{}
+	}
+	return groups
+}
+
+// rename applies the first matching rule to the group of a stream.
+func (g *groupRules) rename(stream *StreamInfo) {
+	for _, rule := range g.rules {
+		match := rule.pattern.FindStringSubmatchIndex(stream.Group)
+		if match == nil {
+			continue
+		}
+		renamed := rule.pattern.ExpandString(nil, rule.template, stream.Group, match)
+		stream.Group = strings.TrimSpace(string(renamed))
+		return
+	}
+}
+
+// groupOrder ranks the groups listed in GROUP_ORDER, such as
+// "News|Sports|*|Adult". Groups that are not listed are ranked at "*", or
+// after the listed groups if there is none.
+type groupOrder struct {
+	ranks map[string]int
+	other int
+}
+
+func newGroupOrder(s profileSettings) (*groupOrder, error) {
+	value := strings.TrimSpace(s.getenv("GROUP_ORDER"))
+	if value == "" {
+		return nil, nil
+	}
+
+	order := &groupOrder{ranks: make(map[string]int), other: -1}
+	for i, item := range strings.Split(value, "|") {
+		group := strings.ToLower(strings.TrimSpace(item))
+		if group == "" {
+			return nil, fmt.Errorf("invalid GROUP_ORDER: empty group")
+		}
+
+		if group == otherGroups {
+			if order.other >= 0 {
+				return nil, fmt.Errorf("invalid GROUP_ORDER: duplicate %q", otherGroups)
+			}
+			order.other = i
+			continue
+		}
+
+		if _, ok := order.ranks[group]; ok {
+			return nil, fmt.Errorf("invalid GROUP_ORDER: duplicate group %q", strings.TrimSpace(item))
+		}
+		order.ranks[group] = i
+	}
+	if order.other < 0 {
+		order.other = len(order.ranks)
+	}
+
+	return order, nil
+}
+
+// rank returns the position of a group in GROUP_ORDER. Groups are matched
+// regardless of case.
+func (o *groupOrder) rank(group string) int {
+	if rank, ok := o.ranks[strings.ToLower(strings.TrimSpace(group))]; ok {
+		return rank
+	}
+	return o.other
+}
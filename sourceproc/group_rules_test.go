@@ -0,0 +1,136 @@
+package sourceproc
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"m3u-stream-merger/utils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupRules(t *testing.T) {
+	utils.ResetCaches()
+	defer utils.ResetCaches()
+	t.Setenv("GROUP_RENAME_2", `(?i)^.*\bnews\b.*$ => News`)
+	t.Setenv("GROUP_RENAME_1", `(?i)^(?:USA?\s*\|\s*)?news(?:\s*\(US\))?$ => US News`)
+	t.Setenv("GROUP_RENAME_10", `^(?P<country>[A-Z]{2}):\s*(.+)$ => ${country} $2`)
+
+	groups, err := newGroupRules(defaultSettings)
+	require.NoError(t, err)
+
+	tests := map[string]string{
+		"USA | NEWS":     "US News",
+		"US News":        "News",
+		"NEWS (US)":      "US News",
+		"World News":     "News",
+		"UK: Sports":     "UK Sports",
+		"Entertainment":  "Entertainment",
+		"":               "",
+		"UK: Local News": "News",
+	}
+	for group, want := range tests {
+		stream := &StreamInfo{Group: group}
+		groups.rename(stream)
+		assert.Equal(t, want, stream.Group, group)
+	}
+}
+
+func TestGroupOrder(t *testing.T) {
+	streams := []*StreamInfo{
+		{Title: "ABC", Group: "Entertainment"},
+		{Title: "Adult", Group: "Adult"},
+		{Title: "CNN", Group: "news"},
+		{Title: "ESPN", Group: "Sports"},
+		{Title: "BBC", Group: "Kids"},
+		{Title: "BBC News", Group: "News"},
+	}
+
+	tests := []struct {
+		name  string
+		order string
+		key   string
+		want  []string
+	}{
+		{
+			name:  "others after the listed groups",
+			order: "News|Sports",
+			want:  []string{"BBC News", "CNN", "ESPN", "ABC", "Adult", "BBC"},
+		},
+		{
+			name:  "others in place of the wildcard",
+			order: "News | * | Adult",
+			key:   "group:desc,title",
+			want:  []string{"BBC News", "CNN", "ESPN", "BBC", "ABC", "Adult"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GROUP_ORDER", tt.order)
+			t.Setenv("SORTING_KEY", tt.key)
+
+			sorter, err := newStreamSorter(defaultSettings)
+			require.NoError(t, err)
+
+			sorted := append([]*StreamInfo(nil), streams...)
+			sort.Slice(sorted, func(i, j int) bool {
+				return sorter.compare(sorted[i], sorted[j]) < 0
+			})
+
+			var titles []string
+			for _, stream := range sorted {
+				titles = append(titles, stream.Title)
+			}
+			assert.Equal(t, tt.want, titles)
+		})
+	}
+}
+
+func TestGroupRulesValidation(t *testing.T) {
+	utils.ResetCaches()
+	defer utils.ResetCaches()
+
+	t.Setenv("GROUP_RENAME_1", "^News$")
+	assert.ErrorContains(t, ValidateSettings(), `invalid GROUP_RENAME: missing "=>" in "^News$"`)
+
+	utils.ResetCaches()
+	t.Setenv("GROUP_RENAME_1", "^(News$ => News")
+	assert.ErrorContains(t, ValidateSettings(), "invalid GROUP_RENAME")
+
+	utils.ResetCaches()
+	t.Setenv("GROUP_RENAME_1", "^US News$ => News")
+	t.Setenv("GROUP_ORDER", "News|Sports|news")
+	assert.ErrorContains(t, ValidateSettings(), `invalid GROUP_ORDER: duplicate group "news"`)
+
+	t.Setenv("GROUP_ORDER", "News|*|Sports|*")
+	assert.ErrorContains(t, ValidateSettings(), `invalid GROUP_ORDER: duplicate "*"`)
+
+	t.Setenv("GROUP_ORDER", "News||Sports")
+	assert.ErrorContains(t, ValidateSettings(), "invalid GROUP_ORDER: empty group")
+
+	t.Setenv("GROUP_ORDER", "News|*|Sports")
+	assert.NoError(t, ValidateSettings())
+}
+
+func TestRenamedGroupsInPlaylist(t *testing.T) {
+	t.Setenv("GROUP_RENAME_1", `(?i)^(?:USA?\s*\|\s*)?news(?:\s*\(US\))?$ => US News`)
+	t.Setenv("GROUP_ORDER", "US News|Sports")
+	processor := runProcessorOn(t,
+		"#EXTM3U\n"+
+			"#EXTINF:-1 group-title=\"USA | NEWS\",CNN\nhttp://example.com/cnn\n"+
+			"#EXTINF:-1 group-title=\"Sports\",ESPN\nhttp://example.com/espn\n",
+		"#EXTM3U\n"+
+			"#EXTINF:-1 group-title=\"NEWS (US)\",Fox News\nhttp://example.com/fox\n"+
+			"#EXTINF:-1 group-title=\"Kids\",Cartoon Network\nhttp://example.com/cn\n")
+
+	assert.Equal(t, []string{"CNN", "Fox News", "ESPN", "Cartoon Network"}, playlistTitles(t, processor.GetResultPath()))
+
+	content, err := os.ReadFile(processor.GetResultPath())
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(content), `group-title="US News"`))
+	assert.NotContains(t, string(content), "NEWS")
+}
@@ -0,0 +1,156 @@
+package sourceproc
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+
+	"m3u-stream-merger/logger"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	// qualityTagRegex matches quality and codec tags such as HD, FHD, 4K,
+	// 1080p or HEVC, optionally in brackets.
+	qualityTagRegex = regexp.MustCompile(`(?i)[\[(]?\b(?:uhd|fhd|hd|sd|4k|8k|hdr|hevc|h\.?26[45]|(?:480|576|720|1080|2160)[pi]?|[25]0fps|60fps)\b[\])]?`)
+	// countryPrefixRegex matches two-letter country prefixes such as "US:",
+	// "UK |", "DE -", "|FR|" or "[CA]".
+	countryPrefixRegex = regexp.MustCompile(`^\s*(?:[\[(|]\s*[\p{L}]{2}\s*[\])|]\s*[:|-]?|[\p{L}]{2}\s*(?:[:|]|\s-))\s*`)
+)
+
+type mergeNormalizer struct {
+	name      string
+	normalize func(string) string
+}
+
+// mergeNormalizers are the steps of the normalization pipeline, in the order
+// they are applied.
+var mergeNormalizers = []mergeNormalizer{
+	{"nfkc", norm.NFKC.String},
+	{"casefold", func(value string) string {
+		return cases.Fold().String(value)
+	}},
+	{"country", func(value string) string {
+		return countryPrefixRegex.ReplaceAllString(value, "")
+	}},
+	{"quality", func(value string) string {
+		return qualityTagRegex.ReplaceAllString(value, " ")
+	}},
+	{"punctuation", collapsePunctuation},
+}
+
+// collapsePunctuation replaces runs of whitespace, punctuation and symbols by
+// a single space.
+func collapsePunctuation(value string) string {
+	var result strings.Builder
+	space := false
+	for _, r := range value {
+		if unicode.IsSpace(r) || unicode.IsPunct(r) || unicode.IsSymbol(r) {
+			space = true
+			continue
+		}
+		if space && result.Len() > 0 {
+			result.WriteByte(' ')
+		}
+		space = false
+		result.WriteRune(r)
+	}
+	return result.String()
+}
+
+// mergeKeyBuilder computes the key streams are merged on. It is configured by
+// MERGE_KEY, a list of alternatives separated by commas, each one being one or
+// more fields joined by +. The first alternative whose fields are all set is
+// used, e.g. "tvg-id,title" merges on the tvg-id and falls back to the title.
+// MERGE_NORMALIZE lists the normalization steps applied to the field values.
+type mergeKeyBuilder struct {
+	alternatives [][]filterField
+	normalizers  []func(string) string
+}
+
+func newMergeKeyBuilder() (*mergeKeyBuilder, error) {
+	builder := &mergeKeyBuilder{}
+
+	mergeKey := strings.TrimSpace(os.Getenv("MERGE_KEY"))
+	if mergeKey == "" {
+		mergeKey = "title"
+	}
+
+	for _, alternative := range strings.Split(mergeKey, ",") {
+		var fields []filterField
+		for _, name := range strings.Split(alternative, "+") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			field, ok := lookupFilterField(name)
+			if !ok {
+				return nil, fmt.Errorf("invalid MERGE_KEY: unknown field %q", name)
+			}
+			fields = append(fields, field)
+		}
+		builder.alternatives = append(builder.alternatives, fields)
+	}
+
+	steps := map[string]bool{}
+	for _, step := range strings.Split(os.Getenv("MERGE_NORMALIZE"), ",") {
+		step = strings.ToLower(strings.TrimSpace(step))
+		if step == "" {
+			continue
+		}
+		if step != "all" && !slices.ContainsFunc(mergeNormalizers, func(n mergeNormalizer) bool {
+			return n.name == step
+		}) {
+			return nil, fmt.Errorf("invalid MERGE_NORMALIZE: unknown step %q", step)
+		}
+		steps[step] = true
+	}
+	for _, normalizer := range mergeNormalizers {
+		if steps["all"] || steps[normalizer.name] {
+			builder.normalizers = append(builder.normalizers, normalizer.normalize)
+		}
+	}
+
+	return builder, nil
+}
+
+// compileMergeKey compiles MERGE_KEY and MERGE_NORMALIZE for a sync. Without
+// them, channels are merged on their title as is.
+func compileMergeKey() *mergeKeyBuilder {
+	builder, err := newMergeKeyBuilder()
+	if err != nil {
+		logger.Default.Errorf("Merging on the title instead: %v", err)
+		return &mergeKeyBuilder{alternatives: [][]filterField{{filterFields["title"]}}}
+	}
+	return builder
+}
+
+func (b *mergeKeyBuilder) normalize(value string) string {
+	for _, normalizer := range b.normalizers {
+		value = normalizer(value)
+	}
+	return strings.TrimSpace(value)
+}
+
+// key returns the merge key of a stream, or its title if no alternative
+// applies. The default configuration merges on the title as is.
+func (b *mergeKeyBuilder) key(stream *StreamInfo) string {
+	for _, fields := range b.alternatives {
+		values := make([]string, 0, len(fields))
+		for _, field := range fields {
+			value := b.normalize(field(stream))
+			if value == "" {
+				break
+			}
+			values = append(values, value)
+		}
+		if len(values) == len(fields) {
+			return strings.Join(values, "|")
+		}
+	}
+
+	// Normalization may strip a title down to nothing, e.g. "HD".
+	return stream.Title
+}
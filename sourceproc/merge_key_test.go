@@ -0,0 +1,115 @@
+package sourceproc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		mergeKey  string
+		normalize string
+		streams   []*StreamInfo
+		want      []string
+	}{
+		{
+			name:    "defaults to the title as is",
+			streams: []*StreamInfo{{Title: "CNN HD"}, {Title: "US: CNN"}},
+			want:    []string{"CNN HD", "US: CNN"},
+		},
+		{
+			name:      "normalized titles",
+			normalize: "all",
+			streams: []*StreamInfo{
+				{Title: "CNN HD"},
+				{Title: "CNN [FHD]"},
+				{Title: "US: CNN"},
+				{Title: "|US| CNN 1080p"},
+				{Title: "ＣＮＮ"},
+				{Title: "cnn"},
+			},
+			want: []string{"cnn", "cnn", "cnn", "cnn", "cnn", "cnn"},
+		},
+		{
+			name:      "selected steps only",
+			normalize: "casefold,quality",
+			streams:   []*StreamInfo{{Title: "CNN HD"}, {Title: "US: CNN"}},
+			want:      []string{"cnn", "us: cnn"},
+		},
+		{
+			name:      "tvg-id falls back to the title",
+			mergeKey:  "tvg-id,title",
+			normalize: "casefold",
+			streams:   []*StreamInfo{{Title: "CNN", TvgID: "cnn.us"}, {Title: "BBC One"}},
+			want:      []string{"cnn.us", "bbc one"},
+		},
+		{
+			name:      "combined fields",
+			mergeKey:  "tvg-id+title",
+			normalize: "casefold,quality,punctuation",
+			streams:   []*StreamInfo{{Title: "CNN HD", TvgID: "cnn.us"}, {Title: "CNN"}},
+			want:      []string{"cnn us|cnn", "CNN"},
+		},
+		{
+			name:      "title reduced to nothing",
+			normalize: "all",
+			streams:   []*StreamInfo{{Title: "HD"}},
+			want:      []string{"HD"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MERGE_KEY", tt.mergeKey)
+			t.Setenv("MERGE_NORMALIZE", tt.normalize)
+
+			builder, err := newMergeKeyBuilder()
+			require.NoError(t, err)
+
+			var got []string
+			for _, stream := range tt.streams {
+				got = append(got, builder.key(stream))
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMergeKeyValidation(t *testing.T) {
+	t.Setenv("MERGE_KEY", "tvg-id,channel")
+	assert.ErrorContains(t, ValidateSettings(), `invalid MERGE_KEY: unknown field "channel"`)
+
+	t.Setenv("MERGE_KEY", "tvg-id+attr.tvg-country,title")
+	t.Setenv("MERGE_NORMALIZE", "casefold,lowercase")
+	assert.ErrorContains(t, ValidateSettings(), `invalid MERGE_NORMALIZE: unknown step "lowercase"`)
+
+	t.Setenv("MERGE_NORMALIZE", "casefold,quality")
+	assert.NoError(t, ValidateSettings())
+}
+
+func TestMergeOnNormalizedKey(t *testing.T) {
+	t.Setenv("MERGE_NORMALIZE", "all")
+	processor := runProcessorOn(t,
+		"#EXTM3U\n"+
+			"#EXTINF:-1 group-title=\"News\",CNN HD\nhttp://example.com/cnn-hd\n"+
+			"#EXTINF:-1 group-title=\"News\",BBC One\nhttp://example.com/bbc\n",
+		"#EXTM3U\n"+
+			"#EXTINF:-1 group-title=\"News\",US: CNN\nhttp://example.com/cnn\n")
+
+	// The display title comes from the first source.
+	assert.ElementsMatch(t, []string{"CNN HD", "BBC One"}, playlistTitles(t, processor.GetResultPath()))
+
+	stream, err := ParseStreamInfoBySlug(EncodeSlug(&StreamInfo{Title: "CNN HD", MergeKey: "cnn"}))
+	require.NoError(t, err)
+	require.Len(t, stream.URLs["1"], 1)
+	require.Len(t, stream.URLs["2"], 1)
+	for _, url := range stream.URLs["1"] {
+		assert.Contains(t, url, "http://example.com/cnn-hd")
+	}
+	for _, url := range stream.URLs["2"] {
+		assert.Contains(t, url, "http://example.com/cnn")
+	}
+}
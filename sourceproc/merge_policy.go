@@ -0,0 +1,313 @@
+package sourceproc
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"m3u-stream-merger/logger"
+)
+
+const (
+	mergePolicyPriority = "priority"
+	mergePolicyMajority = "majority"
+	mergePolicyLongest  = "longest"
+	mergePolicySource   = "source"
+)
+
+// fieldCandidate is a value of a field of merged streams, along with the
+// entry it comes from.
+type fieldCandidate struct {
+	Value     string `json:"value"`
+	Source    string `json:"source"`
+	Index     int    `json:"index"`
+	Canonical bool   `json:"canonical,omitempty"`
+}
+
+// attributeCandidate holds the extra attributes of a merged stream, along
+// with the entry they come from.
+type attributeCandidate struct {
+	Attributes map[string]string `json:"attributes"`
+	Source     string            `json:"source"`
+	Index      int               `json:"index"`
+}
+
+type mergeField struct {
+	name  string
+	env   string
+	field func(*StreamInfo) *string
+}
+
+// mergeFields are the fields whose value is chosen by a merge policy.
+var mergeFields = []mergeField{
+	{"title", "TITLE", func(s *StreamInfo) *string { return &s.Title }},
+	{"tvg-id", "TVG_ID", func(s *StreamInfo) *string { return &s.TvgID }},
+	{"tvg-chno", "TVG_CHNO", func(s *StreamInfo) *string { return &s.TvgChNo }},
+	{"tvg-type", "TVG_TYPE", func(s *StreamInfo) *string { return &s.TvgType }},
+	{"logo", "LOGO", func(s *StreamInfo) *string { return &s.LogoURL }},
+	{"group", "GROUP", func(s *StreamInfo) *string { return &s.Group }},
+}
+
+type mergePolicy struct {
+	kind   string
+	source string
+}
+
+// mergePolicies chooses the value of each field of merged streams among the
+// values of every stream, so that the result doesn't depend on the order the
+// streams were processed in. Values of a canonical channel always win.
+type mergePolicies struct {
+	fields map[string]mergePolicy
+	// ranks of the sources listed in SOURCE_PRIORITY
+	ranks map[string]int
+}
+
+// defaultMergePolicies picks the first non-empty value by source index and
+// line number.
+var defaultMergePolicies = &mergePolicies{}
+
+func parseMergePolicy(name, value string) (mergePolicy, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	switch {
+	case value == "", value == mergePolicyPriority:
+		return mergePolicy{kind: mergePolicyPriority}, nil
+	case value == mergePolicyMajority, value == mergePolicyLongest:
+		return mergePolicy{kind: value}, nil
+	case strings.HasPrefix(value, mergePolicySource+":"):
+		source := strings.TrimSpace(strings.TrimPrefix(value, mergePolicySource+":"))
+		if source != "" {
+			return mergePolicy{kind: mergePolicySource, source: source}, nil
+		}
+	}
+	return mergePolicy{}, fmt.Errorf("invalid %s: unknown policy %q", name, value)
+}
+
+func newMergePolicies() (*mergePolicies, error) {
+	defaultPolicy, err := parseMergePolicy("MERGE_POLICY", os.Getenv("MERGE_POLICY"))
+	if err != nil {
+		return nil, err
+	}
+
+	policies := &mergePolicies{
+		fields: make(map[string]mergePolicy, len(mergeFields)),
+		ranks:  make(map[string]int),
+	}
+	for _, field := range mergeFields {
+		name := "MERGE_POLICY_" + field.env
+		value, ok := os.LookupEnv(name)
+		if !ok || strings.TrimSpace(value) == "" {
+			policies.fields[field.name] = defaultPolicy
+			continue
+		}
+		if policies.fields[field.name], err = parseMergePolicy(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, source := range strings.Split(os.Getenv("SOURCE_PRIORITY"), ",") {
+		source = strings.TrimSpace(source)
+		if _, ok := policies.ranks[source]; source != "" && !ok {
+			policies.ranks[source] = len(policies.ranks)
+		}
+	}
+
+	return policies, nil
+}
+
+// compileMergePolicies compiles MERGE_POLICY, MERGE_POLICY_<FIELD> and
+// SOURCE_PRIORITY for a sync. Without them, each field of a merged channel
+// takes the first non-empty value by source index and line number.
+func compileMergePolicies() *mergePolicies {
+	policies, err := newMergePolicies()
+	if err != nil {
+		logger.Default.Errorf("Using the default merge policy instead: %v", err)
+		return defaultMergePolicies
+	}
+	return policies
+}
+
+// candidates returns the values of the field for a stream, which are its own
+// value unless it was merged or mapped to a canonical channel.
+func (s *StreamInfo) candidates(field mergeField) []fieldCandidate {
+	if candidates, ok := s.Candidates[field.name]; ok {
+		return candidates
+	}
+	return []fieldCandidate{{
+		Value:  *field.field(s),
+		Source: s.SourceM3U,
+		Index:  s.SourceIndex,
+	}}
+}
+
+// attributeCandidates returns the attributes of the streams merged into a
+// stream, which are its own unless it was merged.
+func (s *StreamInfo) attributeCandidates() []attributeCandidate {
+	if s.AttributeCandidates != nil {
+		return s.AttributeCandidates
+	}
+	if len(s.Attributes) == 0 {
+		return nil
+	}
+	return []attributeCandidate{{
+		Attributes: s.Attributes,
+		Source:     s.SourceM3U,
+		Index:      s.SourceIndex,
+	}}
+}
+
+// addCandidates adds the values of the fields of new to the ones of base.
+func (s *StreamInfo) addCandidates(new *StreamInfo) {
+	if s.Candidates == nil {
+		s.Candidates = make(map[string][]fieldCandidate, len(mergeFields))
+	}
+	for _, field := range mergeFields {
+		s.Candidates[field.name] = append(s.candidates(field), new.candidates(field)...)
+	}
+
+	candidates := append(slices.Clip(s.attributeCandidates()), new.attributeCandidates()...)
+	if len(candidates) > 0 {
+		s.AttributeCandidates = candidates
+	}
+}
+
+// resolve sets the fields of a merged stream to the values chosen by the
+// policies. The stream keeps the key it was merged and indexed on.
+func (p *mergePolicies) resolve(s *StreamInfo) {
+	if len(s.Candidates) == 0 {
+		return
+	}
+
+	key := s.indexKey()
+	for _, field := range mergeFields {
+		if candidates, ok := s.Candidates[field.name]; ok {
+			*field.field(s) = p.pick(p.fields[field.name], candidates)
+		}
+	}
+	if len(s.AttributeCandidates) > 0 {
+		s.Attributes = p.pickAttributes(s.AttributeCandidates)
+	}
+
+	s.MergeKey = ""
+	if key != s.Title {
+		s.MergeKey = key
+	}
+}
+
+func (p *mergePolicies) pick(policy mergePolicy, candidates []fieldCandidate) string {
+	values := make([]fieldCandidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		if candidate.Value != "" {
+			values = append(values, candidate)
+		}
+	}
+	if len(values) == 0 {
+		return ""
+	}
+
+	sort.SliceStable(values, func(i, j int) bool {
+		return p.less(values[i], values[j])
+	})
+
+	for _, candidate := range values {
+		if candidate.Canonical {
+			return candidate.Value
+		}
+	}
+
+	switch policy.kind {
+	case mergePolicySource:
+		for _, candidate := range values {
+			if candidate.Source == policy.source {
+				return candidate.Value
+			}
+		}
+	case mergePolicyLongest:
+		longest := values[0].Value
+		for _, candidate := range values[1:] {
+			if utf8.RuneCountInString(candidate.Value) > utf8.RuneCountInString(longest) {
+				longest = candidate.Value
+			}
+		}
+		return longest
+	case mergePolicyMajority:
+		counts := make(map[string]int, len(values))
+		for _, candidate := range values {
+			counts[candidate.Value]++
+		}
+		majority := values[0].Value
+		for _, candidate := range values[1:] {
+			if counts[candidate.Value] > counts[majority] {
+				majority = candidate.Value
+			}
+		}
+		return majority
+	}
+
+	return values[0].Value
+}
+
+// isCatchupAttribute reports whether an attribute describes the catch-up of a
+// stream. Players build catch-up URLs from these attributes together, so they
+// are only taken from a single stream.
+func isCatchupAttribute(key string) bool {
+	return strings.HasPrefix(key, "catchup") || key == "timeshift" || key == "tvg-rec"
+}
+
+// pickAttributes merges the attributes of merged streams. Each attribute
+// takes the first non-empty value by source priority, except for the catch-up
+// attributes, which all come from the first stream that has any.
+func (p *mergePolicies) pickAttributes(candidates []attributeCandidate) map[string]string {
+	sorted := slices.Clone(candidates)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return p.less(
+			fieldCandidate{Source: sorted[i].Source, Index: sorted[i].Index},
+			fieldCandidate{Source: sorted[j].Source, Index: sorted[j].Index},
+		)
+	})
+
+	attributes := make(map[string]string)
+	hasCatchup := false
+	for _, candidate := range sorted {
+		catchup := false
+		for key, value := range candidate.Attributes {
+			if isCatchupAttribute(key) {
+				if hasCatchup || value == "" {
+					continue
+				}
+				catchup = true
+			}
+			if attributes[key] == "" {
+				attributes[key] = value
+			}
+		}
+		hasCatchup = hasCatchup || catchup
+	}
+	return attributes
+}
+
+// less orders candidates by source priority: the sources listed in
+// SOURCE_PRIORITY first, then by source index and line number.
+func (p *mergePolicies) less(a, b fieldCandidate) bool {
+	rankA, listedA := p.ranks[a.Source]
+	rankB, listedB := p.ranks[b.Source]
+	switch {
+	case listedA && listedB && rankA != rankB:
+		return rankA < rankB
+	case listedA != listedB:
+		return listedA
+	}
+
+	if a.Source != b.Source {
+		numA, errA := strconv.Atoi(a.Source)
+		numB, errB := strconv.Atoi(b.Source)
+		if errA == nil && errB == nil {
+			return numA < numB
+		}
+		return a.Source < b.Source
+	}
+	return a.Index < b.Index
+}
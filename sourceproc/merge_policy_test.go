@@ -0,0 +1,148 @@
+package sourceproc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergePolicies(t *testing.T) {
+	streams := func() []*StreamInfo {
+		return []*StreamInfo{
+			{Title: "CNN", Group: "News", LogoURL: "http://example.com/cnn-small.png", SourceM3U: "2", SourceIndex: 4},
+			{Title: "CNN", Group: "US News", TvgID: "cnn.us", SourceM3U: "10", SourceIndex: 2},
+			{Title: "CNN", Group: "US News", LogoURL: "http://example.com/cnn-large-hd.png", SourceM3U: "3", SourceIndex: 8},
+			{Title: "CNN", Group: "", TvgChNo: "5", SourceM3U: "2", SourceIndex: 2},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		env       map[string]string
+		wantLogo  string
+		wantGroup string
+	}{
+		{
+			name:      "first by source index and line by default",
+			wantLogo:  "http://example.com/cnn-small.png",
+			wantGroup: "News",
+		},
+		{
+			name:      "source priority",
+			env:       map[string]string{"SOURCE_PRIORITY": "3,10"},
+			wantLogo:  "http://example.com/cnn-large-hd.png",
+			wantGroup: "US News",
+		},
+		{
+			name:      "per-field policies",
+			env:       map[string]string{"MERGE_POLICY_LOGO": "longest", "MERGE_POLICY_GROUP": "majority"},
+			wantLogo:  "http://example.com/cnn-large-hd.png",
+			wantGroup: "US News",
+		},
+		{
+			name:      "named source falls back to priority",
+			env:       map[string]string{"MERGE_POLICY": "source:10"},
+			wantLogo:  "http://example.com/cnn-small.png",
+			wantGroup: "US News",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"MERGE_POLICY", "MERGE_POLICY_LOGO", "MERGE_POLICY_GROUP", "SOURCE_PRIORITY"} {
+				t.Setenv(key, tt.env[key])
+			}
+			policies, err := newMergePolicies()
+			require.NoError(t, err)
+
+			// The result must not depend on the order the streams are merged in.
+			for _, order := range [][]int{{0, 1, 2, 3}, {3, 2, 1, 0}, {2, 0, 3, 1}} {
+				s := streams()
+				merged := s[order[0]]
+				for _, i := range order[1:] {
+					merged = mergeStreamInfoAttributes(merged, s[i])
+				}
+				policies.resolve(merged)
+
+				assert.Equal(t, tt.wantLogo, merged.LogoURL, "order %v", order)
+				assert.Equal(t, tt.wantGroup, merged.Group, "order %v", order)
+				assert.Equal(t, "cnn.us", merged.TvgID, "order %v", order)
+				assert.Equal(t, "5", merged.TvgChNo, "order %v", order)
+			}
+		})
+	}
+}
+
+func TestMergePoliciesAttributes(t *testing.T) {
+	streams := func() []*StreamInfo {
+		return []*StreamInfo{
+			{Title: "CNN", SourceM3U: "2", SourceIndex: 4, Attributes: map[string]string{"tvg-country": "US", "tvg-language": "English"}},
+			{Title: "CNN", SourceM3U: "10", SourceIndex: 2, Attributes: map[string]string{"tvg-country": "USA", "radio": "false"}},
+			{Title: "CNN", SourceM3U: "3", SourceIndex: 8, Attributes: map[string]string{"tvg-language": "en", "tvg-rec": "3"}},
+			{Title: "CNN", SourceM3U: "2", SourceIndex: 2},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		priority string
+		want     map[string]string
+	}{
+		{
+			name: "first by source index and line by default",
+			want: map[string]string{"tvg-country": "US", "tvg-language": "English", "tvg-rec": "3", "radio": "false"},
+		},
+		{
+			name:     "source priority",
+			priority: "3,10",
+			want:     map[string]string{"tvg-country": "USA", "tvg-language": "en", "tvg-rec": "3", "radio": "false"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SOURCE_PRIORITY", tt.priority)
+			policies, err := newMergePolicies()
+			require.NoError(t, err)
+
+			// The result must not depend on the order the streams are merged in.
+			for _, order := range [][]int{{0, 1, 2, 3}, {3, 2, 1, 0}, {2, 0, 3, 1}} {
+				s := streams()
+				merged := s[order[0]]
+				for _, i := range order[1:] {
+					merged = mergeStreamInfoAttributes(merged, s[i])
+				}
+				policies.resolve(merged)
+
+				assert.Equal(t, tt.want, merged.Attributes, "order %v", order)
+			}
+		})
+	}
+}
+
+func TestMergePoliciesKeepIndexKey(t *testing.T) {
+	t.Setenv("MERGE_POLICY_TITLE", "longest")
+	policies, err := newMergePolicies()
+	require.NoError(t, err)
+
+	merged := mergeStreamInfoAttributes(
+		&StreamInfo{Title: "cnn", SourceM3U: "1", SourceIndex: 2},
+		&StreamInfo{Title: "CNN HD", MergeKey: "cnn", SourceM3U: "2", SourceIndex: 2},
+	)
+	policies.resolve(merged)
+
+	assert.Equal(t, "CNN HD", merged.Title)
+	assert.Equal(t, "cnn", merged.indexKey())
+}
+
+func TestMergePolicyValidation(t *testing.T) {
+	t.Setenv("MERGE_POLICY_GROUP", "loudest")
+	assert.ErrorContains(t, ValidateSettings(), `invalid MERGE_POLICY_GROUP: unknown policy "loudest"`)
+
+	t.Setenv("MERGE_POLICY_GROUP", "source:")
+	assert.ErrorContains(t, ValidateSettings(), `invalid MERGE_POLICY_GROUP: unknown policy "source:"`)
+
+	t.Setenv("MERGE_POLICY_GROUP", "Source:2")
+	assert.NoError(t, ValidateSettings())
+}
@@ -4,25 +4,30 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
-	"m3u-stream-merger/config"
 	"m3u-stream-merger/logger"
 	"m3u-stream-merger/utils"
 	"os"
 	"path/filepath"
-	"regexp"
+	"sort"
 	"strings"
 
 	"golang.org/x/crypto/sha3"
 )
 
-var (
-	// attributeRegex matches M3U attributes in the format key="value"
-	attributeRegex = regexp.MustCompile(`([a-zA-Z0-9_-]+)="([^"]*)"`)
-)
-
-// parseLine parses a single M3U line into a StreamInfo
-func parseLine(line string, nextLine *LineDetails, m3uIndex string) *StreamInfo {
+// parseLine parses a single M3U line into a StreamInfo. The options hold the
+// directives found between the #EXTINF line and the URL, if any. The URL is
+// indexed in the current stream index generation.
+func parseLine(line string, nextLine *LineDetails, m3uIndex string, options *StreamOptions) *StreamInfo {
 	logger.Default.Debugf("Parsing line: %s", line)
+	stream := parseEntry(tokenizeExtInf(line), nextLine, m3uIndex, options)
+	if stream != nil {
+		indexStream(stream, currentStreamIndexDir())
+	}
+	return stream
+}
+
+// parseEntry builds a StreamInfo from a tokenized #EXTINF line and its URL.
+func parseEntry(info *extInf, nextLine *LineDetails, m3uIndex string, options *StreamOptions) *StreamInfo {
 	logger.Default.Debugf("Next line: %s", nextLine.Content)
 
 	cleanUrl := strings.TrimSpace(nextLine.Content)
@@ -30,14 +35,11 @@ func parseLine(line string, nextLine *LineDetails, m3uIndex string) *StreamInfo
 		URLs: make(map[string]map[string]string),
 	}
 
-	matches := attributeRegex.FindAllStringSubmatch(line, -1)
-	lineWithoutPairs := line
-
-	for _, match := range matches {
-		key := strings.TrimSpace(match[1])
-		value := strings.TrimSpace(match[2])
+	for _, attribute := range info.attributes {
+		key := strings.ToLower(attribute.key)
+		value := attribute.value
 
-		switch strings.ToLower(key) {
+		switch key {
 		case "tvg-id":
 			stream.TvgID = utils.TvgIdParser(value)
 		case "tvg-chno", "channel-id", "channel-number":
@@ -50,61 +52,81 @@ func parseLine(line string, nextLine *LineDetails, m3uIndex string) *StreamInfo
 			stream.Group = utils.GroupTitleParser(value)
 		case "tvg-logo":
 			stream.LogoURL = utils.TvgLogoParser(value)
+		default:
+			if stream.Attributes == nil {
+				stream.Attributes = make(map[string]string)
+			}
+			stream.Attributes[key] = value
 		}
-		lineWithoutPairs = strings.Replace(lineWithoutPairs, match[0], "", 1)
 	}
 
-	if commaSplit := strings.SplitN(lineWithoutPairs, ",", 2); len(commaSplit) > 1 {
-		stream.Title = utils.TvgNameParser(strings.TrimSpace(commaSplit[1]))
+	if info.title != "" {
+		stream.Title = utils.TvgNameParser(info.title)
 	}
 
 	if stream.Title == "" {
 		return nil
 	}
 
-	if stream.URLs[m3uIndex] == nil {
-		stream.URLs[m3uIndex] = make(map[string]string)
+	if stream.Group == "" && options != nil {
+		stream.Group = utils.GroupTitleParser(options.ExtGrp)
 	}
 
-	encodedUrl := base64.StdEncoding.EncodeToString([]byte(cleanUrl))
+	h := sha3.Sum224([]byte(cleanUrl))
+	urlHash := hex.EncodeToString(h[:])
 
-	if stream.Title == "" {
-		logger.Default.Debugf("Stream missing title, skipping: %s", line)
-		return nil
+	stream.SourceM3U = m3uIndex
+	stream.SourceIndex = nextLine.LineNum
+	stream.SourceURL = cleanUrl
+	stream.URLKeys = []string{m3uIndex + "|" + urlHash}
+	stream.URLs[m3uIndex] = map[string]string{
+		urlHash: fmt.Sprintf("%d:::%s", nextLine.LineNum, cleanUrl),
+	}
+	if !options.isEmpty() {
+		stream.SourceOptions = options
+		stream.URLOptions = map[string]map[string]*StreamOptions{
+			m3uIndex: {urlHash: options},
+		}
+	}
+	if quality := detectQuality(stream.Title, cleanUrl); quality != "" {
+		stream.setSourceQuality(quality)
 	}
 
-	base64Title := base64.StdEncoding.EncodeToString([]byte(stream.Title))
-	h := sha3.Sum224([]byte(cleanUrl))
-	urlHash := hex.EncodeToString(h[:])
+	return stream
+}
+
+// indexStream writes the URL of a freshly parsed stream to the streams index
+// in indexDir, under the key the stream is merged on.
+func indexStream(stream *StreamInfo, indexDir string) {
+	_, urlHash, _ := strings.Cut(stream.URLKeys[0], "|")
+
+	base64Key := base64.StdEncoding.EncodeToString([]byte(stream.indexKey()))
+	encodedUrl := base64.StdEncoding.EncodeToString([]byte(stream.SourceURL))
 
 	// Determine shard from the first 3 hex characters of the URL hash
 	shard := urlHash[:3]
-	shardDir := filepath.Join(config.GetStreamsDirPath(), shard)
-	fileName := fmt.Sprintf("%s_%s|%s", base64Title, m3uIndex, urlHash)
+	shardDir := filepath.Join(indexDir, shard)
+	fileName := fmt.Sprintf("%s_%s|%s", base64Key, stream.SourceM3U, urlHash)
 	filePath := filepath.Join(shardDir, fileName)
 
-	stream.SourceM3U = m3uIndex
-	stream.SourceIndex = nextLine.LineNum
-
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
 		// Create shard directory if it doesn't exist
 		if err := os.MkdirAll(shardDir, os.ModePerm); err != nil {
 			logger.Default.Debugf("Error creating shard directory %s: %v", shardDir, err)
 		}
-		content := fmt.Sprintf("%d:::%s", nextLine.LineNum, encodedUrl)
-		if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
-			logger.Default.Debugf("Error indexing stream: %s (#%s) -> %v", stream.Title, m3uIndex, err)
+		content := fmt.Sprintf("%d:::%s", stream.SourceIndex, encodedUrl)
+		encodedOptions := encodeStreamOptions(stream.SourceOptions)
+		quality := stream.URLQualities[stream.SourceM3U][urlHash]
+		if encodedOptions != "" || quality != "" {
+			content += ":::" + encodedOptions
 		}
-		if stream.URLs == nil {
-			stream.URLs = make(map[string]map[string]string)
+		if quality != "" {
+			content += ":::" + quality
 		}
-		if stream.URLs[m3uIndex] == nil {
-			stream.URLs[m3uIndex] = make(map[string]string)
+		if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+			logger.Default.Debugf("Error indexing stream: %s (#%s) -> %v", stream.Title, stream.SourceM3U, err)
 		}
-		stream.URLs[m3uIndex][urlHash] = fmt.Sprintf("%d:::%s", nextLine.LineNum, cleanUrl)
 	}
-
-	return stream
 }
 
 // formatStreamEntry formats a stream entry for M3U output
@@ -114,28 +136,54 @@ func formatStreamEntry(baseURL string, stream *StreamInfo) string {
 	extInfTags := []string{"#EXTINF:-1"}
 
 	if stream.TvgID != "" {
-		extInfTags = append(extInfTags, fmt.Sprintf("tvg-id=\"%s\"", stream.TvgID))
+		extInfTags = append(extInfTags, fmt.Sprintf("tvg-id=\"%s\"", attributeValue(stream.TvgID)))
 	}
 	if stream.TvgChNo != "" {
-		extInfTags = append(extInfTags, fmt.Sprintf("tvg-chno=\"%s\"", stream.TvgChNo))
+		extInfTags = append(extInfTags, fmt.Sprintf("tvg-chno=\"%s\"", attributeValue(stream.TvgChNo)))
 	}
 	if stream.LogoURL != "" {
-		extInfTags = append(extInfTags, fmt.Sprintf("tvg-logo=\"%s\"", stream.LogoURL))
+		extInfTags = append(extInfTags, fmt.Sprintf("tvg-logo=\"%s\"", attributeValue(stream.LogoURL)))
 	}
 	if stream.Group != "" {
-		extInfTags = append(extInfTags, fmt.Sprintf("tvg-group=\"%s\"", stream.Group))
-		extInfTags = append(extInfTags, fmt.Sprintf("group-title=\"%s\"", stream.Group))
+		extInfTags = append(extInfTags, fmt.Sprintf("tvg-group=\"%s\"", attributeValue(stream.Group)))
+		extInfTags = append(extInfTags, fmt.Sprintf("group-title=\"%s\"", attributeValue(stream.Group)))
 	}
 	if stream.TvgType != "" {
-		extInfTags = append(extInfTags, fmt.Sprintf("tvg-type=\"%s\"", stream.TvgType))
+		extInfTags = append(extInfTags, fmt.Sprintf("tvg-type=\"%s\"", attributeValue(stream.TvgType)))
 	}
 	if stream.Title != "" {
-		extInfTags = append(extInfTags, fmt.Sprintf("tvg-name=\"%s\"", stream.Title))
+		extInfTags = append(extInfTags, fmt.Sprintf("tvg-name=\"%s\"", attributeValue(stream.Title)))
+	}
+
+	attributeKeys := make([]string, 0, len(stream.Attributes))
+	for key := range stream.Attributes {
+		attributeKeys = append(attributeKeys, key)
+	}
+	sort.Strings(attributeKeys)
+	for _, key := range attributeKeys {
+		extInfTags = append(extInfTags, fmt.Sprintf("%s=\"%s\"", key, attributeValue(stream.Attributes[key])))
 	}
 
 	entry.WriteString(fmt.Sprintf("%s,%s\n", strings.Join(extInfTags, " "), stream.Title))
-	entry.WriteString(GenerateStreamURL(baseURL, stream))
+
+	if os.Getenv("BYPASS_PROXY") == "true" && stream.SourceURL != "" {
+		// Players connect to the provider directly, so they need the
+		// original directives of the URL as well.
+		for _, directive := range stream.SourceOptions.directiveLines() {
+			entry.WriteString(directive)
+			entry.WriteString("\n")
+		}
+		entry.WriteString(stream.SourceURL)
+	} else {
+		entry.WriteString(GenerateStreamURL(baseURL, stream))
+	}
 	entry.WriteString("\n")
 
 	return entry.String()
 }
+
+// attributeValue makes a value safe to be written as a double quoted
+// attribute value.
+func attributeValue(value string) string {
+	return strings.ReplaceAll(value, `"`, "'")
+}
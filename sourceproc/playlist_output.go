@@ -0,0 +1,127 @@
+package sourceproc
+
+import (
+	"bufio"
+	"os"
+
+	"m3u-stream-merger/config"
+	"m3u-stream-merger/logger"
+)
+
+// playlistOutput is a playlist written by a sync: the main playlist or the
+// playlist of a profile. Each one filters, renames, sorts and numbers the
+// streams of the sources with its own settings.
+type playlistOutput struct {
+	settings   profileSettings
+	file       *os.File
+	writer     *bufio.Writer
+	sortingMgr *SortingManager
+	snapshot   *snapshotWriter
+	filters    *streamFilters
+	groups     *groupRules
+	rewrites   *titleRewrites
+	numbering  *channelNumbering
+}
+
+// newPlaylistOutput creates the playlist of the main playlist at path, or of
+// a profile next to it. Only the main playlist has a channel snapshot.
+func newPlaylistOutput(s profileSettings, processedPath string) (*playlistOutput, error) {
+	path := processedPath
+	if s.profile != "" {
+		path = config.GetProcessedProfilePath(processedPath, s.profile)
+	}
+
+	file, err := createResultFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &playlistOutput{
+		settings:   s,
+		file:       file,
+		writer:     bufio.NewWriter(file),
+		sortingMgr: newSortingManager(s),
+	}
+
+	if s.profile == "" {
+		snapshot, err := newSnapshotWriter(config.GetProcessedSnapshotPath(processedPath))
+		if err != nil {
+			logger.Default.Errorf("Error creating channel snapshot: %v", err)
+		}
+		output.snapshot = snapshot
+	}
+
+	return output, nil
+}
+
+// compileSettings compiles the settings of the playlist once per sync.
+func (o *playlistOutput) compileSettings() {
+	o.filters = compileStreamFilters(o.settings)
+	o.groups = compileGroupRules(o.settings)
+	o.rewrites = compileTitleRewrites(o.settings)
+	o.numbering = compileChannelNumbering(o.settings)
+}
+
+// prepare renames a stream that passed the filters of the playlist and sets
+// the key it is merged on.
+func (o *playlistOutput) prepare(stream *StreamInfo, mergeKey *mergeKeyBuilder, channels *channelMap) {
+	o.groups.rename(stream)
+
+	if channel := channels.lookup(stream); channel != nil {
+		channel.apply(stream)
+	} else if key := o.rewrites.rewrite(stream, mergeKey.key(stream)); key != stream.Title {
+		stream.MergeKey = key
+	}
+}
+
+// compile writes the sorted streams to the playlist.
+func (o *playlistOutput) compile(baseURL string) {
+	_, err := o.writer.WriteString("#EXTM3U\n")
+	if err != nil {
+		logger.Default.Errorf("Error writing to M3U file: %v", err)
+	}
+
+	err = o.sortingMgr.GetSortedEntries(func(entry *StreamInfo) {
+		if o.numbering != nil {
+			o.numbering.assign(entry)
+		}
+		_, writeErr := o.writer.WriteString(formatStreamEntry(baseURL, entry))
+		if writeErr != nil {
+			logger.Default.Errorf("Error writing to M3U file: %v", err)
+		}
+		if o.snapshot != nil {
+			if writeErr := o.snapshot.write(entry); writeErr != nil {
+				logger.Default.Errorf("Error writing channel snapshot: %v", writeErr)
+			}
+		}
+	})
+	if err != nil {
+		logger.Default.Errorf("Error streaming sorted entries: %v", err)
+	}
+
+	if o.snapshot != nil {
+		if err := o.snapshot.close(); err != nil {
+			logger.Default.Errorf("Error saving channel snapshot: %v", err)
+		}
+	}
+
+	if o.numbering != nil {
+		if err := o.numbering.save(); err != nil {
+			logger.Default.Errorf("Error saving channel numbers: %v", err)
+		}
+	}
+
+	o.writer.Flush()
+	o.file.Close()
+
+	o.sortingMgr.Close()
+}
+
+func (o *playlistOutput) cleanup() {
+	if o.writer != nil {
+		o.writer.Flush()
+	}
+	if o.file != nil {
+		o.file.Close()
+	}
+}
@@ -0,0 +1,133 @@
+package sourceproc
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"m3u-stream-merger/logger"
+)
+
+const (
+	// maxExtInfContinuations limits how many lines a wrapped #EXTINF line
+	// may span.
+	maxExtInfContinuations = 3
+	// maxLoggedParseWarnings limits the warnings logged per source and sync.
+	maxLoggedParseWarnings = 50
+)
+
+// urlLineRegex matches lines that start with a URL scheme, e.g. http://.
+var urlLineRegex = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*://`)
+
+func isURLLine(line string) bool {
+	return urlLineRegex.MatchString(line) || strings.HasPrefix(line, "/")
+}
+
+// playlistEntry is an #EXTINF line together with its directives and URL.
+type playlistEntry struct {
+	extInf     *extInf
+	extInfLine int
+	options    *StreamOptions
+	url        *LineDetails
+}
+
+// playlistParser assembles playlist entries from the lines of a source. It
+// joins #EXTINF lines wrapped over several lines and reports malformed
+// entries as warnings with their line numbers.
+type playlistParser struct {
+	index string
+
+	pending       *playlistEntry
+	pendingRaw    string
+	continuations int
+
+	warnings int
+}
+
+func newPlaylistParser(index string) *playlistParser {
+	return &playlistParser{index: index}
+}
+
+// warnf reports a parse warning for the given zero-based line number.
+func (p *playlistParser) warnf(lineNum int, format string, args ...any) {
+	p.warnings++
+	if p.warnings <= maxLoggedParseWarnings {
+		logger.Default.Warnf("M3U_%s line %d: %s", p.index, lineNum+1, fmt.Sprintf(format, args...))
+	}
+}
+
+// feed processes the next line and returns an entry once its URL is found.
+func (p *playlistParser) feed(lineInfo *LineDetails) *playlistEntry {
+	line := strings.TrimSpace(lineInfo.Content)
+
+	switch {
+	case line == "":
+		return nil
+
+	case p.pending != nil && p.pending.extInf.incomplete() &&
+		p.continuations < maxExtInfContinuations &&
+		!strings.HasPrefix(line, "#") && !isURLLine(line):
+		separator := " "
+		if p.pending.extInf.unterminated {
+			separator = ""
+		}
+		p.pendingRaw += separator + line
+		p.pending.extInf = tokenizeExtInf(p.pendingRaw)
+		p.continuations++
+		return nil
+
+	case isExtInfLine(line):
+		p.dropPending("#EXTINF entry has no stream URL, skipping")
+		p.pending = &playlistEntry{
+			extInf:     tokenizeExtInf(line),
+			extInfLine: lineInfo.LineNum,
+			options:    &StreamOptions{},
+		}
+		p.pendingRaw = line
+		p.continuations = 0
+		return nil
+
+	case strings.HasPrefix(line, "#"):
+		if p.pending != nil {
+			p.pending.options.addDirective(line)
+		}
+		return nil
+
+	case p.pending == nil:
+		p.warnf(lineInfo.LineNum, "stream URL without #EXTINF entry, skipping")
+		return nil
+	}
+
+	entry := p.pending
+	entry.url = &LineDetails{Content: line, LineNum: lineInfo.LineNum}
+	p.pending = nil
+
+	for _, warning := range entry.extInf.warnings {
+		p.warnf(entry.extInfLine, "%s", warning)
+	}
+	if !entry.extInf.hasTitle {
+		p.warnf(entry.extInfLine, "missing comma before the title")
+	}
+
+	return entry
+}
+
+func (p *playlistParser) dropPending(reason string) {
+	if p.pending != nil {
+		p.warnf(p.pending.extInfLine, "%s", reason)
+		p.pending = nil
+	}
+}
+
+// finish reports an entry left without URL and a summary of the warnings.
+func (p *playlistParser) finish() {
+	p.dropPending("#EXTINF entry has no stream URL, skipping")
+
+	if p.warnings > maxLoggedParseWarnings {
+		logger.Default.Warnf("M3U_%s: %d more parse warnings were not logged",
+			p.index, p.warnings-maxLoggedParseWarnings)
+	}
+	if p.warnings > 0 {
+		recordParseWarnings(p.index, p.warnings)
+	}
+}
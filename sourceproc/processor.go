@@ -1,14 +1,13 @@
 package sourceproc
 
 import (
-	"bufio"
 	"context"
 	"math"
 	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
-	"strings"
+	"slices"
 	"sync"
 	"sync/atomic"
 
@@ -20,33 +19,83 @@ import (
 type M3UProcessor struct {
 	sync.RWMutex
 	streamCount      atomic.Int64
-	file             *os.File
-	writer           *bufio.Writer
 	revalidatingDone chan struct{}
-	sortingMgr       *SortingManager
+	outputs          []*playlistOutput
+	index            *streamIndexGeneration
+	refreshIndexes   []string
+	mergeKey         *mergeKeyBuilder
+	channels         *channelMap
+	probeQuality     bool
 }
 
-func NewProcessor() *M3UProcessor {
+// outputStream is a stream to add to a playlist.
+type outputStream struct {
+	output *playlistOutput
+	stream *StreamInfo
+}
+
+// probeJob is a stream whose quality is probed before it is added to the
+// playlists it was filtered into.
+type probeJob struct {
+	stream  *StreamInfo
+	outputs []*playlistOutput
+}
+
+// ProcessorOption configures an M3UProcessor.
+type ProcessorOption func(*M3UProcessor)
+
+// WithRefreshIndexes only downloads the given sources. The other sources are
+// read from their cached copies, so passing no index rebuilds the merged
+// output from the cache alone.
+func WithRefreshIndexes(indexes ...string) ProcessorOption {
+	return func(p *M3UProcessor) {
+		p.refreshIndexes = append([]string{}, indexes...)
+	}
+}
+
+// NewProcessor creates the processor of a sync. It writes the main playlist
+// and the playlist of every profile of PLAYLIST_PROFILES from the same
+// download of the sources.
+func NewProcessor(opts ...ProcessorOption) *M3UProcessor {
 	processedPath := config.GetNewM3UPath()
-	file, err := createResultFile(processedPath)
+	output, err := newPlaylistOutput(defaultSettings, processedPath)
 	if err != nil {
 		logger.Default.Errorf("Error creating result file: %v", err)
 		return nil
 	}
+	outputs := []*playlistOutput{output}
+
+	for _, profile := range Profiles() {
+		output, err := newPlaylistOutput(newProfileSettings(profile), processedPath)
+		if err != nil {
+			logger.Default.Errorf("Error creating result file of profile %s: %v", profile, err)
+			continue
+		}
+		outputs = append(outputs, output)
+	}
+
+	index, err := newStreamIndexGeneration()
+	if err != nil {
+		logger.Default.Errorf("Error creating stream index: %v", err)
+	}
 
 	processor := &M3UProcessor{
-		file:             file,
-		writer:           bufio.NewWriter(file),
 		revalidatingDone: make(chan struct{}),
-		sortingMgr:       newSortingManager(),
+		outputs:          outputs,
+		index:            index,
+	}
+
+	for _, opt := range opts {
+		opt(processor)
 	}
 
 	return processor
 }
 
-func (p *M3UProcessor) Start(r *http.Request) {
+// Start processes the sources. Quality probes are cancelled with ctx.
+func (p *M3UProcessor) Start(ctx context.Context, r *http.Request) {
 	processCount := 0
-	errors := p.processStreams(r)
+	errors := p.processStreams(ctx, r)
 	for err := range errors {
 		if err != nil {
 			logger.Default.Errorf("Error while processing stream: %v", err)
@@ -71,12 +120,13 @@ func (p *M3UProcessor) Wait(ctx context.Context) error {
 	}
 
 	p.clearOldResults()
+	p.commitIndex()
 
 	return nil
 }
 
 func (p *M3UProcessor) Run(ctx context.Context, r *http.Request) error {
-	p.Start(r)
+	p.Start(ctx, r)
 	return p.Wait(ctx)
 }
 
@@ -85,20 +135,54 @@ func (p *M3UProcessor) GetCount() int {
 }
 
 func (p *M3UProcessor) clearOldResults() {
-	err := config.ClearOldProcessedM3U(p.file.Name())
+	err := config.ClearOldProcessedM3U(p.GetResultPath())
 	if err != nil {
 		logger.Default.Error(err.Error())
 	}
 }
 
+// shouldRefresh reports whether a source is downloaded during this run.
+func (p *M3UProcessor) shouldRefresh(idx string) bool {
+	return p.refreshIndexes == nil || slices.Contains(p.refreshIndexes, idx)
+}
+
+// commitIndex serves stream lookups from the URLs seen during this run and
+// prunes the ones that were not refreshed.
+func (p *M3UProcessor) commitIndex() {
+	if p.index == nil {
+		return
+	}
+	if err := p.index.commit(); err != nil {
+		logger.Default.Error(err.Error())
+	}
+}
+
+// indexDir returns the directory URLs seen during this run are indexed in.
+func (p *M3UProcessor) indexDir() string {
+	if p.index == nil {
+		return currentStreamIndexDir()
+	}
+	return p.index.dir
+}
+
 func (p *M3UProcessor) GetResultPath() string {
-	if p.file == nil {
+	if len(p.outputs) == 0 || p.outputs[0].file == nil {
 		return ""
 	}
-	return p.file.Name()
+	return p.outputs[0].file.Name()
+}
+
+// GetProfileResultPaths returns the paths of the playlists of the profiles,
+// keyed by profile name.
+func (p *M3UProcessor) GetProfileResultPaths() map[string]string {
+	paths := make(map[string]string)
+	for _, output := range p.outputs[1:] {
+		paths[output.settings.profile] = output.file.Name()
+	}
+	return paths
 }
 
-func (p *M3UProcessor) processStreams(r *http.Request) chan error {
+func (p *M3UProcessor) processStreams(ctx context.Context, r *http.Request) chan error {
 	revalidating := true
 	select {
 	case _, revalidating = <-p.revalidatingDone:
@@ -109,29 +193,56 @@ func (p *M3UProcessor) processStreams(r *http.Request) chan error {
 		p.revalidatingDone = make(chan struct{})
 	}
 
-	results := streamDownloadM3USources()
+	for _, output := range p.outputs {
+		output.compileSettings()
+	}
+	p.mergeKey = compileMergeKey()
+	p.channels = compileChannelMap(p.mergeKey)
+	p.probeQuality = os.Getenv("QUALITY_PROBE") == "true"
+	results := streamDownloadM3USources(p.shouldRefresh)
 	baseURL := utils.DetermineBaseURL(r)
 
 	// Increase channel buffer sizes
-	errors := make(chan error, 1000)         // Increased error buffer
-	streamCh := make(chan *StreamInfo, 1000) // Larger stream buffer
+	errors := make(chan error, 1000)          // Increased error buffer
+	streamCh := make(chan outputStream, 1000) // Larger stream buffer
 
 	go func() {
 		defer close(errors)
 		defer p.cleanup()
 
 		var wgProducers sync.WaitGroup
+		probeCh := make(chan probeJob, 1000)
 		for result := range results {
 			wgProducers.Add(1)
 			go func(res *SourceDownloaderResult) {
 				defer wgProducers.Done()
-				p.handleDownloaded(res, streamCh)
+				p.handleDownloaded(res, probeCh, streamCh)
 			}(result)
 		}
 
-		// Close streamCh after all producers finish
+		// Quality probes are slow requests, so a few of them are run at
+		// once rather than one source line at a time.
+		var wgProbers sync.WaitGroup
+		if p.probeQuality {
+			wgProbers.Add(qualityProbeWorkers)
+			for i := 0; i < qualityProbeWorkers; i++ {
+				go func() {
+					defer wgProbers.Done()
+					for job := range probeCh {
+						if quality := probeStreamQuality(ctx, job.stream); quality != "" {
+							job.stream.setSourceQuality(quality)
+						}
+						p.sendStream(job.stream, job.outputs, streamCh)
+					}
+				}()
+			}
+		}
+
+		// Close streamCh after all producers and probes finish
 		go func() {
 			wgProducers.Wait()
+			close(probeCh)
+			wgProbers.Wait()
 			close(streamCh)
 		}()
 
@@ -143,8 +254,8 @@ func (p *M3UProcessor) processStreams(r *http.Request) chan error {
 		for i := 0; i < numWorkers; i++ {
 			go func() {
 				defer wgWorkers.Done()
-				for stream := range streamCh {
-					err := p.addStream(stream)
+				for entry := range streamCh {
+					err := p.addStream(entry.output, entry.stream)
 					select {
 					case errors <- err:
 					default:
@@ -156,60 +267,48 @@ func (p *M3UProcessor) processStreams(r *http.Request) chan error {
 
 		wgWorkers.Wait() // Wait for all streams to be processed
 
+		if p.probeQuality && ctx.Err() == nil {
+			probedQualities.rotate()
+		}
+
 		p.compileM3U(baseURL)
 	}()
 
 	return errors
 }
 
-func (p *M3UProcessor) addStream(stream *StreamInfo) error {
+func (p *M3UProcessor) addStream(output *playlistOutput, stream *StreamInfo) error {
 	if stream == nil || len(stream.URLs) == 0 {
 		return nil
 	}
 
-	p.streamCount.Add(1)
+	// Streams are counted once, as part of the main playlist.
+	if output == p.outputs[0] {
+		p.streamCount.Add(1)
+	}
 
-	return p.sortingMgr.AddToSorter(stream)
+	return output.sortingMgr.AddToSorter(stream)
 }
 
 func (p *M3UProcessor) compileM3U(baseURL string) {
 	p.Lock()
 	defer p.Unlock()
 
-	_, err := p.writer.WriteString("#EXTM3U\n")
-	if err != nil {
-		logger.Default.Errorf("Error writing to M3U file: %v", err)
+	for _, output := range p.outputs {
+		output.compile(baseURL)
 	}
 
-	err = p.sortingMgr.GetSortedEntries(func(entry *StreamInfo) {
-		_, writeErr := p.writer.WriteString(formatStreamEntry(baseURL, entry))
-		if writeErr != nil {
-			logger.Default.Errorf("Error writing to M3U file: %v", err)
-		}
-	})
-	if err != nil {
-		logger.Default.Errorf("Error streaming sorted entries: %v", err)
-	}
-
-	p.writer.Flush()
-	p.file.Close()
-
-	p.sortingMgr.Close()
-
 	close(p.revalidatingDone)
 }
 
 func (p *M3UProcessor) cleanup() {
-	if p.writer != nil {
-		p.writer.Flush()
-	}
-	if p.file != nil {
-		p.file.Close()
+	for _, output := range p.outputs {
+		output.cleanup()
 	}
 }
 
-func (p *M3UProcessor) handleDownloaded(result *SourceDownloaderResult, streamCh chan<- *StreamInfo) {
-	var currentLine string
+func (p *M3UProcessor) handleDownloaded(result *SourceDownloaderResult, probeCh chan<- probeJob, streamCh chan<- outputStream) {
+	parser := newPlaylistParser(result.Index)
 
 	// Handle errors asynchronously
 	go func() {
@@ -222,17 +321,51 @@ func (p *M3UProcessor) handleDownloaded(result *SourceDownloaderResult, streamCh
 
 	// Process lines as they come in
 	for lineInfo := range result.Lines {
-		line := strings.TrimSpace(lineInfo.Content)
-		if strings.HasPrefix(line, "#EXTINF:") {
-			currentLine = line
-		} else if currentLine != "" && !strings.HasPrefix(line, "#") {
-			if streamInfo := parseLine(currentLine, lineInfo, result.Index); streamInfo != nil {
-				if checkFilter(streamInfo) {
-					streamCh <- streamInfo
-				}
+		entry := parser.feed(lineInfo)
+		if entry == nil {
+			continue
+		}
+
+		streamInfo := parseEntry(entry.extInf, entry.url, result.Index, entry.options)
+		if streamInfo == nil {
+			parser.warnf(entry.extInfLine, "#EXTINF entry has no title, skipping")
+			continue
+		}
+
+		var outputs []*playlistOutput
+		for _, output := range p.outputs {
+			if output.filters.check(streamInfo) {
+				outputs = append(outputs, output)
 			}
-			currentLine = ""
 		}
+		if len(outputs) == 0 {
+			continue
+		}
+
+		if p.probeQuality && len(streamInfo.URLQualities) == 0 {
+			probeCh <- probeJob{stream: streamInfo, outputs: outputs}
+			continue
+		}
+		p.sendStream(streamInfo, outputs, streamCh)
+	}
+
+	parser.finish()
+}
+
+// sendStream adds a freshly parsed stream to the playlists it was filtered
+// into.
+func (p *M3UProcessor) sendStream(streamInfo *StreamInfo, outputs []*playlistOutput, streamCh chan<- outputStream) {
+	indexDir := p.indexDir()
+	for i, output := range outputs {
+		// The last playlist gets the parsed stream, after the others got
+		// their copy.
+		stream := streamInfo
+		if i < len(outputs)-1 {
+			stream = streamInfo.clone()
+		}
+		output.prepare(stream, p.mergeKey, p.channels)
+		indexStream(stream, indexDir)
+		streamCh <- outputStream{output: output, stream: stream}
 	}
 }
 
@@ -0,0 +1,106 @@
+package sourceproc
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"m3u-stream-merger/utils"
+)
+
+// profileNameRegex matches the names of playlist profiles, which are part of
+// the playlist URL (e.g. /playlist/living-room.m3u).
+var profileNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// profileSettings reads the settings of a playlist profile. A profile can set
+// its own filters, group rules, sorting, numbering and title rules by
+// prefixing their settings with PROFILE_<NAME>_ (e.g. PROFILE_KIDS_SORTING_KEY
+// or PROFILE_KIDS_INCLUDE_GROUPS_1). The settings it doesn't set are the ones
+// of the main playlist.
+type profileSettings struct {
+	profile string
+	prefix  string
+}
+
+// defaultSettings are the settings of the main playlist.
+var defaultSettings = profileSettings{}
+
+func newProfileSettings(profile string) profileSettings {
+	return profileSettings{
+		profile: profile,
+		prefix:  "PROFILE_" + strings.ToUpper(strings.ReplaceAll(profile, "-", "_")) + "_",
+	}
+}
+
+func (s profileSettings) getenv(setting string) string {
+	if s.prefix != "" {
+		if value, ok := os.LookupEnv(s.prefix + setting); ok {
+			return value
+		}
+	}
+	return os.Getenv(setting)
+}
+
+// filters returns the values of the indexed settings baseEnv_X (e.g.
+// INCLUDE_GROUPS_1). If the profile sets any of them, they replace the ones
+// of the main playlist.
+func (s profileSettings) filters(baseEnv string) []string {
+	if s.prefix != "" {
+		if filters := utils.GetFilters(s.prefix + baseEnv); len(filters) > 0 {
+			return filters
+		}
+	}
+	return utils.GetFilters(baseEnv)
+}
+
+// Profiles returns the names of the playlist profiles of PLAYLIST_PROFILES.
+// Invalid names are rejected on startup.
+func Profiles() []string {
+	profiles, _ := parseProfiles()
+	return profiles
+}
+
+func parseProfiles() ([]string, error) {
+	value := strings.TrimSpace(os.Getenv("PLAYLIST_PROFILES"))
+	if value == "" {
+		return nil, nil
+	}
+
+	var profiles []string
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(value, ",") {
+		profile := strings.ToLower(strings.TrimSpace(item))
+		if !profileNameRegex.MatchString(profile) {
+			return nil, fmt.Errorf("invalid PLAYLIST_PROFILES: invalid name %q", item)
+		}
+		if seen[profile] {
+			return nil, fmt.Errorf("invalid PLAYLIST_PROFILES: duplicate profile %q", profile)
+		}
+		seen[profile] = true
+		profiles = append(profiles, profile)
+	}
+
+	return profiles, nil
+}
+
+// validateProfileSettings reports configuration errors of the settings a
+// profile can set.
+func validateProfileSettings(s profileSettings) error {
+	if _, err := compileFilterExpression(s); err != nil {
+		return err
+	}
+	if _, err := newTitleRewrites(s); err != nil {
+		return err
+	}
+	if _, err := newGroupRules(s); err != nil {
+		return err
+	}
+	if _, err := newStreamSorter(s); err != nil {
+		return err
+	}
+	if _, err := newChannelNumbering(s); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package sourceproc
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"m3u-stream-merger/config"
+	"m3u-stream-merger/utils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProfilesValidation(t *testing.T) {
+	utils.ResetCaches()
+	defer utils.ResetCaches()
+
+	t.Setenv("PLAYLIST_PROFILES", "kids,Living Room")
+	assert.ErrorContains(t, ValidateSettings(), `invalid PLAYLIST_PROFILES: invalid name "Living Room"`)
+
+	t.Setenv("PLAYLIST_PROFILES", "kids,KIDS")
+	assert.ErrorContains(t, ValidateSettings(), `invalid PLAYLIST_PROFILES: duplicate profile "kids"`)
+
+	t.Setenv("PLAYLIST_PROFILES", " kids, living-room ,sports_bar")
+	assert.NoError(t, ValidateSettings())
+	assert.Equal(t, []string{"kids", "living-room", "sports_bar"}, Profiles())
+
+	t.Setenv("PROFILE_LIVING_ROOM_SORTING_KEY", "rating")
+	assert.ErrorContains(t, ValidateSettings(), `profile living-room: invalid SORTING_KEY: unknown key "rating"`)
+
+	t.Setenv("PROFILE_LIVING_ROOM_SORTING_KEY", "group")
+	t.Setenv("PROFILE_KIDS_TITLE_REWRITE_1", "^Kids: ")
+	utils.ResetCaches()
+	assert.ErrorContains(t, ValidateSettings(), `profile kids: invalid TITLE_REWRITE: missing "=>"`)
+}
+
+func TestProfileSettings(t *testing.T) {
+	utils.ResetCaches()
+	defer utils.ResetCaches()
+
+	t.Setenv("SORTING_KEY", "title")
+	t.Setenv("INCLUDE_GROUPS_1", "News")
+	t.Setenv("INCLUDE_GROUPS_2", "Sports")
+	t.Setenv("PROFILE_KIDS_SORTING_KEY", "")
+	t.Setenv("PROFILE_KIDS_INCLUDE_GROUPS_1", "Kids")
+
+	kids := newProfileSettings("kids")
+	assert.Equal(t, "", kids.getenv("SORTING_KEY"), "Settings set to nothing override the main playlist")
+	assert.Equal(t, []string{"Kids"}, kids.filters("INCLUDE_GROUPS"))
+
+	bar := newProfileSettings("sports-bar")
+	assert.Equal(t, "title", bar.getenv("SORTING_KEY"))
+	assert.Equal(t, []string{"News", "Sports"}, bar.filters("INCLUDE_GROUPS"))
+}
+
+func TestProfilePlaylists(t *testing.T) {
+	t.Setenv("PLAYLIST_PROFILES", "kids,sports-bar")
+	t.Setenv("PROFILE_KIDS_INCLUDE_GROUPS_1", "^Kids$")
+	t.Setenv("PROFILE_KIDS_TITLE_REWRITE_1", "^(.+)$ => Kids: $1")
+	t.Setenv("PROFILE_KIDS_CHANNEL_NUMBERING", "true")
+	t.Setenv("PROFILE_SPORTS_BAR_M3U_EXCLUDE_GROUPS_2", "^News$")
+	t.Setenv("PROFILE_SPORTS_BAR_GROUP_ORDER", "Sports|News")
+	t.Setenv("PROFILE_SPORTS_BAR_CHANNEL_NUMBERING", "true")
+	t.Setenv("PROFILE_SPORTS_BAR_CHANNEL_NUMBER_START", "100")
+	processor := runProcessorOn(t,
+		"#EXTM3U\n"+
+			"#EXTINF:-1 group-title=\"News\",CNN\nhttp://example.com/cnn\n"+
+			"#EXTINF:-1 group-title=\"Kids\",Cartoon Network\nhttp://example.com/cn\n"+
+			"#EXTINF:-1 group-title=\"Sports\",ESPN\nhttp://example.com/espn\n",
+		"#EXTM3U\n"+
+			"#EXTINF:-1 group-title=\"Kids\",Disney Channel\nhttp://example.com/disney\n"+
+			"#EXTINF:-1 group-title=\"Sports\",beIN Sports\nhttp://example.com/bein\n"+
+			"#EXTINF:-1 group-title=\"News\",CNN\nhttp://example.com/cnn-2\n")
+
+	readTitles := func(path string) []string {
+		content, err := os.ReadFile(path)
+		require.NoError(t, err)
+
+		var titles []string
+		for _, line := range strings.Split(string(content), "\n") {
+			if strings.HasPrefix(line, "#EXTINF") {
+				titles = append(titles, line[strings.Index(line, "tvg-"):])
+			}
+		}
+		return titles
+	}
+
+	assert.Equal(t, []string{
+		`tvg-group="Sports" group-title="Sports" tvg-name="beIN Sports",beIN Sports`,
+		`tvg-group="Kids" group-title="Kids" tvg-name="Cartoon Network",Cartoon Network`,
+		`tvg-group="News" group-title="News" tvg-name="CNN",CNN`,
+		`tvg-group="Kids" group-title="Kids" tvg-name="Disney Channel",Disney Channel`,
+		`tvg-group="Sports" group-title="Sports" tvg-name="ESPN",ESPN`,
+	}, readTitles(processor.GetResultPath()))
+	assert.Equal(t, 6, processor.GetCount(), "Only the streams of the main playlist are counted")
+
+	paths := processor.GetProfileResultPaths()
+	require.Len(t, paths, 2)
+	assert.Equal(t, config.GetProcessedProfilePath(processor.GetResultPath(), "kids"), paths["kids"])
+
+	assert.Equal(t, []string{
+		`tvg-chno="1" tvg-group="Kids" group-title="Kids" tvg-name="Kids: Cartoon Network",Kids: Cartoon Network`,
+		`tvg-chno="2" tvg-group="Kids" group-title="Kids" tvg-name="Kids: Disney Channel",Kids: Disney Channel`,
+	}, readTitles(paths["kids"]))
+
+	assert.Equal(t, []string{
+		`tvg-chno="100" tvg-group="Sports" group-title="Sports" tvg-name="beIN Sports",beIN Sports`,
+		`tvg-chno="101" tvg-group="Sports" group-title="Sports" tvg-name="ESPN",ESPN`,
+		`tvg-chno="102" tvg-group="News" group-title="News" tvg-name="CNN",CNN`,
+		`tvg-chno="103" tvg-group="Kids" group-title="Kids" tvg-name="Cartoon Network",Cartoon Network`,
+		`tvg-chno="104" tvg-group="Kids" group-title="Kids" tvg-name="Disney Channel",Disney Channel`,
+	}, readTitles(paths["sports-bar"]))
+
+	// The streams of every playlist are indexed once.
+	stream, err := ParseStreamInfoBySlug(EncodeSlug(&StreamInfo{Title: "Kids: Disney Channel", MergeKey: "Disney Channel"}))
+	require.NoError(t, err)
+	assert.Len(t, stream.URLs["2"], 1)
+	stream, err = ParseStreamInfoBySlug(EncodeSlug(&StreamInfo{Title: "CNN"}))
+	require.NoError(t, err)
+	assert.Len(t, stream.URLs["1"], 1)
+	assert.Len(t, stream.URLs["2"], 1)
+
+	latest, err := config.GetLatestProcessedM3UPath()
+	require.NoError(t, err)
+	assert.Equal(t, processor.GetResultPath(), latest)
+}
@@ -0,0 +1,258 @@
+package sourceproc
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"m3u-stream-merger/logger"
+	"m3u-stream-merger/utils"
+)
+
+// Quality tiers of stream URLs, from lowest to highest.
+const (
+	QualitySD  = "sd"
+	QualityHD  = "hd"
+	QualityFHD = "fhd"
+	Quality4K  = "4k"
+)
+
+// qualityProbeTimeout bounds the request made to probe the quality of a URL.
+const qualityProbeTimeout = 5 * time.Second
+
+// qualityProbeWorkers bounds the number of URLs probed at once during a sync.
+const qualityProbeWorkers = 16
+
+// probedQualities holds the probed quality of the URLs of the last syncs.
+var probedQualities = newQualityCache()
+
+type qualityTier struct {
+	name    string
+	aliases []string
+	pattern *regexp.Regexp
+}
+
+// qualityTiers are checked from highest to lowest, so that e.g. "Full HD" is
+// not detected as HD.
+var qualityTiers = []qualityTier{
+	{Quality4K, []string{"uhd", "2160p", "2160"}, qualityTagPattern(`4k|uhd|2160[pi]?`)},
+	{QualityFHD, []string{"fullhd", "1080p", "1080"}, qualityTagPattern(`fhd|full[ _.-]?hd|1080[pi]?`)},
+	{QualityHD, []string{"720p", "720"}, qualityTagPattern(`hd|720[pi]?`)},
+	{QualitySD, []string{"480p", "480", "576p", "576"}, qualityTagPattern(`sd|480[pi]?|576[pi]?`)},
+}
+
+// resolutionRegex matches the resolution of the variants of an HLS playlist.
+var resolutionRegex = regexp.MustCompile(`RESOLUTION=\d+x(\d+)`)
+
+// resolutionSuffixPattern matches a resolution with a p or i marker in a file
+// name, such as "_720p" or "-1080i".
+var resolutionSuffixPattern = qualityTagPattern(`(2160|1080|720|576|480)[pi]`)
+
+// xtreamPathPrefixes are the first path segments of Xtream Codes stream URLs.
+// They are followed by the username and password of the account.
+var xtreamPathPrefixes = []string{"live", "movie", "series", "timeshift"}
+
+// qualityTagPattern matches a tag as a whole word of a title or URL, where
+// underscores, dots and dashes also separate words.
+func qualityTagPattern(tags string) *regexp.Regexp {
+	return regexp.MustCompile(`(?i)(?:^|[^a-z0-9])(?:` + tags + `)(?:$|[^a-z0-9])`)
+}
+
+// ParseQuality returns the quality tier of a value such as "hd", "FHD",
+// "1080p" or "uhd".
+func ParseQuality(value string) (string, bool) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	for _, tier := range qualityTiers {
+		if value == tier.name {
+			return tier.name, true
+		}
+		for _, alias := range tier.aliases {
+			if value == alias {
+				return tier.name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// QualityRank orders quality tiers from 1 (SD) to 4 (4K). Unknown tiers rank
+// 0.
+func QualityRank(quality string) int {
+	for i, tier := range qualityTiers {
+		if tier.name == quality {
+			return len(qualityTiers) - i
+		}
+	}
+	return 0
+}
+
+// detectQuality returns the quality tier tagged in the title, or else hinted
+// in the URL, if any.
+func detectQuality(title, streamURL string) string {
+	for _, tier := range qualityTiers {
+		if tier.pattern.MatchString(title) {
+			return tier.name
+		}
+	}
+	return urlQuality(streamURL)
+}
+
+// urlQuality returns the quality tier hinted in the path of a URL: a
+// resolution with a p or i marker in the file name, such as "cnn_720p.m3u8",
+// or else a directory named after a tier, such as "/720/cnn.ts". The host and
+// the query are ignored, and so are the directories of Xtream Codes URLs,
+// which hold the credentials of the account.
+func urlQuality(streamURL string) string {
+	u, err := url.Parse(streamURL)
+	if err != nil {
+		return ""
+	}
+
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if match := resolutionSuffixPattern.FindStringSubmatch(segments[len(segments)-1]); match != nil {
+		quality, _ := ParseQuality(match[1])
+		return quality
+	}
+
+	directories := segments[:len(segments)-1]
+	if len(directories) > 0 && slices.Contains(xtreamPathPrefixes, strings.ToLower(directories[0])) {
+		return ""
+	}
+	for i := len(directories) - 1; i >= 0; i-- {
+		if quality, ok := ParseQuality(directories[i]); ok {
+			return quality
+		}
+	}
+	return ""
+}
+
+// qualityFromHeight returns the quality tier of a vertical resolution.
+func qualityFromHeight(height int) string {
+	switch {
+	case height >= 2160:
+		return Quality4K
+	case height >= 1080:
+		return QualityFHD
+	case height >= 720:
+		return QualityHD
+	case height > 0:
+		return QualitySD
+	}
+	return ""
+}
+
+// probeQuality reads the HLS playlist at streamURL and returns the quality
+// tier of its highest resolution variant. The request carries the headers of
+// the source and of the stream options, like the requests of the load
+// balancer. Other kinds of streams are not probed.
+func probeQuality(ctx context.Context, streamURL string, m3uIndex string, options *StreamOptions) string {
+	if !strings.Contains(strings.ToLower(streamURL), ".m3u8") {
+		return ""
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, qualityProbeTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, streamURL, nil)
+	if err != nil {
+		return ""
+	}
+	utils.ApplySourceHeaders(req, m3uIndex)
+	options.ApplyHeaders(req)
+
+	resp, err := utils.GetSourceHTTPClient(m3uIndex).Do(req)
+	if err != nil {
+		logger.Default.Debugf("Error probing quality of %s: %v", streamURL, err)
+		return ""
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ""
+	}
+
+	maxHeight := 0
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, 1024*1024))
+	for scanner.Scan() {
+		match := resolutionRegex.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		if height, err := strconv.Atoi(match[1]); err == nil && height > maxHeight {
+			maxHeight = height
+		}
+	}
+
+	return qualityFromHeight(maxHeight)
+}
+
+// probeStreamQuality returns the probed quality of the URL of a freshly parsed
+// stream. The result is cached, so that the URL is not probed again for as
+// long as it stays in its source. Probes cut short by ctx are not cached.
+func probeStreamQuality(ctx context.Context, stream *StreamInfo) string {
+	key := stream.URLKeys[0]
+	if quality, ok := probedQualities.get(key); ok {
+		return quality
+	}
+
+	quality := probeQuality(ctx, stream.SourceURL, stream.SourceM3U, stream.SourceOptions)
+	if ctx.Err() == nil {
+		probedQualities.set(key, quality)
+	}
+	return quality
+}
+
+// qualityCache holds the probed quality of URLs, keyed like URLKeys. URLs
+// found during a sync are kept for the next one, and the others are
+// forgotten.
+type qualityCache struct {
+	mu       sync.Mutex
+	previous map[string]string
+	current  map[string]string
+}
+
+func newQualityCache() *qualityCache {
+	return &qualityCache{
+		previous: make(map[string]string),
+		current:  make(map[string]string),
+	}
+}
+
+func (c *qualityCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if quality, ok := c.current[key]; ok {
+		return quality, true
+	}
+	quality, ok := c.previous[key]
+	if ok {
+		c.current[key] = quality
+	}
+	return quality, ok
+}
+
+func (c *qualityCache) set(key, quality string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current[key] = quality
+}
+
+// rotate forgets the URLs that were not found since the previous rotation.
+// It is called at the end of each sync.
+func (c *qualityCache) rotate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.previous = c.current
+	c.current = make(map[string]string)
+}
@@ -0,0 +1,182 @@
+package sourceproc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectQuality(t *testing.T) {
+	tests := []struct {
+		title string
+		url   string
+		want  string
+	}{
+		{title: "CNN HD", url: "http://example.com/cnn", want: QualityHD},
+		{title: "CNN Full HD", url: "http://example.com/cnn", want: QualityFHD},
+		{title: "CNN [FHD]", url: "http://example.com/cnn", want: QualityFHD},
+		{title: "CNN UHD", url: "http://example.com/cnn", want: Quality4K},
+		{title: "CNN 4K", url: "http://example.com/cnn", want: Quality4K},
+		{title: "CNN SD", url: "http://example.com/cnn", want: QualitySD},
+		{title: "CNN", url: "http://example.com/cnn_1080p.m3u8", want: QualityFHD},
+		{title: "CNN", url: "http://example.com/720/cnn.ts", want: QualityHD},
+		{title: "CNN HD", url: "http://example.com/cnn_2160p.m3u8", want: QualityHD},
+		{title: "HDTV Channel", url: "http://example.com/shdw", want: ""},
+		{title: "CNN", url: "http://example.com/hls/hd/cnn/index.m3u8", want: QualityHD},
+		{title: "CNN", url: "http://example.com/cnn-1080i.ts?token=abc", want: QualityFHD},
+		{title: "CNN", url: "http://example.com/live/user/pass/720.ts", want: ""},
+		{title: "CNN", url: "http://example.com/live/u/p/1080.ts", want: ""},
+		{title: "CNN", url: "http://example.com/live/hd/pass/123.ts", want: ""},
+		{title: "CNN", url: "http://example.com/movie/user/sd/456.mkv", want: ""},
+		{title: "CNN", url: "http://example.com/user/pass/720.ts", want: ""},
+		{title: "CNN", url: "http://sd.provider.tv/cnn.m3u8", want: ""},
+		{title: "CNN", url: "http://example.com/cnn.m3u8?quality=hd", want: ""},
+		{title: "CNN", url: "http://example.com/cnn_hd.m3u8", want: ""},
+		{title: "CNN", url: "http://example.com/cnn", want: ""},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, detectQuality(tt.title, tt.url), "%s %s", tt.title, tt.url)
+	}
+
+	for value, want := range map[string]string{"HD": QualityHD, "1080p": QualityFHD, "uhd": Quality4K, "576": QualitySD} {
+		quality, ok := ParseQuality(value)
+		assert.True(t, ok, value)
+		assert.Equal(t, want, quality, value)
+	}
+	_, ok := ParseQuality("ultra")
+	assert.False(t, ok)
+
+	assert.Less(t, QualityRank(QualitySD), QualityRank(QualityHD))
+	assert.Less(t, QualityRank(QualityFHD), QualityRank(Quality4K))
+}
+
+func TestProbeQuality(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("#EXTM3U\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360\nlow.m3u8\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1920x1080\nhigh.m3u8\n"))
+	}))
+	defer server.Close()
+
+	assert.Equal(t, QualityFHD, probeQuality(context.Background(), server.URL+"/master.m3u8", "1", nil))
+	assert.Equal(t, "", probeQuality(context.Background(), server.URL+"/stream.ts", "1", nil))
+}
+
+func TestProbeQualityStreamHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") != "VLC/3.0" || r.Header.Get("Referer") != "http://portal.example.com/" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1280x720\nhigh.m3u8\n"))
+	}))
+	defer server.Close()
+
+	options := &StreamOptions{VLCOpts: []string{"http-user-agent=VLC/3.0", "http-referrer=http://portal.example.com/"}}
+	assert.Equal(t, "", probeQuality(context.Background(), server.URL+"/cnn.m3u8", "1", nil))
+	assert.Equal(t, QualityHD, probeQuality(context.Background(), server.URL+"/cnn.m3u8", "1", options))
+}
+
+func TestProbeStreamQuality(t *testing.T) {
+	probedQualities = newQualityCache()
+	defer func() { probedQualities = newQualityCache() }()
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		_, _ = w.Write([]byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1280x720\nhigh.m3u8\n"))
+	}))
+	defer server.Close()
+
+	stream := &StreamInfo{SourceM3U: "1", SourceURL: server.URL + "/cnn.m3u8", URLKeys: []string{"1|cnn"}}
+
+	// Probes cut short by a cancelled sync are not cached.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, "", probeStreamQuality(ctx, stream))
+	assert.Equal(t, int32(0), requests.Load())
+
+	assert.Equal(t, QualityHD, probeStreamQuality(context.Background(), stream))
+	assert.Equal(t, QualityHD, probeStreamQuality(context.Background(), stream))
+	assert.Equal(t, int32(1), requests.Load(), "URLs are probed once per sync")
+
+	// URLs found during a sync are kept for the next one.
+	probedQualities.rotate()
+	assert.Equal(t, QualityHD, probeStreamQuality(context.Background(), stream))
+	assert.Equal(t, int32(1), requests.Load(), "URLs are probed once across syncs")
+
+	// URLs missing from a sync are probed again.
+	probedQualities.rotate()
+	probedQualities.rotate()
+	assert.Equal(t, QualityHD, probeStreamQuality(context.Background(), stream))
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestQualityProbeDuringSync(t *testing.T) {
+	probedQualities = newQualityCache()
+	defer func() { probedQualities = newQualityCache() }()
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		_, _ = w.Write([]byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1920x1080\nhigh.m3u8\n"))
+	}))
+	defer server.Close()
+
+	t.Setenv("QUALITY_PROBE", "true")
+	setupSources(t, "#EXTM3U\n"+
+		"#EXTINF:-1,CNN\n"+server.URL+"/cnn.m3u8\n"+
+		"#EXTINF:-1,BBC\n"+server.URL+"/bbc.m3u8\n"+
+		"#EXTINF:-1,ESPN HD\n"+server.URL+"/espn.m3u8\n")
+
+	runTestProcessor(t)
+	assert.Equal(t, int32(2), requests.Load(), "URLs with a tagged quality are not probed")
+
+	for title, want := range map[string]string{"CNN": QualityFHD, "ESPN HD": QualityHD} {
+		stream, err := ParseStreamInfoBySlug(EncodeSlug(&StreamInfo{Title: title}))
+		require.NoError(t, err)
+		require.Len(t, stream.URLQualities["1"], 1, title)
+		for _, quality := range stream.URLQualities["1"] {
+			assert.Equal(t, want, quality, title)
+		}
+	}
+
+	runTestProcessor(t)
+	assert.Equal(t, int32(2), requests.Load(), "URLs are not probed again on the next sync")
+}
+
+func TestStreamQualityIndex(t *testing.T) {
+	setupTestConfig(t)
+	t.Setenv("M3U_URL_1", "http://example.com/1.m3u")
+
+	hd := parseLine(`#EXTINF:-1,CNN`, &LineDetails{Content: "http://example.com/hd/cnn", LineNum: 2}, "1", nil)
+	require.NotNil(t, hd)
+	sd := parseLine(`#EXTINF:-1,CNN`, &LineDetails{Content: "http://example.com/sd/cnn", LineNum: 4}, "1",
+		&StreamOptions{VLCOpts: []string{"http-user-agent=Test"}})
+	require.NotNil(t, sd)
+	unknown := parseLine(`#EXTINF:-1,CNN`, &LineDetails{Content: "http://example.com/cnn", LineNum: 6}, "1", nil)
+	require.NotNil(t, unknown)
+
+	stream, err := ParseStreamInfoBySlug(EncodeSlug(&StreamInfo{Title: "CNN"}))
+	require.NoError(t, err)
+	require.Len(t, stream.URLs["1"], 3)
+
+	qualities := make(map[string]string)
+	for subIndex, url := range stream.URLs["1"] {
+		qualities[url] = stream.URLQualities["1"][subIndex]
+		if url == "4:::http://example.com/sd/cnn" {
+			assert.NotNil(t, stream.URLOptions["1"][subIndex], "Options should be kept along with the quality")
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"2:::http://example.com/hd/cnn": QualityHD,
+		"4:::http://example.com/sd/cnn": QualitySD,
+		"6:::http://example.com/cnn":    "",
+	}, qualities)
+}
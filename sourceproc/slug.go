@@ -42,8 +42,24 @@ func init() {
 	}
 }
 
+// slugStreamInfo returns the part of the stream that is encoded into its
+// slug. URLs and their options are looked up from the streams index instead.
+func slugStreamInfo(stream *StreamInfo) *StreamInfo {
+	return &StreamInfo{
+		Title:       stream.Title,
+		MergeKey:    stream.MergeKey,
+		TvgID:       stream.TvgID,
+		TvgChNo:     stream.TvgChNo,
+		TvgType:     stream.TvgType,
+		LogoURL:     stream.LogoURL,
+		Group:       stream.Group,
+		SourceM3U:   stream.SourceM3U,
+		SourceIndex: stream.SourceIndex,
+	}
+}
+
 func EncodeSlug(stream *StreamInfo) string {
-	jsonData, err := json.Marshal(stream)
+	jsonData, err := json.Marshal(slugStreamInfo(stream))
 	if err != nil {
 		logger.Default.Debugf("Error json marshal for slug: %v", err)
 		return ""
@@ -87,5 +103,16 @@ func DecodeSlug(encodedSlug string) (*StreamInfo, error) {
 	}
 
 	result.URLs = make(map[string]map[string]string)
+	result.URLOptions = make(map[string]map[string]*StreamOptions)
+	result.URLQualities = make(map[string]map[string]string)
 	return &result, nil
 }
+
+// SlugKey returns the key the stream of a slug is merged and indexed on.
+func SlugKey(slug string) (string, error) {
+	stream, err := DecodeSlug(slug)
+	if err != nil {
+		return "", err
+	}
+	return stream.indexKey(), nil
+}
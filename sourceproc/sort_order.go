@@ -0,0 +1,159 @@
+package sourceproc
+
+import (
+	"fmt"
+	"strings"
+
+	"m3u-stream-merger/logger"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+// sourceOrderKey keeps the order of the channels in their source, sources
+// being ordered by M3U index.
+const sourceOrderKey = "source-order"
+
+type sortKey struct {
+	field       filterField
+	sourceOrder bool
+	desc        bool
+}
+
+// streamSorter orders the channels of the merged playlist by the keys of
+// SORTING_KEY, a comma separated list such as "group,chno:desc,title". Keys
+// without a direction use SORTING_DIRECTION. Values are compared with a
+// numeric-aware, case-insensitive collation, so "Channel 2" comes before
+// "Channel 10". With GROUP_ORDER, channels are ordered by group first.
+type streamSorter struct {
+	keys     []sortKey
+	groups   *groupOrder
+	collator *collate.Collator
+}
+
+func newStreamSorter(s profileSettings) (*streamSorter, error) {
+	defaultDesc := false
+	switch direction := strings.ToLower(strings.TrimSpace(s.getenv("SORTING_DIRECTION"))); direction {
+	case "", "asc":
+	case "desc":
+		defaultDesc = true
+	default:
+		return nil, fmt.Errorf("invalid SORTING_DIRECTION: %q", direction)
+	}
+
+	tag := language.Und
+	if locale := strings.TrimSpace(s.getenv("SORTING_LOCALE")); locale != "" {
+		parsed, err := language.Parse(locale)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SORTING_LOCALE: %v", err)
+		}
+		tag = parsed
+	}
+
+	groups, err := newGroupOrder(s)
+	if err != nil {
+		return nil, err
+	}
+
+	sorter := &streamSorter{
+		groups:   groups,
+		collator: collate.New(tag, collate.Numeric, collate.IgnoreCase),
+	}
+
+	sortingKey := strings.TrimSpace(s.getenv("SORTING_KEY"))
+	if sortingKey == "" {
+		sortingKey = "title"
+	}
+
+	for _, item := range strings.Split(sortingKey, ",") {
+		name, direction, _ := strings.Cut(strings.TrimSpace(item), ":")
+		name = strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), "_", "-")
+
+		key := sortKey{desc: defaultDesc}
+		switch strings.ToLower(strings.TrimSpace(direction)) {
+		case "":
+		case "asc":
+			key.desc = false
+		case "desc":
+			key.desc = true
+		default:
+			return nil, fmt.Errorf("invalid SORTING_KEY: unknown direction %q for %q", direction, name)
+		}
+
+		switch {
+		case name == sourceOrderKey:
+			key.sourceOrder = true
+		case name == "channel-id", name == "channel-number":
+			key.field = filterFields["tvg-chno"]
+		default:
+			field, ok := lookupFilterField(name)
+			if !ok {
+				return nil, fmt.Errorf("invalid SORTING_KEY: unknown key %q", name)
+			}
+			key.field = field
+		}
+
+		sorter.keys = append(sorter.keys, key)
+	}
+
+	return sorter, nil
+}
+
+// compileStreamSorter compiles the sorting settings of a playlist for a sync.
+// Without them, the playlist is sorted by title, naturally and ignoring case,
+// regardless of GROUP_ORDER and SORTING_LOCALE.
+func compileStreamSorter(s profileSettings) *streamSorter {
+	sorter, err := newStreamSorter(s)
+	if err != nil {
+		logger.Default.Errorf("Sorting by title instead: %v", err)
+		return &streamSorter{
+			keys:     []sortKey{{field: filterFields["title"]}},
+			collator: collate.New(language.Und, collate.Numeric, collate.IgnoreCase),
+		}
+	}
+	return sorter
+}
+
+// compare orders two streams by group order, then by each key in turn.
+// Streams that are equal on every key are ordered by title, then by their
+// position in the sources, so that the order is the same on every sync.
+func (s *streamSorter) compare(a, b *StreamInfo) int {
+	if s.groups != nil {
+		if result := s.groups.rank(a.Group) - s.groups.rank(b.Group); result != 0 {
+			return result
+		}
+	}
+
+	for _, key := range s.keys {
+		var result int
+		if key.sourceOrder {
+			result = compareSourceOrder(a, b)
+		} else {
+			result = s.collator.CompareString(key.field(a), key.field(b))
+		}
+		if key.desc {
+			result = -result
+		}
+		if result != 0 {
+			return result
+		}
+	}
+
+	if result := s.collator.CompareString(a.Title, b.Title); result != 0 {
+		return result
+	}
+	return compareSourceOrder(a, b)
+}
+
+// compareSourceOrder orders streams by M3U index, then by line number.
+func compareSourceOrder(a, b *StreamInfo) int {
+	candidateA := fieldCandidate{Source: a.SourceM3U, Index: a.SourceIndex}
+	candidateB := fieldCandidate{Source: b.SourceM3U, Index: b.SourceIndex}
+	switch {
+	case defaultMergePolicies.less(candidateA, candidateB):
+		return -1
+	case defaultMergePolicies.less(candidateB, candidateA):
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,91 @@
+package sourceproc
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamSorter(t *testing.T) {
+	streams := []*StreamInfo{
+		{Title: "Channel 10", Group: "News", TvgChNo: "3", SourceM3U: "2", SourceIndex: 2},
+		{Title: "channel 2", Group: "Sports", TvgChNo: "12", SourceM3U: "1", SourceIndex: 6},
+		{Title: "Émission", Group: "News", TvgChNo: "1", SourceM3U: "1", SourceIndex: 4},
+		{Title: "Channel 1", Group: "Sports", TvgChNo: "2", SourceM3U: "10", SourceIndex: 2},
+		{Title: "Zoo", Group: "Kids", TvgChNo: "12", SourceM3U: "1", SourceIndex: 2},
+	}
+
+	tests := []struct {
+		name      string
+		key       string
+		direction string
+		want      []string
+	}{
+		{
+			name: "natural title order",
+			want: []string{"Channel 1", "channel 2", "Channel 10", "Émission", "Zoo"},
+		},
+		{
+			name:      "default direction",
+			direction: "desc",
+			want:      []string{"Zoo", "Émission", "Channel 10", "channel 2", "Channel 1"},
+		},
+		{
+			name: "numeric channel numbers",
+			key:  "tvg-chno",
+			want: []string{"Émission", "Channel 1", "Channel 10", "channel 2", "Zoo"},
+		},
+		{
+			name: "multiple keys with their own direction",
+			key:  "group,chno:desc,title",
+			want: []string{"Zoo", "Channel 10", "Émission", "channel 2", "Channel 1"},
+		},
+		{
+			name: "source order",
+			key:  "source-order",
+			want: []string{"Zoo", "Émission", "channel 2", "Channel 10", "Channel 1"},
+		},
+		{
+			name: "group then source order",
+			key:  "group:desc,source-order",
+			want: []string{"channel 2", "Channel 1", "Émission", "Channel 10", "Zoo"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SORTING_KEY", tt.key)
+			t.Setenv("SORTING_DIRECTION", tt.direction)
+
+			sorter, err := newStreamSorter(defaultSettings)
+			require.NoError(t, err)
+
+			sorted := append([]*StreamInfo(nil), streams...)
+			sort.Slice(sorted, func(i, j int) bool {
+				return sorter.compare(sorted[i], sorted[j]) < 0
+			})
+
+			var titles []string
+			for _, stream := range sorted {
+				titles = append(titles, stream.Title)
+			}
+			assert.Equal(t, tt.want, titles)
+		})
+	}
+}
+
+func TestStreamSorterValidation(t *testing.T) {
+	t.Setenv("SORTING_KEY", "group,rating")
+	assert.ErrorContains(t, ValidateSettings(), `invalid SORTING_KEY: unknown key "rating"`)
+
+	t.Setenv("SORTING_KEY", "group:up")
+	assert.ErrorContains(t, ValidateSettings(), `invalid SORTING_KEY: unknown direction "up" for "group"`)
+
+	t.Setenv("SORTING_KEY", "tvg-group:desc,channel-number,attr.tvg-country")
+	assert.NoError(t, ValidateSettings())
+
+	t.Setenv("SORTING_LOCALE", "not a locale")
+	assert.ErrorContains(t, ValidateSettings(), "invalid SORTING_LOCALE")
+}
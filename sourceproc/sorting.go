@@ -7,8 +7,8 @@ import (
 	"m3u-stream-merger/logger"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
 
@@ -21,18 +21,19 @@ const (
 )
 
 type SortingManager struct {
-	muxes      []*sync.Mutex       // Sharded mutexes
-	indexes    []map[string]bool   // In-memory existence checks
-	buffers    []map[string][]byte // Buffered writes
-	sortingKey string
-	sortingDir string
-	basePath   string
+	muxes    []*sync.Mutex       // Sharded mutexes
+	indexes  []map[string]bool   // In-memory existence checks
+	buffers  []map[string][]byte // Buffered writes
+	sorter   *streamSorter
+	basePath string
+	policies *mergePolicies
 }
 
-func newSortingManager() *SortingManager {
-	sortingKey := os.Getenv("SORTING_KEY")
-	sortingDir := strings.ToLower(os.Getenv("SORTING_DIRECTION"))
+func newSortingManager(s profileSettings) *SortingManager {
 	basePath := config.GetSortDirPath()
+	if s.profile != "" {
+		basePath = config.GetProfileSortDirPath(s.profile)
+	}
 
 	if err := os.MkdirAll(basePath, 0755); err != nil {
 		logger.Default.Error(err.Error())
@@ -49,20 +50,20 @@ func newSortingManager() *SortingManager {
 	}
 
 	return &SortingManager{
-		muxes:      muxes,
-		indexes:    indexes,
-		buffers:    buffers,
-		sortingKey: sortingKey,
-		sortingDir: sortingDir,
-		basePath:   basePath,
+		muxes:    muxes,
+		indexes:  indexes,
+		buffers:  buffers,
+		sorter:   compileStreamSorter(s),
+		basePath: basePath,
+		policies: compileMergePolicies(),
 	}
 }
 
 func (m *SortingManager) AddToSorter(s *StreamInfo) error {
-	titleHash := xxhash.Sum64String(s.Title)
+	titleHash := xxhash.Sum64String(s.indexKey())
 	shardIndex := titleHash % mutexShards
 	mutex := m.muxes[shardIndex]
-	sanitizedTitle := sanitizeField(s.Title)
+	sanitizedTitle := sanitizeField(s.indexKey())
 
 	mutex.Lock()
 	defer mutex.Unlock()
@@ -101,11 +102,24 @@ func (m *SortingManager) AddToSorter(s *StreamInfo) error {
 }
 
 func (m *SortingManager) Close() {
-	basePath := config.GetSortDirPath()
-	os.RemoveAll(basePath)
+	os.RemoveAll(m.basePath)
 }
 
 func (m *SortingManager) handleExisting(shardIndex uint64, title string, s *StreamInfo) error {
+	// Merge into the buffered entry if it was not flushed yet
+	if data, buffered := m.buffers[shardIndex][title]; buffered {
+		var existing StreamInfo
+		if err := json.Unmarshal(data, &existing); err != nil {
+			return fmt.Errorf("failed to unmarshal StreamInfo: %w", err)
+		}
+		encoded, err := json.Marshal(mergeStreamInfoAttributes(&existing, s))
+		if err != nil {
+			return fmt.Errorf("failed to marshal StreamInfo: %w", err)
+		}
+		m.buffers[shardIndex][title] = encoded
+		return nil
+	}
+
 	// Read existing entries
 	entries, err := m.readShard(shardIndex)
 	if err != nil {
@@ -213,11 +227,7 @@ func (m *SortingManager) GetSortedEntries(callback func(*StreamInfo)) error {
 	}
 
 	// Collect all entries from all shards
-	type shardEntry struct {
-		key   string
-		value *StreamInfo
-	}
-	entries := make([]shardEntry, 0, 1_000_000) // Preallocate for 1M entries
+	entries := make([]*StreamInfo, 0, 1_000_000) // Preallocate for 1M entries
 
 	// Read and parse all shard files
 	for shardIndex := uint64(0); shardIndex < mutexShards; shardIndex++ {
@@ -240,63 +250,28 @@ func (m *SortingManager) GetSortedEntries(callback func(*StreamInfo)) error {
 
 		// Convert map to sortable slice
 		for _, stream := range shardData {
-			entries = append(entries, shardEntry{
-				key:   getSortKey(stream, m.sortingKey, m.sortingDir),
-				value: stream,
-			})
+			m.policies.resolve(stream)
+			entries = append(entries, stream)
 		}
 	}
 
 	// Sort the entries
 	sort.Slice(entries, func(i, j int) bool {
-		return entries[i].key < entries[j].key
+		return m.sorter.compare(entries[i], entries[j]) < 0
 	})
 
 	// Execute callback in sorted order
 	for _, entry := range entries {
-		callback(entry.value)
+		callback(entry)
 	}
 
 	return nil
 }
 
-// Helper to replicate the filename-based sorting logic
-func getSortKey(s *StreamInfo, sortingKey, direction string) string {
-	switch sortingKey {
-	case "tvg-id":
-		return normalizeNumericField(s.TvgID, 10, direction)
-	case "tvg-chno", "channel-id", "channel-number":
-		return normalizeNumericField(s.TvgChNo, 10, direction)
-	case "tvg-group", "group-title":
-		return normalizeStringField(s.Group, direction)
-	case "tvg-type":
-		return normalizeStringField(s.TvgType, direction)
-	case "source":
-		return normalizeNumericField(s.SourceM3U, 5, direction)
-	default: // Title
-		return normalizeStringField(s.Title, direction)
-	}
-}
-
 func mergeStreamInfoAttributes(base, new *StreamInfo) *StreamInfo {
-	if base.Title == "" {
-		base.Title = new.Title
-	}
-	if base.TvgID == "" {
-		base.TvgID = new.TvgID
-	}
-	if base.TvgChNo == "" {
-		base.TvgChNo = new.TvgChNo
-	}
-	if base.TvgType == "" {
-		base.TvgType = new.TvgType
-	}
-	if base.LogoURL == "" {
-		base.LogoURL = new.LogoURL
-	}
-	if base.Group == "" {
-		base.Group = new.Group
-	}
+	// The configured merge policies are applied once all streams are merged
+	base.addCandidates(new)
+	defaultMergePolicies.resolve(base)
 
 	if base.URLs == nil {
 		base.URLs = make(map[string]map[string]string)
@@ -311,35 +286,49 @@ func mergeStreamInfoAttributes(base, new *StreamInfo) *StreamInfo {
 		}
 	}
 
-	if new.SourceM3U < base.SourceM3U || (new.SourceM3U == base.SourceM3U && new.SourceIndex < base.SourceIndex) {
-		base.SourceM3U = new.SourceM3U
-		base.SourceIndex = new.SourceIndex
+	for _, key := range new.URLKeys {
+		if !slices.Contains(base.URLKeys, key) {
+			base.URLKeys = append(base.URLKeys, key)
+		}
 	}
 
-	return base
-}
-
-func normalizeNumericField(value string, width int, direction string) string {
-	num, err := strconv.Atoi(value)
-	if err != nil {
-		return sanitizeField(value)
+	for key, value := range new.URLOptions {
+		if base.URLOptions == nil {
+			base.URLOptions = make(map[string]map[string]*StreamOptions)
+		}
+		if _, exists := base.URLOptions[key]; !exists {
+			base.URLOptions[key] = value
+		} else {
+			for subKey, subValue := range value {
+				base.URLOptions[key][subKey] = subValue
+			}
+		}
 	}
-	if direction == "desc" {
-		maxValue := int64(1<<31 - 1) // Use a large constant (e.g., max int32)
-		return fmt.Sprintf("%0*d", width, maxValue-int64(num))
+
+	for key, value := range new.URLQualities {
+		if base.URLQualities == nil {
+			base.URLQualities = make(map[string]map[string]string)
+		}
+		if _, exists := base.URLQualities[key]; !exists {
+			base.URLQualities[key] = value
+		} else {
+			for subKey, subValue := range value {
+				base.URLQualities[key][subKey] = subValue
+			}
+		}
 	}
-	return fmt.Sprintf("%0*d", width, num)
-}
 
-func normalizeStringField(value, direction string) string {
-	if direction == "desc" {
-		return reverseLexicographical(value)
+	if defaultMergePolicies.less(
+		fieldCandidate{Source: new.SourceM3U, Index: new.SourceIndex},
+		fieldCandidate{Source: base.SourceM3U, Index: base.SourceIndex},
+	) {
+		base.SourceM3U = new.SourceM3U
+		base.SourceIndex = new.SourceIndex
+		base.SourceURL = new.SourceURL
+		base.SourceOptions = new.SourceOptions
 	}
-	return sanitizeField(value)
-}
 
-func reverseLexicographical(value string) string {
-	return fmt.Sprintf("~%s", value)
+	return base
 }
 
 func sanitizeField(value string) string {
@@ -0,0 +1,127 @@
+package sourceproc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errNotModified = errors.New("source not modified")
+
+// sourceMeta is stored next to each cached source and is used for
+// conditional requests and for detecting truncated downloads.
+type sourceMeta struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Entries      int    `json:"entries"`
+}
+
+func sourceMetaPath(sourcePath string) string {
+	return sourcePath + ".meta"
+}
+
+func loadSourceMeta(sourcePath string) sourceMeta {
+	var meta sourceMeta
+
+	data, err := os.ReadFile(sourceMetaPath(sourcePath))
+	if err != nil {
+		return meta
+	}
+	_ = json.Unmarshal(data, &meta)
+
+	return meta
+}
+
+func saveSourceMeta(sourcePath string, meta sourceMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(sourceMetaPath(sourcePath), data, 0644)
+}
+
+// isTruncated reports whether a download with the given number of entries
+// should be rejected in favour of the last good copy.
+func isTruncated(entries, previousEntries int) bool {
+	if entries == 0 {
+		return true
+	}
+
+	threshold, err := truncationThreshold()
+	if err != nil {
+		threshold = 50
+	}
+
+	return previousEntries > 0 && entries*100 < previousEntries*threshold
+}
+
+// truncationThreshold returns the TRUNCATION_THRESHOLD percentage. Values
+// above 100 would reject every download that doesn't grow the source.
+func truncationThreshold() (int, error) {
+	value, ok := os.LookupEnv("TRUNCATION_THRESHOLD")
+	if !ok || value == "" {
+		return 50, nil
+	}
+
+	threshold, err := strconv.Atoi(value)
+	if err != nil || threshold < 0 || threshold > 100 {
+		return 0, fmt.Errorf("invalid TRUNCATION_THRESHOLD: %q, must be from 0 to 100", value)
+	}
+	return threshold, nil
+}
+
+const (
+	SourceStatusDownloaded     = "downloaded"
+	SourceStatusNotModified    = "not-modified"
+	SourceStatusCachedFallback = "cached-fallback"
+	SourceStatusCached         = "cached"
+	SourceStatusLocal          = "local"
+	SourceStatusFailed         = "failed"
+)
+
+// SourceStatus describes how a source was obtained during the last sync.
+type SourceStatus struct {
+	Status        string    `json:"status"`
+	Error         string    `json:"error,omitempty"`
+	ParseWarnings int       `json:"parse_warnings,omitempty"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+var sourceStatuses sync.Map // map[string]SourceStatus
+
+func recordSourceStatus(idx string, status string, err error) {
+	sourceStatus := SourceStatus{
+		Status:    status,
+		UpdatedAt: time.Now(),
+	}
+	if err != nil {
+		sourceStatus.Error = err.Error()
+	}
+	sourceStatuses.Store(idx, sourceStatus)
+}
+
+// recordParseWarnings adds the number of parse warnings to the status of
+// the last sync of a source.
+func recordParseWarnings(idx string, warnings int) {
+	value, ok := sourceStatuses.Load(idx)
+	if !ok {
+		return
+	}
+	sourceStatus := value.(SourceStatus)
+	sourceStatus.ParseWarnings = warnings
+	sourceStatuses.Store(idx, sourceStatus)
+}
+
+// GetSourceStatuses returns how each source was obtained during the last sync.
+func GetSourceStatuses() map[string]SourceStatus {
+	statuses := make(map[string]SourceStatus)
+	sourceStatuses.Range(func(key, value any) bool {
+		statuses[key.(string)] = value.(SourceStatus)
+		return true
+	})
+	return statuses
+}
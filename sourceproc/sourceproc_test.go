@@ -97,6 +97,7 @@ http://example.com/vevo
 	os.Setenv("M3U_URL_1", fmt.Sprintf("file://%s", m3uPath1))
 	os.Setenv("M3U_URL_2", fmt.Sprintf("file://%s", m3uPath2))
 	os.Setenv("M3U_URL_3", fmt.Sprintf("file://%s", m3uPath3))
+	utils.ResetCaches()
 
 	return func() {
 		testDataLock.Lock()
@@ -113,6 +114,76 @@ http://example.com/vevo
 	}
 }
 
+// setupTestConfig keeps the data of the test in a temporary directory, which
+// it returns, and resets the caches, until the end of the test.
+func setupTestConfig(t *testing.T) string {
+	t.Helper()
+
+	tempDir := t.TempDir()
+	originalConfig := config.GetConfig()
+	config.SetConfig(&config.Config{
+		DataPath: filepath.Join(tempDir, "data"),
+		TempPath: filepath.Join(tempDir, "temp"),
+	})
+	t.Cleanup(func() { config.SetConfig(originalConfig) })
+
+	utils.ResetCaches()
+	t.Cleanup(utils.ResetCaches)
+	return tempDir
+}
+
+// setupSources writes the content of each source to a file and points
+// M3U_URL_1, M3U_URL_2, ... at them, in order. The data of the syncs is kept
+// in a temporary directory until the end of the test.
+func setupSources(t *testing.T, sources ...string) {
+	t.Helper()
+
+	tempDir := setupTestConfig(t)
+	for i, source := range sources {
+		path := filepath.Join(tempDir, fmt.Sprintf("source-%d.m3u", i+1))
+		require.NoError(t, os.WriteFile(path, []byte(source), 0644))
+		t.Setenv(fmt.Sprintf("M3U_URL_%d", i+1), "file://"+path)
+	}
+}
+
+// runTestProcessor runs a sync of the sources set up by setupSources.
+func runTestProcessor(t *testing.T, opts ...ProcessorOption) *M3UProcessor {
+	t.Helper()
+
+	processor := NewProcessor(opts...)
+	require.NotNil(t, processor)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, processor.Run(ctx, httptest.NewRequest(http.MethodGet, "http://example.com", nil)))
+	return processor
+}
+
+// runProcessorOn runs a sync of the given sources.
+func runProcessorOn(t *testing.T, sources ...string) *M3UProcessor {
+	t.Helper()
+
+	setupSources(t, sources...)
+	return runTestProcessor(t)
+}
+
+// playlistTitles returns the titles of the channels of a processed M3U, in
+// order.
+func playlistTitles(t *testing.T, path string) []string {
+	t.Helper()
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	var titles []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, "#EXTINF") {
+			titles = append(titles, line[strings.LastIndex(line, ",")+1:])
+		}
+	}
+	return titles
+}
+
 type testStreamInfo struct {
 	group string
 	chno  string
@@ -359,27 +430,27 @@ func TestSortingVariations(t *testing.T) {
 func TestMergeAttributesToM3UFile(t *testing.T) {
 	m3u1 := `#EXTINF:-1 tvg-chno="010",First Channel`
 	url1 := "http://example.com/source1"
-	s1 := parseLine(m3u1, &LineDetails{Content: url1, LineNum: 1}, "M3U_Test")
+	s1 := parseLine(m3u1, &LineDetails{Content: url1, LineNum: 1}, "M3U_Test", nil)
 	require.NotNil(t, s1, "Failed to parse source 1")
 
 	m3u2 := `#EXTINF:-1 tvg-id="id-2" tvg-chno="010" tvg-name="First Channel" tvg-type="type-2",First Channel`
 	url2 := "http://example.com/source2"
-	s2 := parseLine(m3u2, &LineDetails{Content: url2, LineNum: 2}, "M3U_Test")
+	s2 := parseLine(m3u2, &LineDetails{Content: url2, LineNum: 2}, "M3U_Test", nil)
 	require.NotNil(t, s2, "Failed to parse source 2")
 
 	m3u3 := `#EXTINF:-1 tvg-chno="010" tvg-name="First Channel" group-title="Group-3",First Channel`
 	url3 := "http://example.com/source3"
-	s3 := parseLine(m3u3, &LineDetails{Content: url3, LineNum: 3}, "M3U_Test")
+	s3 := parseLine(m3u3, &LineDetails{Content: url3, LineNum: 3}, "M3U_Test", nil)
 	require.NotNil(t, s3, "Failed to parse source 3")
 
 	m3u4 := `#EXTINF:-1 tvg-chno="010" tvg-name="First Channel" tvg-logo="http://logo/source4.png",First Channel`
 	url4 := "http://example.com/source4"
-	s4 := parseLine(m3u4, &LineDetails{Content: url4, LineNum: 4}, "M3U_Test")
+	s4 := parseLine(m3u4, &LineDetails{Content: url4, LineNum: 4}, "M3U_Test", nil)
 	require.NotNil(t, s4, "Failed to parse source 4")
 
 	m3u5 := `#EXTINF:-1 tvg-id="id-5" tvg-chno="010" tvg-name="First Channel",First Channel`
 	url5 := "http://example.com/source5"
-	s5 := parseLine(m3u5, &LineDetails{Content: url5, LineNum: 5}, "M3U_Test")
+	s5 := parseLine(m3u5, &LineDetails{Content: url5, LineNum: 5}, "M3U_Test", nil)
 	require.NotNil(t, s5, "Failed to parse source 5")
 
 	s1 = mergeStreamInfoAttributes(s1, s2)
@@ -415,3 +486,58 @@ func TestMergeAttributesToM3UFile(t *testing.T) {
 	assert.Contains(t, contentStr, `tvg-type="type-2"`, "Should contain tvg-type from merged attributes")
 	assert.Contains(t, contentStr, `tvg-logo="http://logo/source4.png"`, "Should contain tvg-logo from merged attributes")
 }
+
+func TestMergeExtraAttributes(t *testing.T) {
+	m3u1 := `#EXTINF:-1 tvg-id="id-1" catchup="shift" catchup-days="7" tvg-shift="0",Radio One`
+	s1 := parseLine(m3u1, &LineDetails{Content: "http://example.com/radio1", LineNum: 1}, "M3U_Test", nil)
+	require.NotNil(t, s1, "Failed to parse source 1")
+
+	m3u2 := `#EXTINF:-1 catchup="append" catchup-source="?utc={utc}" radio="true" TVG-Country="UK",Radio One`
+	s2 := parseLine(m3u2, &LineDetails{Content: "http://example.com/radio2", LineNum: 2}, "M3U_Test", nil)
+	require.NotNil(t, s2, "Failed to parse source 2")
+
+	assert.Equal(t, map[string]string{
+		"catchup":      "shift",
+		"catchup-days": "7",
+		"tvg-shift":    "0",
+	}, s1.Attributes)
+
+	merged := mergeStreamInfoAttributes(s1, s2)
+	assert.Equal(t, "shift", merged.Attributes["catchup"], "First value should win")
+	assert.NotContains(t, merged.Attributes, "catchup-source", "Catch-up attributes should come from a single source")
+	assert.Equal(t, "true", merged.Attributes["radio"])
+	assert.Equal(t, "UK", merged.Attributes["tvg-country"])
+
+	entry := formatStreamEntry("http://dummy", merged)
+	assert.Contains(t, entry, `tvg-name="Radio One" catchup="shift" catchup-days="7" radio="true" tvg-country="UK" tvg-shift="0",Radio One`)
+
+	// Streams without catch-up don't prevent the others from providing it.
+	s3 := parseLine(`#EXTINF:-1 radio="false",Radio One`, &LineDetails{Content: "http://example.com/radio3", LineNum: 1}, "M3U_Other", nil)
+	require.NotNil(t, s3, "Failed to parse source 3")
+	merged = mergeStreamInfoAttributes(s3, s2)
+	assert.Equal(t, map[string]string{
+		"catchup":        "append",
+		"catchup-source": "?utc={utc}",
+		"radio":          "false",
+		"tvg-country":    "UK",
+	}, merged.Attributes)
+
+	slugInfo, err := DecodeSlug(EncodeSlug(merged))
+	require.NoError(t, err)
+	assert.Empty(t, slugInfo.Attributes, "Extra attributes should not be encoded into the slug")
+}
+
+func TestMergeSourceOrderNumeric(t *testing.T) {
+	s2 := parseLine(`#EXTINF:-1,CNN`, &LineDetails{Content: "http://two.example.com/cnn", LineNum: 5}, "2", nil)
+	require.NotNil(t, s2, "Failed to parse source 2")
+	s10 := parseLine(`#EXTINF:-1,CNN`, &LineDetails{Content: "http://ten.example.com/cnn", LineNum: 1}, "10", nil)
+	require.NotNil(t, s10, "Failed to parse source 10")
+
+	for _, merged := range []*StreamInfo{
+		mergeStreamInfoAttributes(s2.clone(), s10.clone()),
+		mergeStreamInfoAttributes(s10.clone(), s2.clone()),
+	} {
+		assert.Equal(t, "2", merged.SourceM3U, "Source 2 should come before source 10")
+		assert.Equal(t, 5, merged.SourceIndex)
+	}
+}
@@ -0,0 +1,116 @@
+package sourceproc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"m3u-stream-merger/config"
+	"m3u-stream-merger/logger"
+)
+
+const (
+	// streamIndexPointer is the file in the streams directory that names the
+	// generation lookups are served from.
+	streamIndexPointer = "current"
+	// streamIndexGenPrefix prefixes the directory of every generation.
+	streamIndexGenPrefix = "gen-"
+)
+
+// streamIndexLock is held for reading by lookups for as long as they read
+// from a generation, and for writing while the current generation is
+// swapped. Once the swap holds the lock, no lookup can still be reading from
+// the previous generation, so it can be removed safely.
+var streamIndexLock sync.RWMutex
+
+// currentStreamIndexDir returns the directory of the generation lookups are
+// served from. Indexes written before generations were introduced live
+// directly in the streams directory.
+func currentStreamIndexDir() string {
+	root := config.GetStreamsDirPath()
+
+	data, err := os.ReadFile(filepath.Join(root, streamIndexPointer))
+	if err != nil {
+		return root
+	}
+
+	gen := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(gen, streamIndexGenPrefix) || gen != filepath.Base(gen) {
+		logger.Default.Warnf("Invalid stream index generation %q, using %s", gen, root)
+		return root
+	}
+
+	return filepath.Join(root, gen)
+}
+
+// streamIndexGeneration is the stream index being written by a sync. Every
+// URL seen during the sync is written to it, so URLs that were not refreshed
+// are left behind in older generations and pruned once it is committed.
+type streamIndexGeneration struct {
+	name string
+	dir  string
+}
+
+func newStreamIndexGeneration() (*streamIndexGeneration, error) {
+	name := fmt.Sprintf("%s%d", streamIndexGenPrefix, time.Now().UnixNano())
+	dir := filepath.Join(config.GetStreamsDirPath(), name)
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("error creating stream index generation: %v", err)
+	}
+
+	return &streamIndexGeneration{name: name, dir: dir}, nil
+}
+
+// commit makes the generation the one lookups are served from and removes
+// everything else from the streams directory.
+func (g *streamIndexGeneration) commit() error {
+	root := config.GetStreamsDirPath()
+	pointerPath := filepath.Join(root, streamIndexPointer)
+	tmpPath := pointerPath + ".tmp"
+
+	if err := os.WriteFile(tmpPath, []byte(g.name), 0644); err != nil {
+		return fmt.Errorf("error writing stream index pointer: %v", err)
+	}
+
+	streamIndexLock.Lock()
+	err := os.Rename(tmpPath, pointerPath)
+	streamIndexLock.Unlock()
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("error swapping stream index generation: %v", err)
+	}
+
+	pruned := g.prune(root)
+	logger.Default.Debugf("Stream index generation %s is now current, removed %d stale directories", g.name, pruned)
+
+	return nil
+}
+
+// prune removes older generations as well as shard directories left by the
+// legacy layout.
+func (g *streamIndexGeneration) prune(root string) int {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		logger.Default.Errorf("Error reading stream index directory: %v", err)
+		return 0
+	}
+
+	pruned := 0
+	for _, entry := range entries {
+		if entry.Name() == g.name || entry.Name() == streamIndexPointer {
+			continue
+		}
+
+		if err := os.RemoveAll(filepath.Join(root, entry.Name())); err != nil {
+			logger.Default.Errorf("Error pruning stream index entry %s: %v", entry.Name(), err)
+			continue
+		}
+		pruned++
+	}
+
+	return pruned
+}
@@ -0,0 +1,87 @@
+package sourceproc
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"m3u-stream-merger/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamIndexGarbageCollection(t *testing.T) {
+	playlistPath := filepath.Join(setupTestConfig(t), "playlist.m3u")
+	t.Setenv("M3U_URL_1", "file://"+playlistPath)
+
+	// An entry written by the legacy layout, directly in a shard directory.
+	legacy := parseLine(`#EXTINF:-1,CNN`, &LineDetails{Content: "http://example.com/legacy", LineNum: 1}, "1", nil)
+	require.NotNil(t, legacy)
+	stream, err := ParseStreamInfoBySlug(EncodeSlug(&StreamInfo{Title: "CNN"}))
+	require.NoError(t, err)
+	require.Len(t, stream.URLs["1"], 1)
+
+	runProcessor := func(playlist string) {
+		require.NoError(t, os.WriteFile(playlistPath, []byte(playlist), 0644))
+		runTestProcessor(t)
+	}
+
+	lookupURLs := func() []string {
+		stream, err := ParseStreamInfoBySlug(EncodeSlug(&StreamInfo{Title: "CNN"}))
+		require.NoError(t, err)
+
+		var urls []string
+		for _, url := range stream.URLs["1"] {
+			urls = append(urls, url)
+		}
+		return urls
+	}
+
+	runProcessor("#EXTM3U\n" +
+		"#EXTINF:-1,CNN\nhttp://example.com/cnn-1\n" +
+		"#EXTINF:-1,CNN\nhttp://example.com/cnn-2\n")
+	assert.ElementsMatch(t, []string{"2:::http://example.com/cnn-1", "4:::http://example.com/cnn-2"}, lookupURLs())
+
+	runProcessor("#EXTM3U\n" +
+		"#EXTINF:-1,CNN\nhttp://example.com/cnn-2\n")
+	assert.ElementsMatch(t, []string{"2:::http://example.com/cnn-2"}, lookupURLs())
+
+	// Only the current generation and its pointer are left.
+	entries, err := os.ReadDir(config.GetStreamsDirPath())
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.ElementsMatch(t, []string{streamIndexPointer, filepath.Base(currentStreamIndexDir())}, names)
+
+	// Lookups running during a sync see either generation, never a partial one.
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				stream, err := ParseStreamInfoBySlug(EncodeSlug(&StreamInfo{Title: "CNN"}))
+				if assert.NoError(t, err) {
+					assert.Len(t, stream.URLs["1"], 1)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 3; i++ {
+		runProcessor("#EXTM3U\n" +
+			"#EXTINF:-1,CNN\nhttp://example.com/cnn-2\n")
+	}
+	close(done)
+	wg.Wait()
+}
@@ -1,6 +1,7 @@
 package sourceproc
 
 import (
+	"strings"
 	"sync"
 )
 
@@ -16,4 +17,78 @@ type StreamInfo struct {
 	URLs        map[string]map[string]string `json:"-"`
 	SourceM3U   string                       `json:"source_m3u"`
 	SourceIndex int                          `json:"source_index"`
+
+	// MergeKey is the normalized key the stream was merged on, if it differs
+	// from the title. URLs are indexed under it.
+	MergeKey string `json:"merge_key,omitempty"`
+
+	// Candidates holds the values of the fields of merged streams, keyed by
+	// field name. The merge policies choose among them.
+	Candidates map[string][]fieldCandidate `json:"candidates,omitempty"`
+
+	// Attributes holds the #EXTINF attributes that have no dedicated field,
+	// such as catchup, tvg-shift or radio, keyed by lowercase name.
+	Attributes map[string]string `json:"attributes,omitempty"`
+
+	// AttributeCandidates holds the attributes of each merged stream. The
+	// merge policies choose among them like among Candidates.
+	AttributeCandidates []attributeCandidate `json:"attribute_candidates,omitempty"`
+
+	// URLKeys identifies the URLs of the stream as "index|urlHash", like the
+	// file names of the streams index.
+	URLKeys []string `json:"url_keys,omitempty"`
+
+	// URLOptions holds the player directives of each URL, keyed like URLs.
+	URLOptions map[string]map[string]*StreamOptions `json:"-"`
+
+	// URLQualities holds the quality tier of each URL whose quality is known,
+	// keyed like URLs.
+	URLQualities map[string]map[string]string `json:"-"`
+
+	// SourceURL and SourceOptions belong to the entry at SourceM3U and
+	// SourceIndex. They are used when the proxy is bypassed.
+	SourceURL     string         `json:"source_url,omitempty"`
+	SourceOptions *StreamOptions `json:"source_options,omitempty"`
+}
+
+// setSourceQuality sets the quality of the URL of a freshly parsed stream.
+func (s *StreamInfo) setSourceQuality(quality string) {
+	_, urlHash, _ := strings.Cut(s.URLKeys[0], "|")
+	s.URLQualities = map[string]map[string]string{
+		s.SourceM3U: {urlHash: quality},
+	}
+}
+
+// clone returns a copy of a freshly parsed stream, so that playlist profiles
+// can change its fields independently. The URLs and attributes, which are not
+// changed once parsed, are shared.
+func (s *StreamInfo) clone() *StreamInfo {
+	return &StreamInfo{
+		Title:               s.Title,
+		TvgID:               s.TvgID,
+		TvgChNo:             s.TvgChNo,
+		TvgType:             s.TvgType,
+		LogoURL:             s.LogoURL,
+		Group:               s.Group,
+		URLs:                s.URLs,
+		SourceM3U:           s.SourceM3U,
+		SourceIndex:         s.SourceIndex,
+		MergeKey:            s.MergeKey,
+		Candidates:          s.Candidates,
+		Attributes:          s.Attributes,
+		AttributeCandidates: s.AttributeCandidates,
+		URLKeys:             s.URLKeys,
+		URLOptions:          s.URLOptions,
+		URLQualities:        s.URLQualities,
+		SourceURL:           s.SourceURL,
+		SourceOptions:       s.SourceOptions,
+	}
+}
+
+// indexKey returns the key the stream is merged and indexed on.
+func (s *StreamInfo) indexKey() string {
+	if s.MergeKey != "" {
+		return s.MergeKey
+	}
+	return s.Title
 }
@@ -0,0 +1,150 @@
+package sourceproc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// StreamOptions holds the player directives (#EXTVLCOPT, #KODIPROP and
+// #EXTGRP) that preceded a stream URL in its source playlist.
+type StreamOptions struct {
+	VLCOpts   []string `json:"vlcopt,omitempty"`
+	KodiProps []string `json:"kodiprop,omitempty"`
+	ExtGrp    string   `json:"extgrp,omitempty"`
+}
+
+// vlcHeaderOptions maps the VLC HTTP options to the request headers they set.
+var vlcHeaderOptions = map[string]string{
+	"http-user-agent": "User-Agent",
+	"http-referrer":   "Referer",
+	"http-referer":    "Referer",
+	"http-origin":     "Origin",
+	"http-cookie":     "Cookie",
+}
+
+// kodiHeaderProps lists the Kodi properties that carry request headers as
+// URL-encoded key=value pairs.
+var kodiHeaderProps = []string{
+	"inputstream.adaptive.manifest_headers",
+	"inputstream.adaptive.stream_headers",
+}
+
+// addDirective records a directive line and reports whether it was one.
+func (o *StreamOptions) addDirective(line string) bool {
+	switch {
+	case strings.HasPrefix(line, "#EXTVLCOPT:"):
+		if value := strings.TrimSpace(strings.TrimPrefix(line, "#EXTVLCOPT:")); value != "" {
+			o.VLCOpts = append(o.VLCOpts, value)
+		}
+	case strings.HasPrefix(line, "#KODIPROP:"):
+		if value := strings.TrimSpace(strings.TrimPrefix(line, "#KODIPROP:")); value != "" {
+			o.KodiProps = append(o.KodiProps, value)
+		}
+	case strings.HasPrefix(line, "#EXTGRP:"):
+		o.ExtGrp = strings.TrimSpace(strings.TrimPrefix(line, "#EXTGRP:"))
+	default:
+		return false
+	}
+	return true
+}
+
+func (o *StreamOptions) isEmpty() bool {
+	return o == nil || (len(o.VLCOpts) == 0 && len(o.KodiProps) == 0 && o.ExtGrp == "")
+}
+
+// HTTPHeaders returns the request headers set by the HTTP options of the
+// stream, such as http-user-agent and http-referrer.
+func (o *StreamOptions) HTTPHeaders() http.Header {
+	headers := http.Header{}
+	if o == nil {
+		return headers
+	}
+
+	for _, prop := range o.KodiProps {
+		key, value, ok := strings.Cut(prop, "=")
+		if !ok {
+			continue
+		}
+		for _, headerProp := range kodiHeaderProps {
+			if !strings.EqualFold(strings.TrimSpace(key), headerProp) {
+				continue
+			}
+			values, err := url.ParseQuery(value)
+			if err != nil {
+				continue
+			}
+			for header, headerValues := range values {
+				if len(headerValues) > 0 {
+					headers.Set(header, headerValues[0])
+				}
+			}
+		}
+	}
+
+	for _, opt := range o.VLCOpts {
+		key, value, ok := strings.Cut(opt, "=")
+		if !ok {
+			continue
+		}
+		if header, ok := vlcHeaderOptions[strings.ToLower(strings.TrimSpace(key))]; ok {
+			headers.Set(header, strings.Trim(strings.TrimSpace(value), `"`))
+		}
+	}
+
+	return headers
+}
+
+// ApplyHeaders sets the request headers of the stream options on req.
+func (o *StreamOptions) ApplyHeaders(req *http.Request) {
+	for key, values := range o.HTTPHeaders() {
+		req.Header[key] = values
+	}
+}
+
+// directiveLines returns the options as M3U directive lines.
+func (o *StreamOptions) directiveLines() []string {
+	if o.isEmpty() {
+		return nil
+	}
+
+	var lines []string
+	if o.ExtGrp != "" {
+		lines = append(lines, "#EXTGRP:"+o.ExtGrp)
+	}
+	for _, opt := range o.VLCOpts {
+		lines = append(lines, "#EXTVLCOPT:"+opt)
+	}
+	for _, prop := range o.KodiProps {
+		lines = append(lines, "#KODIPROP:"+prop)
+	}
+	return lines
+}
+
+func encodeStreamOptions(o *StreamOptions) string {
+	if o.isEmpty() {
+		return ""
+	}
+	data, err := json.Marshal(o)
+	if err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func decodeStreamOptions(encoded string) *StreamOptions {
+	if encoded == "" {
+		return nil
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil
+	}
+	var o StreamOptions
+	if err := json.Unmarshal(data, &o); err != nil {
+		return nil
+	}
+	return &o
+}
@@ -0,0 +1,108 @@
+package sourceproc
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamOptionsHTTPHeaders(t *testing.T) {
+	options := &StreamOptions{}
+	assert.True(t, options.addDirective("#EXTVLCOPT:http-user-agent=VLC/3.0"))
+	assert.True(t, options.addDirective(`#EXTVLCOPT:http-referrer="http://portal.example.com/"`))
+	assert.True(t, options.addDirective("#EXTVLCOPT:network-caching=1000"))
+	assert.True(t, options.addDirective("#KODIPROP:inputstream.adaptive.stream_headers=Origin=http%3A%2F%2Forigin.example.com&X-Token=abc"))
+	assert.True(t, options.addDirective("#EXTGRP:News"))
+	assert.False(t, options.addDirective("#EXT-X-UNRELATED:1"))
+
+	headers := options.HTTPHeaders()
+	assert.Equal(t, "VLC/3.0", headers.Get("User-Agent"))
+	assert.Equal(t, "http://portal.example.com/", headers.Get("Referer"))
+	assert.Equal(t, "http://origin.example.com", headers.Get("Origin"))
+	assert.Equal(t, "abc", headers.Get("X-Token"))
+	assert.Len(t, headers, 4)
+
+	var nilOptions *StreamOptions
+	assert.Empty(t, nilOptions.HTTPHeaders())
+	assert.Empty(t, nilOptions.directiveLines())
+}
+
+func TestStreamOptionsProcessing(t *testing.T) {
+	setupSources(t, "#EXTM3U\n"+
+		"#EXTINF:-1 tvg-id=\"cnn.us\",CNN\n"+
+		"#EXTGRP:News\n"+
+		"#EXTVLCOPT:http-user-agent=VLC/3.0\n"+
+		"#EXTVLCOPT:http-referrer=http://portal.example.com/\n"+
+		"#KODIPROP:inputstream.adaptive.manifest_type=hls\n"+
+		"http://example.com/cnn.m3u8\n"+
+		"#EXTINF:-1 group-title=\"Sports\",ESPN\n"+
+		"http://example.com/espn\n")
+
+	runProcessor := func() string {
+		content, err := os.ReadFile(runTestProcessor(t).GetResultPath())
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	content := runProcessor()
+	assert.NotContains(t, content, "#EXTVLCOPT")
+	assert.Contains(t, content, `group-title="News"`)
+
+	var cnnSlug string
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(line, "http://example.com/p/") {
+			stream, err := DecodeSlug(strings.TrimSuffix(path.Base(line), path.Ext(line)))
+			require.NoError(t, err)
+			if stream.Title == "CNN" {
+				cnnSlug = strings.TrimSuffix(path.Base(line), path.Ext(line))
+			}
+		}
+	}
+	require.NotEmpty(t, cnnSlug)
+
+	stream, err := ParseStreamInfoBySlug(cnnSlug)
+	require.NoError(t, err)
+	require.Len(t, stream.URLs["1"], 1)
+	for subIndex := range stream.URLs["1"] {
+		options := stream.URLOptions["1"][subIndex]
+		require.NotNil(t, options)
+		assert.Equal(t, "VLC/3.0", options.HTTPHeaders().Get("User-Agent"))
+		assert.Equal(t, "http://portal.example.com/", options.HTTPHeaders().Get("Referer"))
+	}
+
+	t.Setenv("BYPASS_PROXY", "true")
+	content = runProcessor()
+	assert.Contains(t, content, ",CNN\n"+
+		"#EXTGRP:News\n"+
+		"#EXTVLCOPT:http-user-agent=VLC/3.0\n"+
+		"#EXTVLCOPT:http-referrer=http://portal.example.com/\n"+
+		"#KODIPROP:inputstream.adaptive.manifest_type=hls\n"+
+		"http://example.com/cnn.m3u8\n")
+	assert.Contains(t, content, ",ESPN\nhttp://example.com/espn\n")
+}
+
+func TestStreamOptionsBypassSourceOrder(t *testing.T) {
+	sources := make([]string, 10)
+	for i := range sources {
+		sources[i] = "#EXTM3U\n"
+	}
+	sources[1] += "#EXTINF:-1,CNN\n" +
+		"#EXTVLCOPT:http-user-agent=Source2\n" +
+		"http://two.example.com/cnn\n"
+	sources[9] += "#EXTINF:-1,CNN\n" +
+		"#EXTVLCOPT:http-user-agent=Source10\n" +
+		"http://ten.example.com/cnn\n"
+	setupSources(t, sources...)
+	t.Setenv("BYPASS_PROXY", "true")
+
+	content, err := os.ReadFile(runTestProcessor(t).GetResultPath())
+	require.NoError(t, err)
+	assert.Contains(t, string(content), ",CNN\n"+
+		"#EXTVLCOPT:http-user-agent=Source2\n"+
+		"http://two.example.com/cnn\n")
+	assert.NotContains(t, string(content), "ten.example.com")
+}
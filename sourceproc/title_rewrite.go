@@ -0,0 +1,226 @@
+package sourceproc
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"m3u-stream-merger/logger"
+	"m3u-stream-merger/utils"
+)
+
+// parseRewriteRule splits a rule of the form "<regexp> => <template>".
+func parseRewriteRule(value string) (*regexp.Regexp, string, error) {
+	sep := strings.LastIndex(value, "=>")
+	if sep < 0 {
+		return nil, "", fmt.Errorf("missing \"=>\" in %q", value)
+	}
+
+	pattern, err := regexp.Compile(strings.TrimSpace(value[:sep]))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return pattern, strings.TrimSpace(value[sep+2:]), nil
+}
+
+// rewriteData holds the fields of a stream that rewrite templates can use,
+// e.g. "{{.Group}} - $1".
+type rewriteData struct {
+	Title      string
+	Group      string
+	TvgID      string
+	TvgChNo    string
+	TvgType    string
+	Logo       string
+	Source     string
+	Attributes map[string]string
+}
+
+// newRewriteData returns the fields of a stream, with "$" escaped so that
+// values are not expanded as captured groups.
+func newRewriteData(stream *StreamInfo) *rewriteData {
+	escape := func(value string) string {
+		return strings.ReplaceAll(value, "$", "$$")
+	}
+
+	data := &rewriteData{
+		Title:      escape(stream.Title),
+		Group:      escape(stream.Group),
+		TvgID:      escape(stream.TvgID),
+		TvgChNo:    escape(stream.TvgChNo),
+		TvgType:    escape(stream.TvgType),
+		Logo:       escape(stream.LogoURL),
+		Source:     stream.SourceM3U,
+		Attributes: make(map[string]string, len(stream.Attributes)),
+	}
+	for key, value := range stream.Attributes {
+		data.Attributes[key] = escape(value)
+	}
+
+	return data
+}
+
+type rewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+	template    *template.Template
+}
+
+func newRewriteRule(setting, value string) (rewriteRule, error) {
+	pattern, replacement, err := parseRewriteRule(value)
+	if err != nil {
+		return rewriteRule{}, fmt.Errorf("invalid %s: %v", setting, err)
+	}
+
+	rule := rewriteRule{pattern: pattern, replacement: replacement}
+	if strings.Contains(replacement, "{{") {
+		tmpl, err := template.New(setting).Option("missingkey=zero").Parse(replacement)
+		if err != nil {
+			return rewriteRule{}, fmt.Errorf("invalid %s: %v", setting, err)
+		}
+		// Unknown fields are only reported when the template is executed.
+		if err := tmpl.Execute(&strings.Builder{}, &rewriteData{}); err != nil {
+			return rewriteRule{}, fmt.Errorf("invalid %s: %v", setting, err)
+		}
+		rule.template = tmpl
+	}
+
+	return rule, nil
+}
+
+// apply replaces every match of the rule in value.
+func (r rewriteRule) apply(value string, data *rewriteData) string {
+	replacement := r.replacement
+	if r.template != nil {
+		if !r.pattern.MatchString(value) {
+			return value
+		}
+
+		var result strings.Builder
+		if err := r.template.Execute(&result, data); err != nil {
+			logger.Default.Debugf("Error executing rewrite template: %v", err)
+			return value
+		}
+		replacement = result.String()
+	}
+
+	return r.pattern.ReplaceAllString(value, replacement)
+}
+
+// rewriteRules are the rules of a setting, such as TITLE_REWRITE_X, along
+// with the rules that only apply to the streams of a source, such as
+// M3U_TITLE_REWRITE_2_X. The rules of the source are applied first.
+type rewriteRules struct {
+	global  []rewriteRule
+	sources map[string][]rewriteRule
+}
+
+func newRewriteRules(s profileSettings, setting string) (*rewriteRules, error) {
+	compile := func(setting string) ([]rewriteRule, error) {
+		var rules []rewriteRule
+		for _, value := range s.filters(setting) {
+			rule, err := newRewriteRule(setting, value)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, rule)
+		}
+		return rules, nil
+	}
+
+	global, err := compile(setting)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := &rewriteRules{global: global, sources: make(map[string][]rewriteRule)}
+	for _, m3uIndex := range utils.GetM3UIndexes() {
+		sourceRules, err := compile(fmt.Sprintf("M3U_%s_%s", setting, m3uIndex))
+		if err != nil {
+			return nil, err
+		}
+		if len(sourceRules) > 0 {
+			rules.sources[m3uIndex] = sourceRules
+		}
+	}
+
+	return rules, nil
+}
+
+func (r *rewriteRules) isEmpty() bool {
+	return len(r.global) == 0 && len(r.sources) == 0
+}
+
+// apply rewrites value with the rules of the source of the stream, then with
+// the global rules. A value that is rewritten to nothing is kept as is.
+func (r *rewriteRules) apply(value string, stream *StreamInfo, data *rewriteData) string {
+	rewritten := value
+	for _, rules := range [][]rewriteRule{r.sources[stream.SourceM3U], r.global} {
+		for _, rule := range rules {
+			rewritten = rule.apply(rewritten, data)
+		}
+	}
+
+	if rewritten = strings.TrimSpace(rewritten); rewritten == "" {
+		return value
+	}
+	return rewritten
+}
+
+// titleRewrites rewrite the displayed titles with the TITLE_REWRITE_X rules
+// and the merge keys with the MERGE_KEY_REWRITE_X rules, such as
+// "(?i)^(?:US|USA):\s*(.+) => $1". Each rule replaces the matches of its
+// regexp with its template, where $1 or ${name} stand for the captured groups
+// and text/template actions such as {{.Group}} for the fields of the stream.
+// Rules are applied in order of X, each one to the result of the previous one.
+// Templates see the fields of the stream as parsed from its source.
+//
+// Playlist profiles have their own title rules, but share the merge key rules
+// of the main playlist.
+type titleRewrites struct {
+	title    *rewriteRules
+	mergeKey *rewriteRules
+}
+
+func newTitleRewrites(s profileSettings) (*titleRewrites, error) {
+	title, err := newRewriteRules(s, "TITLE_REWRITE")
+	if err != nil {
+		return nil, err
+	}
+	mergeKey, err := newRewriteRules(defaultSettings, "MERGE_KEY_REWRITE")
+	if err != nil {
+		return nil, err
+	}
+	return &titleRewrites{title: title, mergeKey: mergeKey}, nil
+}
+
+// compileTitleRewrites compiles the TITLE_REWRITE_X and MERGE_KEY_REWRITE_X
+// rules of a playlist for a sync. If one of them can't be compiled, neither
+// titles nor merge keys are rewritten, as the two sets of rules are written
+// to work together.
+func compileTitleRewrites(s profileSettings) *titleRewrites {
+	rewrites, err := newTitleRewrites(s)
+	if err != nil {
+		logger.Default.Errorf("Keeping the titles of the sources: %v", err)
+		return &titleRewrites{title: &rewriteRules{}, mergeKey: &rewriteRules{}}
+	}
+	return rewrites
+}
+
+// rewrite rewrites the title of a stream and returns its rewritten merge key.
+// The merge key is rewritten from the key computed from the fields of the
+// stream before its title is rewritten, so that the displayed title can be
+// changed without changing how streams are merged.
+func (r *titleRewrites) rewrite(stream *StreamInfo, key string) string {
+	if r.title.isEmpty() && r.mergeKey.isEmpty() {
+		return key
+	}
+
+	data := newRewriteData(stream)
+	key = r.mergeKey.apply(key, stream, data)
+	stream.Title = r.title.apply(stream.Title, stream, data)
+
+	return key
+}
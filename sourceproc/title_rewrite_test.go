@@ -0,0 +1,123 @@
+package sourceproc
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"m3u-stream-merger/utils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTitleRewrites(t *testing.T) {
+	utils.ResetCaches()
+	defer utils.ResetCaches()
+	t.Setenv("M3U_URL_1", "http://example.com/1.m3u")
+	t.Setenv("M3U_URL_2", "http://example.com/2.m3u")
+	t.Setenv("TITLE_REWRITE_2", `^(?P<name>.+?)\s+HD$ => ${name}`)
+	t.Setenv("TITLE_REWRITE_1", `(?i)^(?:US|USA):\s*(.+)$ => $1`)
+	t.Setenv("TITLE_REWRITE_3", `^Sky (.+)$ => {{.Group}} - Sky $1{{with .Attributes.country}} ({{.}}){{end}}`)
+	t.Setenv("M3U_TITLE_REWRITE_2_1", `^\|EN\|\s* => USA: `)
+	t.Setenv("MERGE_KEY_REWRITE_1", `\s*(?:HD|FHD)$ => `)
+
+	rewrites, err := newTitleRewrites(defaultSettings)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		stream    *StreamInfo
+		key       string
+		wantTitle string
+		wantKey   string
+	}{
+		{
+			name:      "captured groups",
+			stream:    &StreamInfo{Title: "USA: CNN HD", SourceM3U: "1"},
+			key:       "USA: CNN HD",
+			wantTitle: "CNN",
+			wantKey:   "USA: CNN",
+		},
+		{
+			name:      "source rules first",
+			stream:    &StreamInfo{Title: "|EN| CNN FHD", SourceM3U: "2"},
+			key:       "|EN| CNN FHD",
+			wantTitle: "CNN FHD",
+			wantKey:   "|EN| CNN",
+		},
+		{
+			name:      "source rules of other sources",
+			stream:    &StreamInfo{Title: "|EN| CNN", SourceM3U: "1"},
+			key:       "cnn",
+			wantTitle: "|EN| CNN",
+			wantKey:   "cnn",
+		},
+		{
+			name:      "template",
+			stream:    &StreamInfo{Title: "Sky News", Group: "UK $1", SourceM3U: "1", Attributes: map[string]string{"country": "GB"}},
+			key:       "Sky News",
+			wantTitle: "UK $1 - Sky News (GB)",
+			wantKey:   "Sky News",
+		},
+		{
+			name:      "rewritten to nothing",
+			stream:    &StreamInfo{Title: "HD", SourceM3U: "1"},
+			key:       "HD",
+			wantTitle: "HD",
+			wantKey:   "HD",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := rewrites.rewrite(tt.stream, tt.key)
+			assert.Equal(t, tt.wantTitle, tt.stream.Title)
+			assert.Equal(t, tt.wantKey, key)
+		})
+	}
+}
+
+func TestTitleRewritesValidation(t *testing.T) {
+	utils.ResetCaches()
+	defer utils.ResetCaches()
+
+	t.Setenv("TITLE_REWRITE_1", `^US: (.+)$`)
+	assert.ErrorContains(t, ValidateSettings(), `invalid TITLE_REWRITE: missing "=>" in "^US: (.+)$"`)
+
+	utils.ResetCaches()
+	t.Setenv("TITLE_REWRITE_1", `^US: (.+)$ => {{.Title}`)
+	assert.ErrorContains(t, ValidateSettings(), "invalid TITLE_REWRITE")
+
+	utils.ResetCaches()
+	t.Setenv("TITLE_REWRITE_1", `^US: (.+)$ => {{.Name}}`)
+	assert.ErrorContains(t, ValidateSettings(), "invalid TITLE_REWRITE")
+
+	utils.ResetCaches()
+	t.Setenv("TITLE_REWRITE_1", `^US: (.+)$ => {{.Group}}: $1`)
+	t.Setenv("M3U_URL_1", "http://example.com/1.m3u")
+	t.Setenv("M3U_MERGE_KEY_REWRITE_1_1", `(.+ => $1`)
+	assert.ErrorContains(t, ValidateSettings(), "invalid M3U_MERGE_KEY_REWRITE_1")
+
+	utils.ResetCaches()
+	t.Setenv("M3U_MERGE_KEY_REWRITE_1_1", `(.+) HD => $1`)
+	assert.NoError(t, ValidateSettings())
+}
+
+func TestRewrittenTitlesInPlaylist(t *testing.T) {
+	t.Setenv("TITLE_REWRITE_1", `^(.+?)(?: HD)?$ => {{.Group}}: $1`)
+	t.Setenv("MERGE_KEY_REWRITE_1", ` HD$ => `)
+	processor := runProcessorOn(t,
+		"#EXTM3U\n#EXTINF:-1 group-title=\"News\",CNN HD\nhttp://example.com/cnn-hd\n",
+		"#EXTM3U\n#EXTINF:-1 group-title=\"News\",CNN\nhttp://example.com/cnn\n")
+
+	content, err := os.ReadFile(processor.GetResultPath())
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(content), "#EXTINF"))
+	assert.Contains(t, string(content), ",News: CNN\n")
+
+	stream, err := ParseStreamInfoBySlug(EncodeSlug(&StreamInfo{Title: "News: CNN", MergeKey: "CNN"}))
+	require.NoError(t, err)
+	assert.Len(t, stream.URLs["1"], 1)
+	assert.Len(t, stream.URLs["2"], 1)
+}
@@ -0,0 +1,39 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+// AccountLimits holds provider-reported limits for a single M3U source,
+// e.g. the max_connections and exp_date of an Xtream Codes account.
+type AccountLimits struct {
+	MaxConnections int
+	ExpiresAt      time.Time
+}
+
+var accountLimits sync.Map // map[string]AccountLimits
+
+// SetAccountLimits records the limits reported by the provider of the given
+// M3U index. A zero MaxConnections or ExpiresAt means "unknown".
+func SetAccountLimits(m3uIndex string, limits AccountLimits) {
+	accountLimits.Store(m3uIndex, limits)
+}
+
+// GetAccountLimits returns the provider-reported limits of the given M3U index.
+func GetAccountLimits(m3uIndex string) (AccountLimits, bool) {
+	value, ok := accountLimits.Load(m3uIndex)
+	if !ok {
+		return AccountLimits{}, false
+	}
+	return value.(AccountLimits), true
+}
+
+// ClearAccountLimits forgets the provider-reported limits of the given M3U index.
+func ClearAccountLimits(m3uIndex string) {
+	accountLimits.Delete(m3uIndex)
+}
+
+func (l AccountLimits) expired() bool {
+	return !l.ExpiresAt.IsZero() && time.Now().After(l.ExpiresAt)
+}
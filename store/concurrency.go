@@ -19,9 +19,17 @@ func NewConcurrencyManager() *ConcurrencyManager {
 }
 
 func (cm *ConcurrencyManager) getMaxConcurrency(m3uIndex string) int {
+	limits, hasLimits := GetAccountLimits(m3uIndex)
+	if hasLimits && limits.expired() {
+		return 0
+	}
+
 	max, err := strconv.Atoi(os.Getenv(fmt.Sprintf("M3U_MAX_CONCURRENCY_%s", m3uIndex)))
 	if err != nil {
 		max = 1
+		if hasLimits && limits.MaxConnections > 0 {
+			max = limits.MaxConnections
+		}
 	}
 	return max
 }
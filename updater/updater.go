@@ -2,23 +2,60 @@ package updater
 
 import (
 	"context"
+	"fmt"
 	"m3u-stream-merger/config"
 	"m3u-stream-merger/handlers"
 	"m3u-stream-merger/logger"
 	"m3u-stream-merger/sourceproc"
+	"m3u-stream-merger/utils"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/robfig/cron/v3"
 )
 
+// configFilePollInterval is how often the CONFIG_FILE and CHANNEL_MAP_FILE
+// are checked for changes.
+var configFilePollInterval = 10 * time.Second
+
 type Updater struct {
 	sync.Mutex
-	ctx        context.Context
-	Cron       *cron.Cron
-	logger     logger.Logger
-	m3uHandler *handlers.M3UHTTPHandler
+	ctx         context.Context
+	Cron        *cron.Cron
+	logger      logger.Logger
+	m3uHandler  *handlers.M3UHTTPHandler
+	configMutex sync.Mutex
+
+	// pendingSync collects the sync requests received while a job is
+	// running, so they are run once it is done.
+	pendingMutex sync.Mutex
+	pendingSync  *pendingSync
+}
+
+// pendingSync is a sync waiting for the running job: of every source, or of
+// the given ones.
+type pendingSync struct {
+	all     bool
+	indexes []string
+}
+
+func (p *pendingSync) add(indexes []string) {
+	if len(indexes) == 0 {
+		p.all, p.indexes = true, nil
+		return
+	}
+	if p.all {
+		return
+	}
+	for _, idx := range indexes {
+		if !slices.Contains(p.indexes, idx) {
+			p.indexes = append(p.indexes, idx)
+		}
+	}
 }
 
 func Initialize(ctx context.Context, logger logger.Logger, m3uHandler *handlers.M3UHTTPHandler) (*Updater, error) {
@@ -28,6 +65,18 @@ func Initialize(ctx context.Context, logger logger.Logger, m3uHandler *handlers.
 		m3uHandler: m3uHandler,
 	}
 
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := updateInstance.loadConfigFile(path); err != nil {
+			return nil, err
+		}
+		go updateInstance.watchFile(ctx, "Config file", func() string { return path })
+	}
+	go updateInstance.watchFile(ctx, "Channel map", func() string { return os.Getenv("CHANNEL_MAP_FILE") })
+
+	if err := validateSettings(); err != nil {
+		return nil, err
+	}
+
 	clearOnBoot := os.Getenv("CLEAR_ON_BOOT")
 	if len(strings.TrimSpace(clearOnBoot)) == 0 {
 		clearOnBoot = "false"
@@ -39,7 +88,7 @@ func Initialize(ctx context.Context, logger logger.Logger, m3uHandler *handlers.
 	} else {
 		latestM3u, err := config.GetLatestProcessedM3UPath()
 		if err == nil {
-			m3uHandler.SetProcessedPath(latestM3u)
+			m3uHandler.SetPlaylistPaths(latestM3u, latestProfilePaths(latestM3u))
 		}
 	}
 
@@ -50,15 +99,52 @@ func Initialize(ctx context.Context, logger logger.Logger, m3uHandler *handlers.
 	}
 
 	c := cron.New()
-	_, err := c.AddFunc(cronSched, func() {
-		go updateInstance.UpdateSources(ctx)
-	})
-	if err != nil {
-		updateInstance.logger.Logf("Error initializing background processes: %v", err)
-		return nil, err
+
+	// Sources with their own schedule are left out of the SYNC_CRON job.
+	var defaultIndexes []string
+	scheduled := 0
+	for _, idx := range utils.GetM3UIndexes() {
+		sourceSched := strings.TrimSpace(os.Getenv(fmt.Sprintf("M3U_SYNC_CRON_%s", idx)))
+		if sourceSched == "" {
+			defaultIndexes = append(defaultIndexes, idx)
+			continue
+		}
+
+		_, err := c.AddFunc(sourceSched, func() {
+			go updateInstance.UpdateSources(ctx, idx)
+		})
+		if err != nil {
+			updateInstance.logger.Logf("Error initializing background processes for M3U_%s: %v", idx, err)
+			return nil, err
+		}
+		updateInstance.logger.Logf("M3U_SYNC_CRON_%s set. M3U_%s will be synced on its own schedule (%s).", idx, idx, sourceSched)
+		scheduled++
+	}
+
+	var syncJob func()
+	switch {
+	case scheduled == 0:
+		syncJob = func() {
+			go updateInstance.UpdateSources(ctx)
+		}
+	case len(defaultIndexes) > 0:
+		syncJob = func() {
+			go updateInstance.UpdateSources(ctx, defaultIndexes...)
+		}
+	}
+
+	if syncJob != nil {
+		_, err := c.AddFunc(cronSched, syncJob)
+		if err != nil {
+			updateInstance.logger.Logf("Error initializing background processes: %v", err)
+			return nil, err
+		}
 	}
 	c.Start()
 
+	m3uHandler.SetSyncer(updateInstance)
+	m3uHandler.SetReloader(updateInstance)
+
 	syncOnBoot := os.Getenv("SYNC_ON_BOOT")
 	if len(strings.TrimSpace(syncOnBoot)) == 0 {
 		syncOnBoot = "true"
@@ -75,25 +161,236 @@ func Initialize(ctx context.Context, logger logger.Logger, m3uHandler *handlers.
 	return updateInstance, nil
 }
 
-func (instance *Updater) UpdateSources(ctx context.Context) {
+// UpdateSources downloads the given sources, or all of them if none is given,
+// and rebuilds the merged M3U using the cached copies of the other sources.
+func (instance *Updater) UpdateSources(ctx context.Context, indexes ...string) {
 	// Ensure only one job is running at a time
 	instance.Lock()
 	defer instance.Unlock()
 
-	processor := sourceproc.NewProcessor()
+	instance.updateSources(ctx, indexes...)
+}
+
+func (instance *Updater) updateSources(ctx context.Context, indexes ...string) {
+	var opts []sourceproc.ProcessorOption
+	message := "Background process: Updating sources..."
+	if len(indexes) > 0 {
+		opts = append(opts, sourceproc.WithRefreshIndexes(indexes...))
+		message = fmt.Sprintf("Background process: Updating sources (M3U_%s)...", strings.Join(indexes, ", M3U_"))
+	}
+
+	instance.buildM3U(ctx, message, opts...)
+}
+
+// RegenerateM3U rebuilds the merged M3U from the cached copies of the sources
+// without downloading them.
+func (instance *Updater) RegenerateM3U(ctx context.Context) {
+	instance.Lock()
+	defer instance.Unlock()
+
+	instance.buildM3U(ctx, "Background process: Regenerating merged M3U from cached sources...",
+		sourceproc.WithRefreshIndexes())
+}
+
+// buildM3U runs a job. Callers must hold the lock of the updater.
+func (instance *Updater) buildM3U(ctx context.Context, message string, opts ...sourceproc.ProcessorOption) {
+	processor := sourceproc.NewProcessor(opts...)
 	select {
 	case <-ctx.Done():
 		return
 	default:
-		instance.logger.Log("Background process: Updating sources...")
+		instance.logger.Log(message)
 
 		instance.logger.Log("Background process: Building merged M3U...")
 		if _, ok := os.LookupEnv("BASE_URL"); !ok {
 			instance.logger.Error("BASE_URL is required for M3U processing to work.")
 			return
 		}
+
+		previousPath, previous := instance.loadPreviousChannels()
 		if err := processor.Run(ctx, nil); err == nil {
-			instance.m3uHandler.SetProcessedPath(processor.GetResultPath())
+			instance.m3uHandler.SetPlaylistPaths(processor.GetResultPath(), processor.GetProfileResultPaths())
+			instance.saveSyncDiff(previousPath, previous, processor.GetResultPath())
+		}
+	}
+}
+
+// latestProfilePaths returns the playlists of the profiles that were saved
+// next to the latest processed M3U.
+func latestProfilePaths(latestM3u string) map[string]string {
+	paths := make(map[string]string)
+	for _, profile := range sourceproc.Profiles() {
+		path := config.GetProcessedProfilePath(latestM3u, profile)
+		if _, err := os.Stat(path); err == nil {
+			paths[profile] = path
+		}
+	}
+	return paths
+}
+
+// SyncSources starts a sync of the given sources in the background. The
+// other sources are read from their cached copies. Requests received while a
+// sync is waiting for the running job are merged into it, so at most one sync
+// is ever waiting.
+func (instance *Updater) SyncSources(indexes ...string) error {
+	for _, idx := range indexes {
+		if !slices.Contains(utils.GetM3UIndexes(), idx) {
+			return fmt.Errorf("unknown M3U index: %s", idx)
+		}
+	}
+
+	instance.pendingMutex.Lock()
+	defer instance.pendingMutex.Unlock()
+
+	if instance.pendingSync != nil {
+		instance.pendingSync.add(indexes)
+		instance.logger.Debugf("Sync request merged into the pending sync")
+		return nil
+	}
+
+	instance.pendingSync = &pendingSync{}
+	instance.pendingSync.add(indexes)
+	go instance.runPendingSync()
+	return nil
+}
+
+// runPendingSync waits for the running job, then runs the pending sync.
+func (instance *Updater) runPendingSync() {
+	instance.Lock()
+	defer instance.Unlock()
+
+	instance.pendingMutex.Lock()
+	pending := instance.pendingSync
+	instance.pendingSync = nil
+	instance.pendingMutex.Unlock()
+
+	instance.updateSources(instance.ctx, pending.indexes...)
+}
+
+// ReloadConfig reloads the CONFIG_FILE, if any, and regenerates the merged M3U
+// from the cached sources. An invalid config file or channel map is rejected
+// and the current settings are kept.
+func (instance *Updater) ReloadConfig() error {
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := instance.loadConfigFile(path); err != nil {
+			return err
 		}
+	} else if err := validateSettings(); err != nil {
+		return err
+	}
+
+	go instance.RegenerateM3U(instance.ctx)
+	return nil
+}
+
+// validateSettings reports configuration errors of the settings of the
+// playlists, of the source proxies and of the users.
+func validateSettings() error {
+	if err := sourceproc.ValidateSettings(); err != nil {
+		return err
+	}
+	if err := utils.ValidateSourceProxies(); err != nil {
+		return err
 	}
+	return handlers.ValidateUserAccess()
+}
+
+// loadConfigFile applies the settings of the config file on top of the
+// environment.
+func (instance *Updater) loadConfigFile(path string) error {
+	instance.configMutex.Lock()
+	defer instance.configMutex.Unlock()
+
+	values, err := utils.ReadConfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	undo := utils.ApplyConfigFile(values)
+	if err := validateSettings(); err != nil {
+		undo()
+		return err
+	}
+
+	instance.logger.Logf("Loaded %d settings from config file %s", len(values), path)
+	return nil
+}
+
+// watchFile reloads the config whenever the file at path changes. The path is
+// read again on every check, as it may be changed by the config file.
+func (instance *Updater) watchFile(ctx context.Context, name string, path func() string) {
+	lastPath := path()
+	var lastStat os.FileInfo
+	if lastPath != "" {
+		lastStat, _ = os.Stat(lastPath)
+	}
+
+	ticker := time.NewTicker(configFilePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		currentPath := path()
+		if currentPath == "" {
+			lastPath, lastStat = "", nil
+			continue
+		}
+		stat, err := os.Stat(currentPath)
+		if err != nil {
+			continue
+		}
+		if currentPath == lastPath && lastStat != nil && stat.ModTime().Equal(lastStat.ModTime()) && stat.Size() == lastStat.Size() {
+			continue
+		}
+		lastPath, lastStat = currentPath, stat
+
+		instance.logger.Logf("%s %s changed. Reloading...", name, currentPath)
+		if err := instance.ReloadConfig(); err != nil {
+			instance.logger.Errorf("Error reloading %s: %v", strings.ToLower(name), err)
+		}
+	}
+}
+
+// loadPreviousChannels loads the channels of the latest processed M3U so that
+// they can be compared with the result of the next sync.
+func (instance *Updater) loadPreviousChannels() (string, map[string]*sourceproc.ChannelSnapshot) {
+	latestM3u, err := config.GetLatestProcessedM3UPath()
+	if err != nil {
+		return "", nil
+	}
+
+	previous, err := sourceproc.LoadChannelSnapshot(config.GetProcessedSnapshotPath(latestM3u))
+	if err != nil {
+		instance.logger.Debugf("No channel snapshot found for %s: %v", latestM3u, err)
+		return "", nil
+	}
+
+	return latestM3u, previous
+}
+
+func (instance *Updater) saveSyncDiff(previousPath string, previous map[string]*sourceproc.ChannelSnapshot, resultPath string) {
+	if previous == nil {
+		return
+	}
+
+	diff, err := sourceproc.ComputeSyncDiff(previous, config.GetProcessedSnapshotPath(resultPath))
+	if err != nil {
+		instance.logger.Errorf("Error computing sync diff: %v", err)
+		return
+	}
+	diff.Previous = filepath.Base(previousPath)
+	diff.Current = filepath.Base(resultPath)
+
+	if err := sourceproc.SaveSyncDiff(config.GetProcessedDiffPath(resultPath), diff); err != nil {
+		instance.logger.Errorf("Error saving sync diff: %v", err)
+		return
+	}
+
+	instance.logger.Logf("Sync diff: %d channels added, %d removed, %d with changed URLs, %d field changes",
+		len(diff.Added), len(diff.Removed), len(diff.URLsChanged), len(diff.Changed))
 }
@@ -0,0 +1,262 @@
+package updater
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"m3u-stream-merger/config"
+	"m3u-stream-merger/handlers"
+	"m3u-stream-merger/logger"
+	"m3u-stream-merger/utils"
+)
+
+func setupUpdater(t *testing.T) *Updater {
+	tempDir := t.TempDir()
+	originalConfig := config.GetConfig()
+	config.SetConfig(&config.Config{
+		DataPath: filepath.Join(tempDir, "data"),
+		TempPath: filepath.Join(tempDir, "temp"),
+	})
+	t.Cleanup(func() { config.SetConfig(originalConfig) })
+
+	// Jobs of a cancelled updater return without syncing.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	return &Updater{
+		ctx:        ctx,
+		logger:     &logger.DefaultLogger{},
+		m3uHandler: handlers.NewM3UHTTPHandler(&logger.DefaultLogger{}, ""),
+	}
+}
+
+func TestSyncSourcesCoalescesRequests(t *testing.T) {
+	t.Setenv("M3U_URL_1", "http://example.com/1.m3u")
+	t.Setenv("M3U_URL_2", "http://example.com/2.m3u")
+	t.Setenv("M3U_URL_3", "http://example.com/3.m3u")
+	utils.ResetCaches()
+	defer utils.ResetCaches()
+
+	instance := setupUpdater(t)
+
+	// Hold the lock as if a job was running.
+	instance.Lock()
+
+	for _, indexes := range [][]string{{"1"}, {"3", "1"}, {"1"}} {
+		if err := instance.SyncSources(indexes...); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if err := instance.SyncSources("9"); err == nil {
+		t.Errorf("Expected an error for an unknown M3U index")
+	}
+
+	instance.pendingMutex.Lock()
+	pending := *instance.pendingSync
+	instance.pendingMutex.Unlock()
+	if want := (pendingSync{indexes: []string{"1", "3"}}); !reflect.DeepEqual(pending, want) {
+		t.Errorf("Expected pending sync %+v, got %+v", want, pending)
+	}
+
+	if err := instance.SyncSources(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	instance.pendingMutex.Lock()
+	pending = *instance.pendingSync
+	instance.pendingMutex.Unlock()
+	if want := (pendingSync{all: true}); !reflect.DeepEqual(pending, want) {
+		t.Errorf("Expected pending sync %+v, got %+v", want, pending)
+	}
+
+	instance.Unlock()
+
+	waitForPendingSync(t, instance)
+
+	// Requests received once the pending sync has run start a new one.
+	instance.Lock()
+	if err := instance.SyncSources("2"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	instance.pendingMutex.Lock()
+	if instance.pendingSync == nil {
+		t.Errorf("Expected a new pending sync")
+	}
+	instance.pendingMutex.Unlock()
+	instance.Unlock()
+
+	waitForPendingSync(t, instance)
+}
+
+// waitForPendingSync waits until the pending sync has run.
+func waitForPendingSync(t *testing.T, instance *Updater) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		instance.pendingMutex.Lock()
+		started := instance.pendingSync == nil
+		instance.pendingMutex.Unlock()
+		if started {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Pending sync was not run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The pending sync holds the lock until it is done.
+	instance.Lock()
+	defer instance.Unlock()
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	t.Setenv("SORTING_KEY", "title")
+	t.Setenv("SORTING_DIRECTION", "")
+	t.Setenv("CREDENTIALS", "")
+	t.Setenv("USER_GROUPS", "")
+	t.Setenv("M3U_PROXY_1", "")
+	utils.ResetCaches()
+	defer utils.ResetCaches()
+
+	instance := setupUpdater(t)
+	path := filepath.Join(t.TempDir(), "config.env")
+
+	writeConfig := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write config file: %v", err)
+		}
+	}
+	expectEnv := func(step, key, want string) {
+		t.Helper()
+		if got := os.Getenv(key); got != want {
+			t.Errorf("%s: expected %s=%q, got %q", step, key, want, got)
+		}
+	}
+
+	writeConfig("SORTING_KEY=tvg-chno\nSORTING_DIRECTION=desc\n")
+	if err := instance.loadConfigFile(path); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expectEnv("valid file", "SORTING_KEY", "tvg-chno")
+	expectEnv("valid file", "SORTING_DIRECTION", "desc")
+
+	// An invalid file is rolled back to the previous one.
+	writeConfig("SORTING_KEY=rating\n")
+	if err := instance.loadConfigFile(path); err == nil || !strings.Contains(err.Error(), "invalid SORTING_KEY") {
+		t.Errorf("Expected an invalid SORTING_KEY error, got %v", err)
+	}
+	expectEnv("invalid file", "SORTING_KEY", "tvg-chno")
+	expectEnv("invalid file", "SORTING_DIRECTION", "desc")
+
+	writeConfig("SORTING_KEY\n")
+	if err := instance.loadConfigFile(path); err == nil {
+		t.Errorf("Expected an error for a malformed file")
+	}
+	expectEnv("malformed file", "SORTING_KEY", "tvg-chno")
+
+	writeConfig("USER_GROUPS=guest:News\n")
+	if err := instance.loadConfigFile(path); err == nil || !strings.Contains(err.Error(), "CREDENTIALS") {
+		t.Errorf("Expected an error for USER_GROUPS without CREDENTIALS, got %v", err)
+	}
+	expectEnv("restricted users without credentials", "USER_GROUPS", "")
+
+	writeConfig("M3U_PROXY_1=ftp://proxy.example.com:21\n")
+	if err := instance.loadConfigFile(path); err == nil || !strings.Contains(err.Error(), "invalid M3U_PROXY_1") {
+		t.Errorf("Expected an invalid M3U_PROXY_1 error, got %v", err)
+	}
+	expectEnv("invalid proxy", "M3U_PROXY_1", "")
+
+	// Settings dropped from the file get their original value back.
+	writeConfig("SORTING_DIRECTION=desc\n")
+	if err := instance.loadConfigFile(path); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expectEnv("dropped setting", "SORTING_KEY", "title")
+	expectEnv("dropped setting", "SORTING_DIRECTION", "desc")
+
+	writeConfig("")
+	if err := instance.loadConfigFile(path); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expectEnv("empty file", "SORTING_DIRECTION", "")
+}
+
+func TestWatchFile(t *testing.T) {
+	t.Setenv("SORTING_KEY", "title")
+	utils.ResetCaches()
+	defer utils.ResetCaches()
+
+	originalInterval := configFilePollInterval
+	configFilePollInterval = 10 * time.Millisecond
+	defer func() { configFilePollInterval = originalInterval }()
+
+	instance := setupUpdater(t)
+	path := filepath.Join(t.TempDir(), "config.env")
+	if err := os.WriteFile(path, []byte("SORTING_KEY=title\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		instance.watchFile(ctx, "Config file", func() string { return path })
+	}()
+	defer func() {
+		cancel()
+		<-done
+		waitForJobs(instance)
+	}()
+
+	waitForEnv := func(key, want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for os.Getenv(key) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %s=%q, got %q", key, want, os.Getenv(key))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Files are replaced at once, so that the watcher never reads a
+	// truncated one.
+	writeConfig := func(content string) {
+		t.Helper()
+		tempPath := path + ".tmp"
+		if err := os.WriteFile(tempPath, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write config file: %v", err)
+		}
+		if err := os.Rename(tempPath, path); err != nil {
+			t.Fatalf("Failed to replace config file: %v", err)
+		}
+	}
+
+	// Let the watcher read the file before it changes.
+	time.Sleep(50 * time.Millisecond)
+
+	writeConfig("SORTING_KEY=tvg-chno\n")
+	waitForEnv("SORTING_KEY", "tvg-chno")
+
+	// Invalid changes are ignored, valid ones are picked up again.
+	writeConfig("SORTING_KEY=rating\n")
+	time.Sleep(100 * time.Millisecond)
+	if got := os.Getenv("SORTING_KEY"); got != "tvg-chno" {
+		t.Errorf("Expected the invalid change to be rejected, got SORTING_KEY=%q", got)
+	}
+
+	writeConfig("SORTING_KEY=tvg-id\n")
+	waitForEnv("SORTING_KEY", "tvg-id")
+}
+
+// waitForJobs waits until the jobs started by the updater are done.
+func waitForJobs(instance *Updater) {
+	time.Sleep(50 * time.Millisecond)
+	instance.Lock()
+	defer instance.Unlock()
+}
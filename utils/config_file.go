@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// originalEnv is the value an environment variable had before the config
+// file overrode it.
+type originalEnv struct {
+	value string
+	set   bool
+}
+
+var (
+	configFileMutex     sync.Mutex
+	configFileOriginals = make(map[string]originalEnv)
+)
+
+func lookupOriginalEnv(key string) originalEnv {
+	value, set := os.LookupEnv(key)
+	return originalEnv{value: value, set: set}
+}
+
+func (o originalEnv) restore(key string) {
+	if o.set {
+		_ = os.Setenv(key, o.value)
+	} else {
+		_ = os.Unsetenv(key)
+	}
+}
+
+// ReadConfigFile reads a file of KEY=VALUE lines, in the same format as a
+// .env file. Empty lines and lines starting with # are ignored.
+func ReadConfigFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening config file: %v", err)
+	}
+	defer file.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, found := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("config file %s line %d: expected KEY=VALUE", path, lineNum)
+		}
+
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading config file: %v", err)
+	}
+
+	return values, nil
+}
+
+// ApplyConfigFile sets the values read from the config file as environment
+// variables, on top of the environment the process was started with.
+// Variables set by a previous version of the file that are gone are restored
+// to their original values. The returned function undoes the change.
+func ApplyConfigFile(values map[string]string) (undo func()) {
+	configFileMutex.Lock()
+	defer configFileMutex.Unlock()
+
+	previousEnv := make(map[string]originalEnv)
+	previousOriginals := make(map[string]originalEnv, len(configFileOriginals))
+	for key, original := range configFileOriginals {
+		previousOriginals[key] = original
+		previousEnv[key] = lookupOriginalEnv(key)
+	}
+
+	for key, original := range configFileOriginals {
+		if _, ok := values[key]; !ok {
+			original.restore(key)
+			delete(configFileOriginals, key)
+		}
+	}
+
+	for key, value := range values {
+		if _, ok := configFileOriginals[key]; !ok {
+			configFileOriginals[key] = lookupOriginalEnv(key)
+			previousEnv[key] = configFileOriginals[key]
+		}
+		_ = os.Setenv(key, value)
+	}
+
+	ResetCaches()
+
+	return func() {
+		configFileMutex.Lock()
+		defer configFileMutex.Unlock()
+
+		for key, env := range previousEnv {
+			env.restore(key)
+		}
+		configFileOriginals = previousOriginals
+
+		ResetCaches()
+	}
+}
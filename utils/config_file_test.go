@@ -0,0 +1,184 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:    "Plain values",
+			content: "SYNC_CRON=0 0 * * *\n  INCLUDE_GROUPS_1 = ^News$  \n",
+			want:    map[string]string{"SYNC_CRON": "0 0 * * *", "INCLUDE_GROUPS_1": "^News$"},
+		},
+		{
+			name:    "Comments and empty lines",
+			content: "# Sorting\n\nSORTING_KEY=title\n   # indented comment\n",
+			want:    map[string]string{"SORTING_KEY": "title"},
+		},
+		{
+			name:    "Quoted values",
+			content: "A=\"double quoted\"\nB='single quoted'\nC=\"mismatched'\nD=\"\nE=\"a=b # c\"\nF=\"\"\n",
+			want: map[string]string{
+				"A": "double quoted",
+				"B": "single quoted",
+				"C": "\"mismatched'",
+				"D": "\"",
+				"E": "a=b # c",
+				"F": "",
+			},
+		},
+		{
+			name:    "Export prefix",
+			content: "export BASE_URL=http://example.com\nexport  SORTING_DIRECTION=desc\n",
+			want:    map[string]string{"BASE_URL": "http://example.com", "SORTING_DIRECTION": "desc"},
+		},
+		{
+			name:    "Later values override earlier ones",
+			content: "SORTING_KEY=title\nSORTING_KEY=tvg-chno\n",
+			want:    map[string]string{"SORTING_KEY": "tvg-chno"},
+		},
+		{
+			name:    "Windows line endings",
+			content: "SORTING_KEY=title\r\nSORTING_DIRECTION=desc\r\n",
+			want:    map[string]string{"SORTING_KEY": "title", "SORTING_DIRECTION": "desc"},
+		},
+		{
+			name:    "Missing separator",
+			content: "SORTING_KEY=title\nSORTING_DIRECTION\n",
+			wantErr: "line 2: expected KEY=VALUE",
+		},
+		{
+			name:    "Missing key",
+			content: "=title\n",
+			wantErr: "line 1: expected KEY=VALUE",
+		},
+		{
+			name:    "Key with spaces",
+			content: "# comment\nSORTING KEY=title\n",
+			wantErr: "line 2: expected KEY=VALUE",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.env")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("Failed to write config file: %v", err)
+			}
+
+			got, err := ReadConfigFile(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	if _, err := ReadConfigFile(filepath.Join(t.TempDir(), "missing.env")); err == nil {
+		t.Errorf("Expected an error for a missing config file")
+	}
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	configFileOriginals = make(map[string]originalEnv)
+	defer func() { configFileOriginals = make(map[string]originalEnv) }()
+
+	t.Setenv("CONFIG_TEST_KEPT", "env")
+	t.Setenv("CONFIG_TEST_CHANGED", "env")
+	t.Setenv("CONFIG_TEST_ADDED", "")
+	os.Unsetenv("CONFIG_TEST_ADDED")
+
+	type envValue struct {
+		value string
+		set   bool
+	}
+	expectEnv := func(t *testing.T, step string, want map[string]envValue) {
+		t.Helper()
+		for key, expected := range want {
+			value, set := os.LookupEnv(key)
+			if value != expected.value || set != expected.set {
+				t.Errorf("%s: expected %s=%q (set: %v), got %q (set: %v)", step, key, expected.value, expected.set, value, set)
+			}
+		}
+	}
+
+	ApplyConfigFile(map[string]string{
+		"CONFIG_TEST_CHANGED": "file 1",
+		"CONFIG_TEST_ADDED":   "file 1",
+	})
+	expectEnv(t, "first file", map[string]envValue{
+		"CONFIG_TEST_KEPT":    {"env", true},
+		"CONFIG_TEST_CHANGED": {"file 1", true},
+		"CONFIG_TEST_ADDED":   {"file 1", true},
+	})
+
+	// Keys dropped from the file get their original value back.
+	undo := ApplyConfigFile(map[string]string{
+		"CONFIG_TEST_CHANGED": "file 2",
+	})
+	expectEnv(t, "second file", map[string]envValue{
+		"CONFIG_TEST_KEPT":    {"env", true},
+		"CONFIG_TEST_CHANGED": {"file 2", true},
+		"CONFIG_TEST_ADDED":   {"", false},
+	})
+
+	// Undoing a rejected file brings back the previous one.
+	undo()
+	expectEnv(t, "undo of the second file", map[string]envValue{
+		"CONFIG_TEST_KEPT":    {"env", true},
+		"CONFIG_TEST_CHANGED": {"file 1", true},
+		"CONFIG_TEST_ADDED":   {"file 1", true},
+	})
+
+	// The originals survive the undo, so emptying the file restores the
+	// environment the process was started with.
+	ApplyConfigFile(map[string]string{})
+	expectEnv(t, "empty file", map[string]envValue{
+		"CONFIG_TEST_KEPT":    {"env", true},
+		"CONFIG_TEST_CHANGED": {"env", true},
+		"CONFIG_TEST_ADDED":   {"", false},
+	})
+	if len(configFileOriginals) != 0 {
+		t.Errorf("Expected no overridden keys to be left, got %v", configFileOriginals)
+	}
+}
+
+func TestApplyConfigFileResetsCaches(t *testing.T) {
+	configFileOriginals = make(map[string]originalEnv)
+	defer func() { configFileOriginals = make(map[string]originalEnv) }()
+	defer ResetCaches()
+
+	t.Setenv("CONFIG_TEST_FILTER_1", "env")
+	ResetCaches()
+	if got := GetFilters("CONFIG_TEST_FILTER"); !reflect.DeepEqual(got, []string{"env"}) {
+		t.Fatalf("Expected the filter of the environment, got %v", got)
+	}
+
+	undo := ApplyConfigFile(map[string]string{"CONFIG_TEST_FILTER_1": "file"})
+	if got := GetFilters("CONFIG_TEST_FILTER"); !reflect.DeepEqual(got, []string{"file"}) {
+		t.Errorf("Expected the filter of the config file, got %v", got)
+	}
+
+	undo()
+	if got := GetFilters("CONFIG_TEST_FILTER"); !reflect.DeepEqual(got, []string{"env"}) {
+		t.Errorf("Expected the filter of the environment after undo, got %v", got)
+	}
+}
@@ -3,6 +3,7 @@ package utils
 import (
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -25,9 +26,13 @@ func GetEnv(env string) string {
 var (
 	m3uIndexes         []string
 	m3uIndexesOnce = new(sync.Once)
+	m3uIndexesMutex    sync.Mutex
 )
 
 func GetM3UIndexes() []string {
+	m3uIndexesMutex.Lock()
+	defer m3uIndexesMutex.Unlock()
+
 	m3uIndexesOnce.Do(func() {
 		for _, env := range os.Environ() {
 			pair := strings.SplitN(env, "=", 2)
@@ -45,6 +50,8 @@ var (
 	filterMutex sync.RWMutex
 )
 
+// GetFilters returns the values of the env vars named baseEnv_X, where X is
+// an integer, in the order of X.
 func GetFilters(baseEnv string) []string {
 	filterMutex.RLock()
 	if cached, ok := filters[baseEnv]; ok {
@@ -60,7 +67,12 @@ func GetFilters(baseEnv string) []string {
 		return cached
 	}
 
-	var envFilters []string
+	type indexedFilter struct {
+		index int
+		value string
+	}
+
+	var indexed []indexedFilter
 	prefix := fmt.Sprintf("%s_", baseEnv)
 	for _, env := range os.Environ() {
 		pair := strings.SplitN(env, "=", 2)
@@ -68,19 +80,30 @@ func GetFilters(baseEnv string) []string {
 			// Remove the prefix (e.g. "FILTER_")
 			indexStr := strings.TrimPrefix(pair[0], prefix)
 			// Ensure the suffix is an integer.
-			if _, err := strconv.Atoi(indexStr); err != nil {
+			index, err := strconv.Atoi(indexStr)
+			if err != nil {
 				continue
 			}
-			envFilters = append(envFilters, pair[1])
+			indexed = append(indexed, indexedFilter{index: index, value: pair[1]})
 		}
 	}
+	sort.SliceStable(indexed, func(i, j int) bool {
+		return indexed[i].index < indexed[j].index
+	})
+
+	var envFilters []string
+	for _, filter := range indexed {
+		envFilters = append(envFilters, filter.value)
+	}
 	filters[baseEnv] = envFilters
 	return envFilters
 }
 
 func ResetCaches() {
+	m3uIndexesMutex.Lock()
 	m3uIndexesOnce = new(sync.Once)
 	m3uIndexes = nil
+	m3uIndexesMutex.Unlock()
 
 	filterMutex.Lock()
 	filters = make(map[string][]string)
@@ -5,32 +5,37 @@ import (
 	"net/http"
 	"os"
 	"strings"
+
+	"m3u-stream-merger/logger"
 )
 
 var HTTPClient = &http.Client{
-	CheckRedirect: func(req *http.Request, via []*http.Request) error {
-		userAgent := GetEnv("USER_AGENT")
+	CheckRedirect: preserveUserAgent,
+}
 
-		// Follow redirects while preserving the custom User-Agent header
-		req.Header.Set("User-Agent", userAgent)
-		fmt.Printf("Redirect : %s , %s\n", req.URL, via[0].URL)
+func preserveUserAgent(req *http.Request, via []*http.Request) error {
+	userAgent := via[0].Header.Get("User-Agent")
+	if userAgent == "" {
+		userAgent = GetEnv("USER_AGENT")
+	}
 
-		return nil
-	},
-}
+	// Follow redirects while preserving the custom User-Agent header
+	req.Header.Set("User-Agent", userAgent)
+	logger.Default.Debugf("Redirect: %s, %s", req.URL, via[0].URL)
 
-func CustomHttpRequest(method string, url string) (*http.Response, error) {
-	userAgent := GetEnv("USER_AGENT")
+	return nil
+}
 
-	// Create a new HTTP client with a custom User-Agent header
+func CustomHttpRequest(method string, url string, index string) (*http.Response, error) {
+	// Create a new HTTP request with the headers configured for the source
 	req, err := http.NewRequest(method, url, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("User-Agent", userAgent)
+	ApplySourceHeaders(req, index)
 
-	resp, err := HTTPClient.Do(req)
+	resp, err := GetSourceHTTPClient(index).Do(req)
 	if err != nil {
 		return nil, err
 	}
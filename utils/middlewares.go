@@ -5,6 +5,7 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 )
 
 func GeneralParser(value string) string {
@@ -15,18 +16,44 @@ func GeneralParser(value string) string {
 	return value
 }
 
-func TvgNameParser(value string) string {
+var (
+	substrFilterMutex   sync.Mutex
+	substrFilterPattern string
+	substrFilterRegex   *regexp.Regexp
+)
+
+// getSubstrFilter returns the compiled TITLE_SUBSTR_FILTER. It is only
+// compiled again when the setting changes, e.g. on a config reload.
+func getSubstrFilter() *regexp.Regexp {
 	substrFilter := os.Getenv("TITLE_SUBSTR_FILTER")
-	// Apply character filter
+
+	substrFilterMutex.Lock()
+	defer substrFilterMutex.Unlock()
+
+	if substrFilter == substrFilterPattern {
+		return substrFilterRegex
+	}
+
+	substrFilterPattern = substrFilter
+	substrFilterRegex = nil
 	if substrFilter != "" {
 		re, err := regexp.Compile(substrFilter)
 		if err != nil {
 			logger.Default.Errorf("Error compiling character filter regex: %v", err)
 		} else {
-			value = re.ReplaceAllString(value, "")
+			substrFilterRegex = re
 		}
 	}
 
+	return substrFilterRegex
+}
+
+func TvgNameParser(value string) string {
+	// Apply character filter
+	if re := getSubstrFilter(); re != nil {
+		value = re.ReplaceAllString(value, "")
+	}
+
 	return GeneralParser(value)
 }
 
@@ -0,0 +1,163 @@
+package utils
+
+import (
+	"encoding/base64"
+	"fmt"
+	"m3u-stream-merger/logger"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// getSourceSetting returns the per-source setting M3U_<name>_<index>.
+func getSourceSetting(name string, index string) string {
+	if index == "" {
+		return ""
+	}
+	return strings.TrimSpace(os.Getenv(fmt.Sprintf("M3U_%s_%s", name, index)))
+}
+
+// GetSourceUserAgent returns the User-Agent used for requests made to the
+// given M3U index, falling back to the global USER_AGENT.
+func GetSourceUserAgent(index string) string {
+	if userAgent := getSourceSetting("USER_AGENT", index); userAgent != "" {
+		return userAgent
+	}
+	return GetEnv("USER_AGENT")
+}
+
+// GetSourceHeaders returns the extra headers configured for the given M3U
+// index. M3U_HEADERS_X holds "Key: value" pairs separated by "|", while
+// M3U_REFERER_X, M3U_COOKIES_X, M3U_BASIC_AUTH_X (user:pass) and
+// M3U_BEARER_TOKEN_X are shorthands for the matching headers.
+func GetSourceHeaders(index string) http.Header {
+	headers := http.Header{}
+
+	for _, pair := range strings.Split(getSourceSetting("HEADERS", index), "|") {
+		key, value, ok := strings.Cut(pair, ":")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			continue
+		}
+		headers.Add(key, strings.TrimSpace(value))
+	}
+
+	if referer := getSourceSetting("REFERER", index); referer != "" {
+		headers.Set("Referer", referer)
+	}
+
+	if cookies := getSourceSetting("COOKIES", index); cookies != "" {
+		headers.Set("Cookie", cookies)
+	}
+
+	if basicAuth := getSourceSetting("BASIC_AUTH", index); basicAuth != "" {
+		headers.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(basicAuth)))
+	} else if token := getSourceSetting("BEARER_TOKEN", index); token != "" {
+		headers.Set("Authorization", "Bearer "+token)
+	}
+
+	return headers
+}
+
+// ApplySourceHeaders sets the User-Agent and the extra headers configured
+// for the given M3U index on an outgoing request.
+func ApplySourceHeaders(req *http.Request, index string) {
+	req.Header.Set("User-Agent", GetSourceUserAgent(index))
+
+	for key, values := range GetSourceHeaders(index) {
+		req.Header.Del(key)
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+}
+
+// parseSourceProxy parses the value of M3U_PROXY_X. Only HTTP, HTTPS and
+// SOCKS5 proxies are supported.
+func parseSourceProxy(proxy string) (*url.URL, error) {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q, expected http, https or socks5", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("missing host in %q", proxy)
+	}
+	return proxyURL, nil
+}
+
+// ValidateSourceProxies reports the M3U_PROXY_X settings that aren't valid
+// proxy URLs.
+func ValidateSourceProxies() error {
+	var names []string
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if strings.HasPrefix(name, "M3U_PROXY_") && strings.TrimSpace(value) != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, err := parseSourceProxy(strings.TrimSpace(os.Getenv(name))); err != nil {
+			return fmt.Errorf("invalid %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// proxyErrorTransport refuses every request. It is used for sources with an
+// invalid proxy, so that their requests never leave without the proxy.
+type proxyErrorTransport struct {
+	err error
+}
+
+func (t proxyErrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	return nil, t.err
+}
+
+var sourceClients sync.Map // map[string]*http.Client, keyed by index and proxy
+
+// GetSourceHTTPClient returns the HTTP client used for requests made to the
+// given M3U index. Sources with M3U_PROXY_X set get their own transport that
+// goes through the configured HTTP or SOCKS5 proxy, and whose requests fail if
+// the proxy is invalid; all other sources share HTTPClient.
+func GetSourceHTTPClient(index string) *http.Client {
+	proxy := getSourceSetting("PROXY", index)
+	if proxy == "" {
+		return HTTPClient
+	}
+
+	key := index + "|" + proxy
+	if client, ok := sourceClients.Load(key); ok {
+		return client.(*http.Client)
+	}
+
+	proxyURL, err := parseSourceProxy(proxy)
+	if err != nil {
+		logger.Default.Errorf("Invalid M3U_PROXY_%s, refusing its requests: %v", index, err)
+		client, _ := sourceClients.LoadOrStore(key, &http.Client{
+			Transport: proxyErrorTransport{err: fmt.Errorf("invalid M3U_PROXY_%s: %v", index, err)},
+		})
+		return client.(*http.Client)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyURL)
+
+	client, _ := sourceClients.LoadOrStore(key, &http.Client{
+		Transport:     transport,
+		CheckRedirect: preserveUserAgent,
+	})
+	return client.(*http.Client)
+}